@@ -0,0 +1,68 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+const (
+	// AutoAckBefore commits message before its handlers invoked, default of implicit mode,
+	// message held by Delay middleware committed once due and dispatched again
+	AutoAckBefore AckStrategy = iota
+	// AutoAckAfterSuccess commits message only when its whole handler chain returns nil
+	AutoAckAfterSuccess
+	// Manual commits message when handler calls Context.Ack, default of explicit mode
+	Manual
+)
+
+// AckStrategy decides when message of a route is committed
+type AckStrategy int
+
+func (a AckStrategy) String() string {
+	switch a {
+	case AutoAckAfterSuccess:
+		return "auto-ack-after-success"
+	case Manual:
+		return "manual"
+	default:
+		return "auto-ack-before"
+	}
+}
+
+// ackStrategy returns strategy of route handling message topic and key,
+// routes without strategy follow implicit or explicit mode of the stream
+func (s *Stream) ackStrategy(topic string, key string) AckStrategy {
+	strategy, ok := s.noRouteAck, s.noRouteAcked
+	if _, routed := s.topicHandlers[route{topic: topic, key: key}]; routed {
+		strategy, ok = s.topicAcks[route{topic: topic, key: key}]
+	} else if _, routed := s.handlers[key]; routed {
+		strategy, ok = s.acks[key]
+	}
+	switch {
+	case ok:
+		return strategy
+	case s.cm == implicit:
+		return AutoAckBefore
+	default:
+		return Manual
+	}
+}
+
+func (s *Stream) setAckStrategy(key string, strategy AckStrategy) {
+	s.acks[key] = strategy
+}
+
+func (s *Stream) setTopicAckStrategy(topic string, key string, strategy AckStrategy) {
+	s.topicAcks[route{topic: topic, key: key}] = strategy
+}
+
+func (s *Stream) setNoRouteAckStrategy(strategy AckStrategy) {
+	s.noRouteAck, s.noRouteAcked = strategy, true
+}
+
+// autoAck commits message of reader with GroupID like reading it does
+func (s *Stream) autoAck(ctx *octx) error {
+	if len(s.reader.Config().GroupID) == 0 {
+		return nil
+	}
+	return ctx.Ack()
+}
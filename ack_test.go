@@ -0,0 +1,118 @@
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type TestAckSuite struct {
+	suite.Suite
+}
+
+func TestAckTestSuite(t *testing.T) {
+	suite.Run(t, new(TestAckSuite))
+}
+
+func (suite *TestAckSuite) TestAckStrategy() {
+	suite.Run("TestAckStrategy", func() {
+		suite.Assert().Equal(AutoAckBefore.String(), "auto-ack-before")
+		suite.Assert().Equal(AutoAckAfterSuccess.String(), "auto-ack-after-success")
+		suite.Assert().Equal(Manual.String(), "manual")
+
+		handlerFunc := func(ctx Context) error {
+			return nil
+		}
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(NewMemoryTransport())))
+		consumer.Handler("create.foo", handlerFunc)
+		event := consumer.Group("event")
+		event.AckStrategy(AutoAckAfterSuccess)
+		event.Handler("bar", handlerFunc)
+		notification := event.Group("notification")
+		notification.Handler("blast", handlerFunc)
+		consumer.AckStrategy(Manual)
+		consumer.NoRoute(handlerFunc)
+
+		// routes without strategy follow stream mode
+		s := consumer.stream
+		suite.Assert().Equal(s.ackStrategy("foos", "create.foo"), AutoAckBefore)
+		suite.Assert().Equal(s.ackStrategy("foos", "event.bar"), AutoAckAfterSuccess)
+		suite.Assert().Equal(s.ackStrategy("foos", "notification.blast"), AutoAckAfterSuccess)
+		suite.Assert().Equal(s.ackStrategy("foos", "delete.foo"), Manual)
+
+		consumer.Explicit()
+		suite.Assert().Equal(s.ackStrategy("foos", "create.foo"), Manual)
+		suite.Assert().Equal(s.ackStrategy("foos", "event.bar"), AutoAckAfterSuccess)
+
+		implicit := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(NewMemoryTransport())))
+		implicit.AckStrategy(AutoAckBefore)
+		implicit.Handler("create.foo", handlerFunc)
+		suite.Assert().Equal(implicit.stream.ackStrategy("foos", "create.foo"), AutoAckBefore)
+	})
+}
+
+func (suite *TestAckSuite) TestStreamAckStrategy() {
+	suite.Run("TestStreamAckStrategy", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		committed := func() int64 {
+			return transport.CommittedOffset("consumer-group-foos", "foos", 0)
+		}
+
+		var committedBefore []int64
+		consumer.Handler("create.foo", func(ctx Context) error {
+			committedBefore = append(committedBefore, committed())
+			return errors.New("invalid foo")
+		})
+		event := consumer.Group("event")
+		event.AckStrategy(AutoAckAfterSuccess)
+		event.Handler("bar", func(ctx Context) error {
+			if ctx.ValueString() == "failing" {
+				return errors.New("payment unavailable")
+			}
+			return nil
+		})
+		event.AckStrategy(Manual)
+		event.Handler("baz", func(ctx Context) error {
+			if ctx.ValueString() == "ack" {
+				return ctx.Ack()
+			}
+			return nil
+		})
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("failing")},
+			kafka.Message{Key: []byte("event.bar"), Value: []byte("succeeding")},
+			kafka.Message{Key: []byte("event.bar"), Value: []byte("failing")},
+			kafka.Message{Key: []byte("event.baz"), Value: []byte("skip")},
+			kafka.Message{Key: []byte("event.baz"), Value: []byte("ack")},
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("failing")},
+		))
+
+		// implicit route committed before its handler even though it failed
+		suite.Assert().NotNil(consumer.Poll(ctx))
+		suite.Assert().Equal(committedBefore, []int64{1})
+
+		// committed only when the whole chain succeeded
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Equal(committed(), int64(2))
+		suite.Assert().NotNil(consumer.Poll(ctx))
+		suite.Assert().Equal(committed(), int64(2))
+
+		// committed by handler
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Equal(committed(), int64(2))
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Equal(committed(), int64(5))
+
+		suite.Assert().NotNil(consumer.Poll(ctx))
+		suite.Assert().Equal(committedBefore, []int64{1, 6})
+	})
+}
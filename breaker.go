@@ -0,0 +1,277 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+type BreakerState int
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerConfig thresholds of circuit breaker, breaker opens when one of
+// enabled threshold reached, zero threshold is disabled
+type BreakerConfig struct {
+	// ConsecutiveFailures opens breaker after n failures in a row,
+	// default 5 when FailureRate is not set either
+	ConsecutiveFailures int
+	// FailureRate opens breaker when ratio of failures between 0 and 1
+	// within Window reached, evaluated after MinRequests messages
+	FailureRate float64
+	MinRequests int
+	// Window of failure rate, default 1 minute
+	Window time.Duration
+	// OpenTimeout is how long breaker stays open before half-open, default 30 seconds
+	OpenTimeout time.Duration
+	// HalfOpenProbes successful messages needed to close half-open breaker, default 1
+	HalfOpenProbes int
+	// IsFailure reports whether handler error counted as failure, default every error
+	IsFailure func(err error) bool
+	// OnStateChange invoked every time breaker changes its state
+	OnStateChange func(from, to BreakerState)
+}
+
+// Breaker circuit breaker middleware pausing every bound consumer while open,
+// message handled while breaker opens is held and handled again once resumed
+// instead of failing, half-open breaker resumes consumers and lets probe
+// messages through, it closes after enough probes succeed or opens again
+// when a probe fails
+type Breaker struct {
+	config      BreakerConfig
+	consumers   []*Consumer
+	state       BreakerState
+	consecutive int
+	buckets     []breakerBucket
+	probes      int
+	successes   int
+	openUntil   time.Time
+	generation  int
+	changed     chan struct{}
+	lock        sync.Mutex
+}
+
+type breakerBucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+func NewBreaker(config BreakerConfig) *Breaker {
+	if config.ConsecutiveFailures <= 0 && config.FailureRate <= 0 {
+		config.ConsecutiveFailures = 5
+	}
+	if config.Window <= 0 {
+		config.Window = time.Minute
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = 30 * time.Second
+	}
+	if config.HalfOpenProbes <= 0 {
+		config.HalfOpenProbes = 1
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = func(err error) bool {
+			return true
+		}
+	}
+	return &Breaker{config: config, changed: make(chan struct{})}
+}
+
+// Bind registers breaker middleware into consumer, consumer paused
+// while breaker open, breaker can be shared by multiple consumers
+func (b *Breaker) Bind(consumer *Consumer) {
+	b.lock.Lock()
+	b.consumers = append(b.consumers, consumer)
+	b.lock.Unlock()
+	consumer.Use(b.middleware)
+}
+
+func (b *Breaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+func (b *Breaker) middleware(next HandlerFunc) HandlerFunc {
+	return func(ctx Context) error {
+		for {
+			b.lock.Lock()
+			state, generation := b.state, b.generation
+			switch state {
+			case BreakerOpen:
+				until := b.openUntil
+				b.lock.Unlock()
+				return &delayed{until: until}
+			case BreakerHalfOpen:
+				if b.probes >= b.config.HalfOpenProbes {
+					changed := b.changed
+					b.lock.Unlock()
+					select {
+					case <-changed:
+						continue
+					case <-ctx.OuterContext().Done():
+						return ctx.OuterContext().Err()
+					}
+				}
+				b.probes++
+			}
+			b.lock.Unlock()
+
+			err := next(ctx)
+			b.record(state, generation, err)
+			return err
+		}
+	}
+}
+
+// record counts result of message handled while breaker in given state,
+// result of probe from previous half-open period is ignored
+func (b *Breaker) record(state BreakerState, generation int, err error) {
+	var d *delayed
+	held := errors.As(err, &d)
+	failed := err != nil && !held && b.config.IsFailure(err)
+
+	b.lock.Lock()
+	from := b.state
+	switch {
+	case state == BreakerHalfOpen && b.state == BreakerHalfOpen && b.generation == generation:
+		b.probes--
+		if held {
+			break
+		}
+		if failed {
+			b.open()
+			break
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenProbes {
+			b.close()
+		}
+	case b.state == BreakerClosed && !held:
+		b.add(time.Now(), failed)
+		if b.tripped() {
+			b.open()
+		}
+	}
+	to := b.state
+	b.lock.Unlock()
+
+	b.notify(from, to)
+}
+
+// add records message result into failure rate window
+// caller must hold breaker lock
+func (b *Breaker) add(now time.Time, failed bool) {
+	if failed {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+
+	size := b.config.Window / 10
+	if size <= 0 {
+		size = b.config.Window
+	}
+	for len(b.buckets) != 0 && now.Sub(b.buckets[0].start) >= b.config.Window {
+		b.buckets = b.buckets[1:]
+	}
+	if len(b.buckets) == 0 || now.Sub(b.buckets[len(b.buckets)-1].start) >= size {
+		b.buckets = append(b.buckets, breakerBucket{start: now})
+	}
+	bucket := &b.buckets[len(b.buckets)-1]
+	bucket.total++
+	if failed {
+		bucket.failures++
+	}
+}
+
+// tripped caller must hold breaker lock
+func (b *Breaker) tripped() bool {
+	if b.config.ConsecutiveFailures > 0 && b.consecutive >= b.config.ConsecutiveFailures {
+		return true
+	}
+	if b.config.FailureRate <= 0 {
+		return false
+	}
+
+	var total, failures int
+	for _, bucket := range b.buckets {
+		total += bucket.total
+		failures += bucket.failures
+	}
+	return total != 0 && total >= b.config.MinRequests &&
+		float64(failures)/float64(total) >= b.config.FailureRate
+}
+
+// open pauses bound consumers and half-opens breaker after open timeout,
+// pause is held on behalf of breaker so it does not release pause set by
+// Consumer.Pause or other breakers, caller must hold breaker lock
+func (b *Breaker) open() {
+	b.state = BreakerOpen
+	b.openUntil = time.Now().Add(b.config.OpenTimeout)
+	b.reset()
+	for _, consumer := range b.consumers {
+		consumer.stream.pauser.hold(b)
+	}
+	time.AfterFunc(b.config.OpenTimeout, b.halfOpen)
+}
+
+func (b *Breaker) halfOpen() {
+	b.lock.Lock()
+	from := b.state
+	if from == BreakerOpen {
+		b.state = BreakerHalfOpen
+		b.reset()
+		for _, consumer := range b.consumers {
+			consumer.stream.pauser.release(b)
+		}
+	}
+	to := b.state
+	b.lock.Unlock()
+
+	b.notify(from, to)
+}
+
+// close caller must hold breaker lock
+func (b *Breaker) close() {
+	b.state = BreakerClosed
+	b.reset()
+}
+
+// reset clears counters and wakes up messages waiting for probe
+// caller must hold breaker lock
+func (b *Breaker) reset() {
+	b.consecutive = 0
+	b.buckets = nil
+	b.probes = 0
+	b.successes = 0
+	b.generation++
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *Breaker) notify(from, to BreakerState) {
+	if from != to && b.config.OnStateChange != nil {
+		b.config.OnStateChange(from, to)
+	}
+}
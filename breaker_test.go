@@ -0,0 +1,278 @@
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type TestBreakerSuite struct {
+	suite.Suite
+}
+
+func TestBreakerTestSuite(t *testing.T) {
+	suite.Run(t, new(TestBreakerSuite))
+}
+
+var errPaymentUnavailable = errors.New("payment unavailable")
+
+func newBreakerContext() *octx {
+	return newContext(context.Background(), nil, kafka.Message{Key: []byte("create.foo")}, nil)
+}
+
+func (suite *TestBreakerSuite) TestBreakerState() {
+	suite.Run("TestBreakerState", func() {
+		suite.Assert().Equal(BreakerClosed.String(), "closed")
+		suite.Assert().Equal(BreakerOpen.String(), "open")
+		suite.Assert().Equal(BreakerHalfOpen.String(), "half-open")
+
+		b := NewBreaker(BreakerConfig{})
+		suite.Assert().Equal(b.config.ConsecutiveFailures, 5)
+		suite.Assert().Equal(b.config.Window, time.Minute)
+		suite.Assert().Equal(b.config.OpenTimeout, 30*time.Second)
+		suite.Assert().Equal(b.config.HalfOpenProbes, 1)
+		suite.Assert().True(b.config.IsFailure(errPaymentUnavailable))
+	})
+}
+
+func (suite *TestBreakerSuite) TestBreakerConsecutiveFailures() {
+	suite.Run("TestBreakerConsecutiveFailures", func() {
+		var lock sync.Mutex
+		var changes []string
+		b := NewBreaker(BreakerConfig{
+			ConsecutiveFailures: 2,
+			OpenTimeout:         20 * time.Millisecond,
+			OnStateChange: func(from, to BreakerState) {
+				lock.Lock()
+				defer lock.Unlock()
+				changes = append(changes, from.String()+">"+to.String())
+			},
+		})
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(NewMemoryTransport())))
+		b.Bind(consumer)
+		suite.Assert().Len(consumer.stream.middlewares, 1)
+
+		var failing error = errPaymentUnavailable
+		handler := b.middleware(func(ctx Context) error {
+			return failing
+		})
+
+		// success resets consecutive failures
+		suite.Assert().ErrorIs(handler(newBreakerContext()), errPaymentUnavailable)
+		failing = nil
+		suite.Assert().Nil(handler(newBreakerContext()))
+		failing = errPaymentUnavailable
+		suite.Assert().ErrorIs(handler(newBreakerContext()), errPaymentUnavailable)
+		suite.Assert().Equal(b.State(), BreakerClosed)
+		suite.Assert().ErrorIs(handler(newBreakerContext()), errPaymentUnavailable)
+		suite.Assert().Equal(b.State(), BreakerOpen)
+		suite.Assert().True(consumer.Paused())
+
+		// message handled while open is held until breaker half-open
+		var d *delayed
+		suite.Assert().True(errors.As(handler(newBreakerContext()), &d))
+
+		// failed probe opens breaker again
+		suite.Assert().Eventually(func() bool {
+			return b.State() == BreakerHalfOpen
+		}, time.Second, time.Millisecond)
+		suite.Assert().False(consumer.Paused())
+		suite.Assert().ErrorIs(handler(newBreakerContext()), errPaymentUnavailable)
+		suite.Assert().Equal(b.State(), BreakerOpen)
+		suite.Assert().True(consumer.Paused())
+
+		// successful probe closes breaker
+		suite.Assert().Eventually(func() bool {
+			return b.State() == BreakerHalfOpen
+		}, time.Second, time.Millisecond)
+		failing = nil
+		suite.Assert().Nil(handler(newBreakerContext()))
+		suite.Assert().Equal(b.State(), BreakerClosed)
+		suite.Assert().False(consumer.Paused())
+
+		lock.Lock()
+		defer lock.Unlock()
+		suite.Assert().Equal(changes, []string{
+			"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed",
+		})
+	})
+}
+
+func (suite *TestBreakerSuite) TestBreakerFailureRate() {
+	suite.Run("TestBreakerFailureRate", func() {
+		b := NewBreaker(BreakerConfig{
+			FailureRate: 0.5,
+			MinRequests: 4,
+			OpenTimeout: time.Minute,
+			IsFailure: func(err error) bool {
+				return errors.Is(err, errPaymentUnavailable)
+			},
+		})
+		var failing error
+		handler := b.middleware(func(ctx Context) error {
+			return failing
+		})
+
+		suite.Assert().Nil(handler(newBreakerContext()))
+		failing = errors.New("invalid foo")
+		suite.Assert().NotNil(handler(newBreakerContext()))
+		failing = errPaymentUnavailable
+		suite.Assert().NotNil(handler(newBreakerContext()))
+
+		// not enough messages within window yet
+		suite.Assert().Equal(b.State(), BreakerClosed)
+		suite.Assert().NotNil(handler(newBreakerContext()))
+		suite.Assert().Equal(b.State(), BreakerOpen)
+	})
+}
+
+func (suite *TestBreakerSuite) TestBreakerHalfOpenProbes() {
+	suite.Run("TestBreakerHalfOpenProbes", func() {
+		b := NewBreaker(BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: 10 * time.Millisecond})
+		probing := make(chan struct{})
+		release := make(chan struct{})
+		var calls int32
+		handler := b.middleware(func(ctx Context) error {
+			switch atomic.AddInt32(&calls, 1) {
+			case 1:
+				return errPaymentUnavailable
+			case 2:
+				probing <- struct{}{}
+				<-release
+			}
+			return nil
+		})
+
+		suite.Assert().ErrorIs(handler(newBreakerContext()), errPaymentUnavailable)
+		suite.Assert().Eventually(func() bool {
+			return b.State() == BreakerHalfOpen
+		}, time.Second, time.Millisecond)
+
+		// second message waits until probe finished
+		results := make(chan error, 2)
+		go func() {
+			results <- handler(newBreakerContext())
+		}()
+		<-probing
+		go func() {
+			results <- handler(newBreakerContext())
+		}()
+		time.Sleep(10 * time.Millisecond)
+		suite.Assert().Len(results, 0)
+
+		close(release)
+		suite.Assert().Nil(<-results)
+		suite.Assert().Nil(<-results)
+		suite.Assert().Equal(b.State(), BreakerClosed)
+	})
+}
+
+func (suite *TestBreakerSuite) TestBreakerOwnPause() {
+	suite.Run("TestBreakerOwnPause", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(NewMemoryTransport())))
+		first := NewBreaker(BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: 20 * time.Millisecond})
+		second := NewBreaker(BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: 100 * time.Millisecond})
+		first.Bind(consumer)
+		second.Bind(consumer)
+		failing := func(ctx Context) error {
+			return errPaymentUnavailable
+		}
+
+		// half-open breaker keeps pause of partition and of other open breaker
+		consumer.stream.pauser.pausePartition(topicPartition{topic: "foos"}, time.Minute)
+		suite.Assert().ErrorIs(first.middleware(failing)(newBreakerContext()), errPaymentUnavailable)
+		suite.Assert().ErrorIs(second.middleware(failing)(newBreakerContext()), errPaymentUnavailable)
+		suite.Assert().Eventually(func() bool {
+			return first.State() == BreakerHalfOpen
+		}, time.Second, time.Millisecond)
+		suite.Assert().True(consumer.Paused())
+		suite.Assert().Len(consumer.State().Partitions, 1)
+
+		suite.Assert().Eventually(func() bool {
+			return second.State() == BreakerHalfOpen
+		}, time.Second, time.Millisecond)
+		suite.Assert().False(consumer.Paused())
+		suite.Assert().Len(consumer.State().Partitions, 1)
+
+		// half-open breaker keeps manual pause, Resume keeps pause of open breaker
+		suite.Assert().ErrorIs(first.middleware(failing)(newBreakerContext()), errPaymentUnavailable)
+		consumer.Pause()
+		suite.Assert().Eventually(func() bool {
+			return first.State() == BreakerHalfOpen
+		}, time.Second, time.Millisecond)
+		suite.Assert().True(consumer.Paused())
+
+		suite.Assert().ErrorIs(first.middleware(failing)(newBreakerContext()), errPaymentUnavailable)
+		consumer.Resume()
+		suite.Assert().True(consumer.Paused())
+		suite.Assert().Eventually(func() bool {
+			return !consumer.Paused()
+		}, time.Second, time.Millisecond)
+	})
+}
+
+func (suite *TestBreakerSuite) TestBreakerStream() {
+	suite.Run("TestBreakerStream", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Explicit()
+
+		var lock sync.Mutex
+		down := true
+		var handled []string
+		var failed []string
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if down {
+				failed = append(failed, ctx.ValueString())
+				return errPaymentUnavailable
+			}
+			handled = append(handled, ctx.ValueString())
+			return ctx.Ack()
+		})
+		b := NewBreaker(BreakerConfig{ConsecutiveFailures: 2, OpenTimeout: 50 * time.Millisecond})
+		b.Bind(consumer)
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		for _, value := range []string{"1", "2", "3", "4"} {
+			suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create.foo"), Value: []byte(value)}))
+		}
+
+		suite.Assert().Eventually(func() bool {
+			return b.State() == BreakerOpen
+		}, time.Second, time.Millisecond)
+		suite.Assert().True(consumer.State().Paused)
+		lock.Lock()
+		down = false
+		lock.Unlock()
+
+		// held messages handled once breaker half-open instead of failing
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(handled) == 2
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		suite.Assert().Equal(failed, []string{"1", "2"})
+		suite.Assert().Equal(handled, []string{"3", "4"})
+		suite.Assert().Equal(b.State(), BreakerClosed)
+	})
+}
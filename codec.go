@@ -0,0 +1,47 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codec encodes and decodes message value, registered through
+// IConsumer.Codec and used by Context.ShouldBind and typed handlers
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// DecodeError returned when message value cannot be decoded
+// by configured Codec, contains message key and decoder error
+type DecodeError struct {
+	Key string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode message %s: %s", e.Key, e.Err.Error())
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+type jsonCodec struct{}
+
+// JSONCodec returns default codec using encoding/json
+func JSONCodec() Codec {
+	return jsonCodec{}
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,40 @@
+package oni
+
+import (
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type TestCodecSuite struct {
+	suite.Suite
+}
+
+func TestCodecTestSuite(t *testing.T) {
+	suite.Run(t, new(TestCodecSuite))
+}
+
+func (suite *TestCodecSuite) TestJSONCodec() {
+	suite.Run("TestJSONCodec", func() {
+		type dummyStruct struct {
+			Content string `json:"content"`
+		}
+
+		b, err := JSONCodec().Marshal(dummyStruct{Content: "this is message content"})
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(b), "{\"content\":\"this is message content\"}")
+
+		var ds dummyStruct
+		suite.Assert().Nil(JSONCodec().Unmarshal(b, &ds))
+		suite.Assert().Equal(ds.Content, "this is message content")
+	})
+}
+
+func (suite *TestCodecSuite) TestDecodeError() {
+	suite.Run("TestDecodeError", func() {
+		cause := errors.New("unexpected end of JSON input")
+		err := error(&DecodeError{Key: "event.create.bar", Err: cause})
+		suite.Assert().Equal(err.Error(), "decode message event.create.bar: unexpected end of JSON input")
+		suite.Assert().True(errors.Is(err, cause))
+	})
+}
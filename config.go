@@ -0,0 +1,498 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultRunnerTimeout = 15 * time.Second
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Handlers binds handler to routing key declared by Config, key prefixed
+// by stream name and slash, for example foos/create.foo, is preferred
+// over plain key when the same key is declared by several streams
+type Handlers map[string]HandlerFunc
+
+// Config declares brokers, producers, streams and runner settings, loaded
+// by LoadConfig from yaml or json file, durations are written like 5s or 1m
+type Config struct {
+	Brokers   []string                  `json:"brokers" yaml:"brokers"`
+	Dialer    *DialerConfig             `json:"dialer" yaml:"dialer"`
+	Runner    RunnerConfig              `json:"runner" yaml:"runner"`
+	Producers map[string]ProducerConfig `json:"producers" yaml:"producers"`
+	Streams   map[string]StreamConfig   `json:"streams" yaml:"streams"`
+
+	transport    Transport
+	errorHandler ErrorCallbackFunc
+}
+
+// RunnerConfig timeout of graceful shutdown, default 15s, signals
+// starting it by name, default SIGINT and SIGTERM, and provisioning
+// of topics verified before runner started
+type RunnerConfig struct {
+	Timeout   string        `json:"timeout" yaml:"timeout"`
+	Signals   []string      `json:"signals" yaml:"signals"`
+	Provision *Provisioning `json:"provision" yaml:"provision"`
+}
+
+// DialerConfig connection of every reader and producer to brokers, client
+// id, dial timeout, default 10s, TLS and SASL authentication
+type DialerConfig struct {
+	ClientID string      `json:"client_id" yaml:"client_id"`
+	Timeout  string      `json:"timeout" yaml:"timeout"`
+	TLS      *TLSConfig  `json:"tls" yaml:"tls"`
+	SASL     *SASLConfig `json:"sasl" yaml:"sasl"`
+}
+
+// TLSConfig enables TLS, CA file verifies brokers instead of system roots,
+// cert and key files given together authenticate client
+type TLSConfig struct {
+	CAFile             string `json:"ca_file" yaml:"ca_file"`
+	CertFile           string `json:"cert_file" yaml:"cert_file"`
+	KeyFile            string `json:"key_file" yaml:"key_file"`
+	ServerName         string `json:"server_name" yaml:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+}
+
+// SASLConfig mechanism plain, scram-sha-256 or scram-sha-512 with its credentials
+type SASLConfig struct {
+	Mechanism string `json:"mechanism" yaml:"mechanism"`
+	Username  string `json:"username" yaml:"username"`
+	Password  string `json:"password" yaml:"password"`
+}
+
+// ProducerConfig writer created from template basic, the default, or
+// batch_timeout which uses BatchTimeout
+type ProducerConfig struct {
+	Template     string `json:"template" yaml:"template"`
+	Topic        string `json:"topic" yaml:"topic"`
+	BatchTimeout string `json:"batch_timeout" yaml:"batch_timeout"`
+}
+
+// StreamConfig reader of one consumer subscribed to topic, topics or topic
+// pattern, every producer registered to its consumer unless Producers listed
+type StreamConfig struct {
+	Topic       string        `json:"topic" yaml:"topic"`
+	Topics      []string      `json:"topics" yaml:"topics"`
+	Pattern     string        `json:"pattern" yaml:"pattern"`
+	Refresh     string        `json:"refresh" yaml:"refresh"`
+	GroupID     string        `json:"group_id" yaml:"group_id"`
+	Mode        string        `json:"mode" yaml:"mode"`
+	Producers   []string      `json:"producers" yaml:"producers"`
+	InvalidWith string        `json:"invalid_with" yaml:"invalid_with"`
+	ReplyWith   string        `json:"reply_with" yaml:"reply_with"`
+	Routes      []RouteConfig `json:"routes" yaml:"routes"`
+	NoRoute     string        `json:"no_route" yaml:"no_route"`
+	Retry       *RetryConfig  `json:"retry" yaml:"retry"`
+}
+
+// RouteConfig keys of handlers registered through Consumer.Topic
+// and Consumer.Group when Topic or Group given, with ack strategy
+// auto-ack-before, auto-ack-after-success or manual
+type RouteConfig struct {
+	Topic    string   `json:"topic" yaml:"topic"`
+	Group    string   `json:"group" yaml:"group"`
+	Ack      string   `json:"ack" yaml:"ack"`
+	Handlers []string `json:"handlers" yaml:"handlers"`
+}
+
+// RetryConfig tiers and dead letter topic of stream RetryTopology
+type RetryConfig struct {
+	Tiers []string `json:"tiers" yaml:"tiers"`
+	DLQ   string   `json:"dlq" yaml:"dlq"`
+}
+
+// LoadConfig reads yaml or json file chosen by its extension, ${NAME} and
+// ${NAME:-default} replaced by environment variable before file parsed
+func LoadConfig(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := expandEnv(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	config := &Config{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = json.Unmarshal([]byte(content), config)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal([]byte(content), config)
+	default:
+		err = fmt.Errorf("unsupported extension %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func expandEnv(content string) (string, error) {
+	var missing []string
+	content = envPattern.ReplaceAllStringFunc(content, func(match string) string {
+		groups := envPattern.FindStringSubmatch(match)
+		if value, ok := os.LookupEnv(groups[1]); ok {
+			return value
+		}
+		if len(groups[2]) != 0 {
+			return groups[3]
+		}
+		missing = append(missing, groups[1])
+		return match
+	})
+	if len(missing) != 0 {
+		return "", fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return content, nil
+}
+
+// Transport replaces kafka transport used by every stream and producer
+func (c *Config) Transport(transport Transport) {
+	c.transport = transport
+}
+
+// ErrorHandler sets error handler of every consumer created by NewRunner
+func (c *Config) ErrorHandler(callbackFunc ErrorCallbackFunc) {
+	c.errorHandler = callbackFunc
+}
+
+// NewRunner creates consumer of every stream ordered by stream name with
+// handlers bound by their routing key, consumers of retry tiers included,
+// returns error listing every key without handler
+func (c *Config) NewRunner(ctx context.Context, handlers Handlers) (*Runner, error) {
+	runner := &Runner{Context: ctx, Timeout: defaultRunnerTimeout, Provisioning: c.Runner.Provision}
+	if len(c.Runner.Timeout) != 0 {
+		timeout, err := time.ParseDuration(c.Runner.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("runner timeout: %w", err)
+		}
+		runner.Timeout = timeout
+	}
+	signals, err := parseSignals(c.Runner.Signals)
+	if err != nil {
+		return nil, err
+	}
+	runner.Syscall = signals
+	dialer, err := c.dialer()
+	if err != nil {
+		return nil, fmt.Errorf("dialer: %w", err)
+	}
+
+	producers := make(map[string]ProducerFunc, len(c.Producers))
+	for name, producer := range c.Producers {
+		producerFunc, err := c.producer(producer, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("producer %s: %w", name, err)
+		}
+		producers[name] = producerFunc
+	}
+
+	names := make([]string, 0, len(c.Streams))
+	for name := range c.Streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// readers created so far leave their groups when runner is not returned
+	var missing []string
+	for _, name := range names {
+		consumers, unbound, err := c.consumers(name, c.Streams[name], dialer, producers, handlers)
+		runner.Consumers = append(runner.Consumers, consumers...)
+		if err != nil {
+			closeConsumers(runner.Consumers)
+			return nil, fmt.Errorf("stream %s: %w", name, err)
+		}
+		missing = append(missing, unbound...)
+	}
+	if len(missing) != 0 {
+		closeConsumers(runner.Consumers)
+		return nil, fmt.Errorf("handlers not bound: %s", strings.Join(missing, ", "))
+	}
+	return runner, nil
+}
+
+func closeConsumers(consumers []*Consumer) {
+	for _, consumer := range consumers {
+		_ = consumer.closeConsumers()
+	}
+}
+
+// dialer creates dialer of DialerConfig shared by readers and writers,
+// nil when not configured so kafka-go defaults are used
+func (c *Config) dialer() (*kafka.Dialer, error) {
+	if c.Dialer == nil {
+		return nil, nil
+	}
+	dialer := &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true, ClientID: c.Dialer.ClientID}
+	if len(c.Dialer.Timeout) != 0 {
+		timeout, err := time.ParseDuration(c.Dialer.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("timeout: %w", err)
+		}
+		dialer.Timeout = timeout
+	}
+	if c.Dialer.TLS != nil {
+		config, err := c.Dialer.TLS.config()
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		dialer.TLS = config
+	}
+	if c.Dialer.SASL != nil {
+		mechanism, err := c.Dialer.SASL.mechanism()
+		if err != nil {
+			return nil, fmt.Errorf("sasl: %w", err)
+		}
+		dialer.SASLMechanism = mechanism
+	}
+	return dialer, nil
+}
+
+func (t *TLSConfig) config() (*tls.Config, error) {
+	config := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.InsecureSkipVerify}
+	if len(t.CAFile) != 0 {
+		ca, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CAFile)
+		}
+	}
+	if len(t.CertFile) != 0 || len(t.KeyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (s *SASLConfig) mechanism() (sasl.Mechanism, error) {
+	switch strings.ToLower(s.Mechanism) {
+	case "plain":
+		return plain.Mechanism{Username: s.Username, Password: s.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, s.Username, s.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, s.Username, s.Password)
+	default:
+		return nil, fmt.Errorf("unknown mechanism %q", s.Mechanism)
+	}
+}
+
+// producer creates writer of template connecting with dialer when configured
+func (c *Config) producer(producer ProducerConfig, dialer *kafka.Dialer) (ProducerFunc, error) {
+	if len(producer.Topic) == 0 {
+		return nil, fmt.Errorf("topic is required")
+	}
+	addr := kafka.TCP(c.Brokers...)
+	var writer func() *kafka.Writer
+	switch producer.Template {
+	case "", "basic":
+		writer = func() *kafka.Writer {
+			return BasicWriter(addr, producer.Topic)
+		}
+	case "batch_timeout":
+		timeout, err := time.ParseDuration(producer.BatchTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("batch timeout: %w", err)
+		}
+		writer = func() *kafka.Writer {
+			return BatchTimeoutWriter(addr, producer.Topic, timeout)
+		}
+	default:
+		return nil, fmt.Errorf("unknown template %q", producer.Template)
+	}
+	return func() *kafka.Writer {
+		w := writer()
+		if dialer != nil {
+			w.Transport = dialerTransport(dialer)
+		}
+		return w
+	}, nil
+}
+
+// consumers creates consumer of stream followed by consumers of its retry
+// tiers, returns keys of stream without handler, consumers created before
+// error returned as well so their readers can be closed
+func (c *Config) consumers(name string, stream StreamConfig, dialer *kafka.Dialer, producers map[string]ProducerFunc, handlers Handlers) ([]*Consumer, []string, error) {
+	var opts []StreamOption
+	if c.transport != nil {
+		opts = append(opts, TransportOpt(c.transport))
+	}
+	if len(stream.Topics) != 0 {
+		opts = append(opts, TopicsOpt(stream.Topics...))
+	}
+	if len(stream.Pattern) != 0 {
+		pattern, err := regexp.Compile(stream.Pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pattern: %w", err)
+		}
+		var refresh time.Duration
+		if len(stream.Refresh) != 0 {
+			if refresh, err = time.ParseDuration(stream.Refresh); err != nil {
+				return nil, nil, fmt.Errorf("refresh: %w", err)
+			}
+		}
+		opts = append(opts, TopicPatternOpt(pattern, refresh))
+	}
+
+	consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+		Brokers: c.Brokers,
+		Dialer:  dialer,
+		Topic:   stream.Topic,
+		GroupID: stream.GroupID,
+	}, opts...))
+	consumer.ErrorHandler(c.errorHandler)
+	consumers := []*Consumer{consumer}
+
+	switch stream.Mode {
+	case "", "implicit":
+	case "explicit":
+		consumer.Explicit()
+	default:
+		return consumers, nil, fmt.Errorf("unknown mode %q", stream.Mode)
+	}
+
+	registered := stream.Producers
+	if len(registered) == 0 {
+		for producer := range producers {
+			registered = append(registered, producer)
+		}
+	}
+	for _, producer := range registered {
+		producerFunc, ok := producers[producer]
+		if !ok {
+			return consumers, nil, fmt.Errorf("unknown producer %s", producer)
+		}
+		consumer.Producer(producer, producerFunc)
+	}
+	for _, producer := range []string{stream.InvalidWith, stream.ReplyWith} {
+		if _, ok := producers[producer]; len(producer) != 0 && !ok {
+			return consumers, nil, fmt.Errorf("unknown producer %s", producer)
+		}
+	}
+	if len(stream.InvalidWith) != 0 {
+		consumer.InvalidWith(stream.InvalidWith)
+	}
+	if len(stream.ReplyWith) != 0 {
+		consumer.ReplyWith(stream.ReplyWith)
+	}
+
+	var missing []string
+	bind := func(key string) (HandlerFunc, bool) {
+		if handlerFunc, ok := handlers[name+"/"+key]; ok {
+			return handlerFunc, true
+		}
+		if handlerFunc, ok := handlers[key]; ok {
+			return handlerFunc, true
+		}
+		missing = append(missing, name+"/"+key)
+		return nil, false
+	}
+	for _, route := range stream.Routes {
+		// ack strategy of route does not leak into the next routes
+		routed := consumer.Group("")
+		routed.ErrorHandler(c.errorHandler)
+		if len(route.Topic) != 0 {
+			routed = routed.Topic(route.Topic)
+			routed.ErrorHandler(c.errorHandler)
+		}
+		if len(route.Group) != 0 {
+			routed = routed.Group(route.Group)
+			routed.ErrorHandler(c.errorHandler)
+		}
+		if len(route.Ack) != 0 {
+			strategy, err := parseAckStrategy(route.Ack)
+			if err != nil {
+				return consumers, nil, err
+			}
+			routed.AckStrategy(strategy)
+		}
+		for _, key := range route.Handlers {
+			routingKey := key
+			if len(route.Group) != 0 {
+				routingKey = fmt.Sprintf("%s.%s", route.Group, key)
+			}
+			if handlerFunc, ok := bind(routingKey); ok {
+				routed.Handler(key, handlerFunc)
+			}
+		}
+	}
+	if len(stream.NoRoute) != 0 {
+		if handlerFunc, ok := bind(stream.NoRoute); ok {
+			consumer.NoRoute(handlerFunc)
+		}
+	}
+
+	if stream.Retry != nil {
+		if len(stream.Topic) == 0 {
+			return consumers, nil, fmt.Errorf("retry requires topic")
+		}
+		tiers := make([]time.Duration, 0, len(stream.Retry.Tiers))
+		for _, tier := range stream.Retry.Tiers {
+			d, err := time.ParseDuration(tier)
+			if err != nil {
+				return consumers, nil, fmt.Errorf("retry tier: %w", err)
+			}
+			tiers = append(tiers, d)
+		}
+		consumers = append(consumers, RetryTopology(stream.Topic, tiers, stream.Retry.DLQ).Bind(consumer)...)
+	}
+	return consumers, missing, nil
+}
+
+func parseAckStrategy(name string) (AckStrategy, error) {
+	for _, strategy := range []AckStrategy{AutoAckBefore, AutoAckAfterSuccess, Manual} {
+		if strategy.String() == name {
+			return strategy, nil
+		}
+	}
+	return AutoAckBefore, fmt.Errorf("unknown ack strategy %q", name)
+}
+
+func parseSignals(names []string) ([]os.Signal, error) {
+	if len(names) == 0 {
+		return SyscallOpt(syscall.SIGINT, syscall.SIGTERM), nil
+	}
+	known := map[string]os.Signal{
+		"SIGINT":  syscall.SIGINT,
+		"SIGTERM": syscall.SIGTERM,
+		"SIGHUP":  syscall.SIGHUP,
+		"SIGQUIT": syscall.SIGQUIT,
+	}
+	signals := make([]os.Signal, 0, len(names))
+	for _, name := range names {
+		signal, ok := known[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown signal %s", name)
+		}
+		signals = append(signals, signal)
+	}
+	return signals, nil
+}
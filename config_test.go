@@ -0,0 +1,303 @@
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testConfigYAML = `
+brokers: ["${TEST_ONI_BROKER}", "${TEST_ONI_UNSET_BROKER:-localhost:8098}"]
+dialer:
+  client_id: oni
+  timeout: 3s
+  tls:
+    insecure_skip_verify: true
+  sasl:
+    mechanism: scram-sha-512
+    username: oni
+    password: ${TEST_ONI_UNSET_PASSWORD:-secret}
+runner:
+  timeout: 5s
+  signals: [SIGINT, sighup]
+  provision:
+    create: true
+    default:
+      partitions: 2
+      replication_factor: 3
+    topics:
+      foos-dlq:
+        partitions: 1
+        config:
+          retention.ms: "604800000"
+producers:
+  bars:
+    topic: bars
+  foos_retry:
+    template: batch_timeout
+    topic: foos-retry
+    batch_timeout: 5s
+streams:
+  foos:
+    topic: foos
+    group_id: consumer-group-foos
+    mode: explicit
+    producers: [bars]
+    routes:
+      - handlers: [create.foo]
+      - group: event
+        ack: auto-ack-after-success
+        handlers: [bar]
+    no_route: unknown
+    retry:
+      tiers: [5s, 1m]
+      dlq: foos-dlq
+  billing:
+    topics: [orders, invoices]
+    group_id: consumer-group-billing
+    routes:
+      - topic: orders
+        handlers: [create]
+      - topic: invoices
+        handlers: [create]
+`
+
+const testConfigJSON = `{
+	"brokers": ["${TEST_ONI_BROKER}", "${TEST_ONI_UNSET_BROKER:-localhost:8098}"],
+	"dialer": {
+		"client_id": "oni",
+		"timeout": "3s",
+		"tls": {"insecure_skip_verify": true},
+		"sasl": {"mechanism": "scram-sha-512", "username": "oni", "password": "${TEST_ONI_UNSET_PASSWORD:-secret}"}
+	},
+	"runner": {
+		"timeout": "5s",
+		"signals": ["SIGINT", "sighup"],
+		"provision": {
+			"create": true,
+			"default": {"partitions": 2, "replication_factor": 3},
+			"topics": {"foos-dlq": {"partitions": 1, "config": {"retention.ms": "604800000"}}}
+		}
+	},
+	"producers": {
+		"bars": {"topic": "bars"},
+		"foos_retry": {"template": "batch_timeout", "topic": "foos-retry", "batch_timeout": "5s"}
+	},
+	"streams": {
+		"foos": {
+			"topic": "foos",
+			"group_id": "consumer-group-foos",
+			"mode": "explicit",
+			"producers": ["bars"],
+			"routes": [
+				{"handlers": ["create.foo"]},
+				{"group": "event", "ack": "auto-ack-after-success", "handlers": ["bar"]}
+			],
+			"no_route": "unknown",
+			"retry": {"tiers": ["5s", "1m"], "dlq": "foos-dlq"}
+		},
+		"billing": {
+			"topics": ["orders", "invoices"],
+			"group_id": "consumer-group-billing",
+			"routes": [
+				{"topic": "orders", "handlers": ["create"]},
+				{"topic": "invoices", "handlers": ["create"]}
+			]
+		}
+	}
+}`
+
+type TestConfigSuite struct {
+	suite.Suite
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(TestConfigSuite))
+}
+
+func (suite *TestConfigSuite) writeConfig(name string, content string) string {
+	path := filepath.Join(suite.T().TempDir(), name)
+	suite.Require().Nil(os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func (suite *TestConfigSuite) TestLoadConfig() {
+	suite.Run("TestLoadConfig", func() {
+		suite.T().Setenv("TEST_ONI_BROKER", "localhost:8097")
+		fromYAML, err := LoadConfig(suite.writeConfig("oni.yaml", testConfigYAML))
+		suite.Assert().Nil(err)
+		fromJSON, err := LoadConfig(suite.writeConfig("oni.json", testConfigJSON))
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(fromYAML, fromJSON)
+
+		suite.Assert().Equal(fromYAML.Brokers, []string{"localhost:8097", "localhost:8098"})
+		suite.Assert().Equal(fromYAML.Dialer, &DialerConfig{
+			ClientID: "oni",
+			Timeout:  "3s",
+			TLS:      &TLSConfig{InsecureSkipVerify: true},
+			SASL:     &SASLConfig{Mechanism: "scram-sha-512", Username: "oni", Password: "secret"},
+		})
+		suite.Assert().Equal(fromYAML.Producers["foos_retry"], ProducerConfig{Template: "batch_timeout", Topic: "foos-retry", BatchTimeout: "5s"})
+		suite.Assert().Equal(fromYAML.Streams["foos"].Routes[1], RouteConfig{Group: "event", Ack: "auto-ack-after-success", Handlers: []string{"bar"}})
+		suite.Assert().Equal(fromYAML.Streams["foos"].Retry, &RetryConfig{Tiers: []string{"5s", "1m"}, DLQ: "foos-dlq"})
+		suite.Assert().Equal(fromYAML.Streams["billing"].Topics, []string{"orders", "invoices"})
+
+		suite.Assert().Nil(os.Unsetenv("TEST_ONI_BROKER"))
+		_, err = LoadConfig(suite.writeConfig("oni.yml", testConfigYAML))
+		suite.Assert().ErrorContains(err, "environment variables not set: TEST_ONI_BROKER")
+		_, err = LoadConfig(suite.writeConfig("oni.toml", ""))
+		suite.Assert().ErrorContains(err, "unsupported extension \".toml\"")
+	})
+}
+
+func (suite *TestConfigSuite) TestConfigNewRunner() {
+	suite.Run("TestConfigNewRunner", func() {
+		ctx := context.Background()
+		suite.T().Setenv("TEST_ONI_BROKER", "localhost:8097")
+		config, err := LoadConfig(suite.writeConfig("oni.yaml", testConfigYAML))
+		suite.Require().Nil(err)
+		transport := NewMemoryTransport()
+		config.Transport(transport)
+
+		var handled []string
+		handlers := Handlers{
+			"create.foo": func(ctx Context) error {
+				handled = append(handled, "create.foo")
+				return ctx.Send("bars", "create.bar", ctx.ValueBytes())
+			},
+			"event.bar": func(ctx Context) error {
+				handled = append(handled, "event.bar")
+				return nil
+			},
+			"billing/create": func(ctx Context) error {
+				handled = append(handled, "create:"+ctx.Topic())
+				return nil
+			},
+		}
+
+		// every key without handler reported at once
+		_, err = config.NewRunner(ctx, handlers)
+		suite.Assert().EqualError(err, "handlers not bound: foos/unknown")
+
+		handlers["unknown"] = func(ctx Context) error {
+			handled = append(handled, "unknown")
+			return nil
+		}
+		runner, err := config.NewRunner(ctx, handlers)
+		suite.Require().Nil(err)
+		suite.Assert().Equal(runner.Timeout, 5*time.Second)
+		suite.Assert().Equal(runner.Syscall, SyscallOpt(syscall.SIGINT, syscall.SIGHUP))
+		suite.Assert().Equal(runner.Provisioning, &Provisioning{
+			Create:  true,
+			Default: TopicSpec{Partitions: 2, ReplicationFactor: 3},
+			Topics:  map[string]TopicSpec{"foos-dlq": {Partitions: 1, Config: map[string]string{"retention.ms": "604800000"}}},
+		})
+
+		// billing, foos and consumers of foos retry tiers
+		suite.Assert().Len(runner.Consumers, 4)
+		billing, foos := runner.Consumers[0], runner.Consumers[1]
+		suite.Assert().Equal(foos.stream.cm, explicit)
+		suite.Assert().Equal(foos.stream.ackStrategy("foos", "event.bar"), AutoAckAfterSuccess)
+		suite.Assert().Equal(foos.stream.ackStrategy("foos", "create.foo"), Manual)
+		suite.Assert().Equal(runner.Consumers[2].stream.reader.Config().Topic, "foos-retry-5s")
+		suite.Assert().Equal(runner.Consumers[3].stream.reader.Config().Topic, "foos-retry-1m")
+
+		// readers of streams and retry tiers connect using configured dialer
+		for _, consumer := range runner.Consumers {
+			dialer := consumer.stream.reader.Config().Dialer
+			suite.Require().NotNil(dialer)
+			suite.Assert().Equal(dialer.ClientID, "oni")
+			suite.Assert().Equal(dialer.Timeout, 3*time.Second)
+			suite.Assert().True(dialer.TLS.InsecureSkipVerify)
+			suite.Assert().Equal(dialer.SASLMechanism.Name(), "SCRAM-SHA-512")
+		}
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("foo")},
+			kafka.Message{Key: []byte("event.bar")},
+			kafka.Message{Key: []byte("delete.foo")},
+		))
+		w = transport.Writer("test_producer", &kafka.Writer{Topic: "invoices"})
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create")}))
+		for i := 0; i < 3; i++ {
+			suite.Assert().Nil(foos.Poll(ctx))
+		}
+		suite.Assert().Nil(billing.Poll(ctx))
+
+		suite.Assert().Equal(handled, []string{"create.foo", "event.bar", "unknown", "create:invoices"})
+		suite.Assert().Len(transport.Messages("bars"), 1)
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(2))
+	})
+}
+
+func (suite *TestConfigSuite) TestConfigNewRunnerError() {
+	suite.Run("TestConfigNewRunnerError", func() {
+		for _, tc := range []struct {
+			config Config
+			err    string
+		}{
+			{Config{Runner: RunnerConfig{Timeout: "soon"}}, "runner timeout: time: invalid duration \"soon\""},
+			{Config{Runner: RunnerConfig{Signals: []string{"SIGBUS"}}}, "unknown signal SIGBUS"},
+			{Config{Producers: map[string]ProducerConfig{"bars": {Template: "fast", Topic: "bars"}}}, "producer bars: unknown template \"fast\""},
+			{Config{Streams: map[string]StreamConfig{"foos": {Topic: "foos", Mode: "lazy"}}}, "stream foos: unknown mode \"lazy\""},
+			{Config{Streams: map[string]StreamConfig{"foos": {Topic: "foos", Producers: []string{"bars"}}}}, "stream foos: unknown producer bars"},
+			{Config{Streams: map[string]StreamConfig{"foos": {Topic: "foos", Routes: []RouteConfig{{Ack: "never"}}}}}, "stream foos: unknown ack strategy \"never\""},
+			{Config{Dialer: &DialerConfig{Timeout: "soon"}}, "dialer: timeout: time: invalid duration \"soon\""},
+			{Config{Dialer: &DialerConfig{SASL: &SASLConfig{Mechanism: "gssapi"}}}, "dialer: sasl: unknown mechanism \"gssapi\""},
+			{Config{Dialer: &DialerConfig{TLS: &TLSConfig{CAFile: "testdata/missing.pem"}}}, "dialer: tls: open testdata/missing.pem: no such file or directory"},
+			{Config{Dialer: &DialerConfig{TLS: &TLSConfig{CertFile: "testdata/missing.pem"}}}, "dialer: tls: open testdata/missing.pem: no such file or directory"},
+		} {
+			tc.config.Transport(NewMemoryTransport())
+			_, err := tc.config.NewRunner(context.Background(), Handlers{})
+			suite.Assert().EqualError(err, tc.err)
+		}
+	})
+}
+
+func (suite *TestConfigSuite) TestConfigDialer() {
+	suite.Run("TestConfigDialer", func() {
+		config := &Config{Brokers: []string{"localhost:9092"}}
+		dialer, err := config.dialer()
+		suite.Assert().Nil(err)
+		suite.Assert().Nil(dialer)
+		producer, err := config.producer(ProducerConfig{Topic: "bars"}, dialer)
+		suite.Require().Nil(err)
+		suite.Assert().Nil(producer().Transport)
+
+		config.Dialer = &DialerConfig{
+			ClientID: "oni",
+			TLS:      &TLSConfig{ServerName: "kafka"},
+			SASL:     &SASLConfig{Mechanism: "PLAIN", Username: "oni", Password: "secret"},
+		}
+		dialer, err = config.dialer()
+		suite.Require().Nil(err)
+		suite.Assert().Equal(dialer.Timeout, 10*time.Second)
+		suite.Assert().Equal(dialer.TLS.ServerName, "kafka")
+		suite.Assert().Equal(dialer.SASLMechanism.Name(), "PLAIN")
+
+		// producers of every template connect the same way readers do
+		for _, template := range []ProducerConfig{
+			{Topic: "bars"},
+			{Template: "batch_timeout", Topic: "bars", BatchTimeout: "5s"},
+		} {
+			producer, err = config.producer(template, dialer)
+			suite.Require().Nil(err)
+			transport, ok := producer().Transport.(*kafka.Transport)
+			suite.Require().True(ok)
+			suite.Assert().Equal(transport.ClientID, "oni")
+			suite.Assert().Equal(transport.TLS, dialer.TLS)
+			suite.Assert().Equal(transport.SASL, dialer.SASLMechanism)
+		}
+
+		// ca file without certificate rejected
+		config.Dialer = &DialerConfig{TLS: &TLSConfig{CAFile: suite.writeConfig("ca.pem", "not a certificate")}}
+		_, err = config.dialer()
+		suite.Assert().ErrorContains(err, "tls: no certificate found in")
+	})
+}
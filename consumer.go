@@ -6,25 +6,52 @@ package oni
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"time"
 )
 
 type IConsumer interface {
 	Handler(key string, handlerFunc ...HandlerFunc)
+	NoRoute(handlerFunc ...HandlerFunc)
+	Use(middleware ...Middleware)
 	ErrorHandler(callbackFunc ErrorCallbackFunc)
 	Producer(name string, producerFunc ProducerFunc)
 	Group(keyGroup string) *Consumer
-	run(ctx context.Context)
+	Topic(topic string) *Consumer
+	Transport(transport Transport)
+	Poll(ctx context.Context) error
+	Codec(codec Codec)
+	Validator(validator Validator)
+	InvalidWith(producerFuncName string)
+	ReplyWith(producerFuncName string)
+	Outbox(outbox *Outbox)
+	Limit(limit Limit)
+	LimitKey(key string, limit Limit)
+	NackDelay(delay time.Duration)
+	PartitionQueue(size int)
+	BatchCommit(interval time.Duration, count int)
+	SeekToTime(t time.Time)
+	ResetToEarliest()
+	OnPartitionsAssigned(assigned RebalanceFunc)
+	OnPartitionsRevoked(revoked RebalanceFunc)
+	run(ctx context.Context) error
 	closeConsumers() error
 	closeProducers() error
 	Explicit()
 	Implicit()
+	AckStrategy(strategy AckStrategy)
+	Pause()
+	Resume()
+	Paused() bool
+	State() ConsumerState
 }
 
 type Consumer struct {
 	stream        *Stream
 	keyGroup      string
+	topic         string
+	ack           *AckStrategy
 	callbackError ErrorCallbackFunc
 }
 
@@ -38,9 +65,40 @@ func (c *Consumer) Handler(key string, handlerFunc ...HandlerFunc) {
 	if len(c.keyGroup) != 0 {
 		key = fmt.Sprintf("%s.%s", c.keyGroup, key)
 	}
+	if len(c.topic) != 0 {
+		for _, f := range handlerFunc {
+			c.stream.addTopicHandler(c.topic, key, f, c.callbackError)
+		}
+		if c.ack != nil {
+			c.stream.setTopicAckStrategy(c.topic, key, *c.ack)
+		}
+		return
+	}
 	for _, f := range handlerFunc {
 		c.stream.addHandler(key, f, c.callbackError)
 	}
+	if c.ack != nil {
+		c.stream.setAckStrategy(key, *c.ack)
+	}
+}
+
+// NoRoute registers handlers of message which topic and key has no handler,
+// shared by every topic of the stream even when registered through Topic
+func (c *Consumer) NoRoute(handlerFunc ...HandlerFunc) {
+	for _, f := range handlerFunc {
+		c.stream.addNoRoute(f, c.callbackError)
+	}
+	if c.ack != nil {
+		c.stream.setNoRouteAckStrategy(*c.ack)
+	}
+}
+
+// Use registers middlewares wrapping handler chain of every message
+// consumed by the stream, invoked in order they are registered
+func (c *Consumer) Use(middleware ...Middleware) {
+	for _, m := range middleware {
+		c.stream.addMiddleware(m)
+	}
 }
 
 func (c *Consumer) Producer(name string, producerFunc ProducerFunc) {
@@ -51,7 +109,82 @@ func (c *Consumer) Group(keyGroup string) *Consumer {
 	return &Consumer{
 		stream:   c.stream,
 		keyGroup: keyGroup,
+		topic:    c.topic,
+		ack:      c.ack,
+	}
+}
+
+// Topic scopes handlers registered afterwards through returned consumer to
+// messages of given topic, preferred over handler of the same key registered
+// without topic which serves every topic of the stream, groups created from
+// it keep the topic
+func (c *Consumer) Topic(topic string) *Consumer {
+	return &Consumer{
+		stream:   c.stream,
+		keyGroup: c.keyGroup,
+		topic:    topic,
+		ack:      c.ack,
+	}
+}
+
+// Transport replaces transport of consumer stream, reader is recreated
+// using same configuration and producers will be recreated on next use
+func (c *Consumer) Transport(transport Transport) {
+	c.stream.useTransport(transport)
+}
+
+// Poll reads next message from consumer stream and invokes its handler
+// chain synchronously, message held by Delay middleware or nacked is invoked
+// again once due, requested seek applied before reading, acknowledged offsets
+// committed once batch commit due, returns reader error, error of the handler
+// which stopped the chain or commit error, should not be used while consumer
+// started by Runner
+func (c *Consumer) Poll(ctx context.Context) error {
+	c.stream.ctx = ctx
+	if err := c.stream.pollTopics(ctx); err != nil {
+		return err
+	}
+	if seeks := c.stream.takeSeeks(); len(seeks) != 0 {
+		if err := c.stream.flushOffsets(); err != nil {
+			return err
+		}
+		err := c.stream.applySeeks(seeks)
+		if c.stream.offsets != nil {
+			c.stream.offsets.reset()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	m, err := c.stream.fetch()
+	if err != nil {
+		return err
+	}
+	if c.stream.tracking() {
+		c.stream.offsets.track(m)
 	}
+	if err := c.stream.limits.acquire(ctx, m, nil); err != nil {
+		return err
+	}
+	defer c.stream.limits.release(m)
+
+	err = c.stream.process(m, nil)
+	if errors.Is(err, errSeeking) {
+		err = nil
+	}
+	if c.stream.tracking() && c.stream.offsets.due() {
+		if commitErr := c.stream.flushOffsets(); err == nil {
+			err = commitErr
+		}
+	}
+	return err
+}
+
+// AckStrategy sets when messages of routes registered afterwards through this
+// consumer or group are committed, overriding implicit or explicit mode of
+// the stream for those routes only, groups created afterwards inherit it
+func (c *Consumer) AckStrategy(strategy AckStrategy) {
+	c.ack = &strategy
 }
 
 func (c *Consumer) Explicit() {
@@ -62,18 +195,147 @@ func (c *Consumer) Implicit() {
 	c.stream.cm = implicit
 }
 
+// Pause stops consumer from fetching and handling messages until Resume
+// called, reader stays member of its consumer group while paused
+func (c *Consumer) Pause() {
+	c.stream.pauser.pause()
+}
+
+// Resume resumes consumer paused by Pause and every partition paused by
+// Context.PausePartition, consumer paused by open Breaker stays paused until
+// the breaker half-opens
+func (c *Consumer) Resume() {
+	c.stream.pauser.resume()
+}
+
+func (c *Consumer) Paused() bool {
+	return c.State().Paused
+}
+
+// State returns consumer stream topic, group and pause state
+func (c *Consumer) State() ConsumerState {
+	return c.stream.state()
+}
+
+// Codec replaces codec used by Context.ShouldBind, Context.Reply and Handle,
+// nil codec restores default JSONCodec
+func (c *Consumer) Codec(codec Codec) {
+	if codec == nil {
+		codec = JSONCodec()
+	}
+	c.stream.codec = codec
+}
+
+func (c *Consumer) Validator(validator Validator) {
+	c.stream.validator = validator
+}
+
+// InvalidWith routes message which failed to bind or validate inside
+// Context.ShouldBindAndValidate or Handle to producer of given name, handler
+// which does not bind its message is invoked with invalid payload as well
+// since only binding handler knows type its message is validated against
+func (c *Consumer) InvalidWith(producerFuncName string) {
+	c.stream.invalidProducer = producerFuncName
+}
+
+func (c *Consumer) ReplyWith(producerFuncName string) {
+	c.stream.replyProducer = producerFuncName
+}
+
+// Outbox sets outbox used by Context.Outbox
+func (c *Consumer) Outbox(outbox *Outbox) {
+	c.stream.outbox = outbox
+}
+
+// Limit limits messages handled by consumer, or by its key group when
+// consumer created by Group, stream waits before handing message over
+// to handler instead of handler waiting while holding handler lock
+func (c *Consumer) Limit(limit Limit) {
+	if len(c.keyGroup) != 0 {
+		c.stream.limits.groups[c.keyGroup] = newLimiter(limit)
+		return
+	}
+	c.stream.limits.consumer = newLimiter(limit)
+}
+
+// LimitKey limits messages of handler key, prefixed by key group when
+// consumer created by Group
+func (c *Consumer) LimitKey(key string, limit Limit) {
+	if len(c.keyGroup) != 0 {
+		key = fmt.Sprintf("%s.%s", c.keyGroup, key)
+	}
+	c.stream.limits.keys[key] = newLimiter(limit)
+}
+
+// BatchCommit makes Context.Ack of explicit mode mark message acknowledged
+// instead of committing it, highest offset of each partition which every
+// message before it acknowledged is committed every interval or once count
+// messages acknowledged, and before the consumer closed or seeked, commit
+// error reported to error handler, zero interval or count is disabled,
+// message without handler or which handler returned error without Context.Ack
+// is marked acknowledged once its error reported, Context.Nack handles it again
+func (c *Consumer) BatchCommit(interval time.Duration, count int) {
+	c.stream.offsets = newOffsetManager(interval, count)
+}
+
+// NackDelay sets how long nacked message waits before handled again, default 1 second
+func (c *Consumer) NackDelay(delay time.Duration) {
+	c.stream.nackDelay = delay
+}
+
+// PartitionQueue sets how many fetched messages of one partition wait while its
+// current message is handled, delayed by Delay or paused by Context.PausePartition,
+// default 100, partition which queue is full stops being fetched until half of it
+// is handled while other partitions keep being fetched, reader not implementing
+// PartitionPausableReader stops fetching every partition instead
+func (c *Consumer) PartitionQueue(size int) {
+	if size > 0 {
+		c.stream.queueSize = size
+	}
+}
+
+// SeekToTime moves every partition of consumer to first message produced at or
+// after given time, applied by running stream once messages fetched before are
+// handled, otherwise on next Poll or start, error reported to error handler,
+// reader with GroupID rejoins its group after offsets committed
+func (c *Consumer) SeekToTime(t time.Time) {
+	c.stream.requestSeek(seek{all: true, at: t})
+}
+
+// ResetToEarliest moves every partition of consumer to its first offset like SeekToTime
+func (c *Consumer) ResetToEarliest() {
+	c.stream.requestSeek(seek{all: true})
+}
+
+// OnPartitionsAssigned sets hook invoked with partitions of every new assignment
+// of consumer group, transport must implement RebalanceTransport
+func (c *Consumer) OnPartitionsAssigned(assigned RebalanceFunc) {
+	c.stream.onAssigned = assigned
+	c.stream.useRebalance()
+}
+
+// OnPartitionsRevoked sets hook invoked before partitions given up on rebalance
+// or close, running stream handles messages fetched before and commits their
+// acknowledged offsets first, paused stream does it once resumed, transport
+// must implement RebalanceTransport
+func (c *Consumer) OnPartitionsRevoked(revoked RebalanceFunc) {
+	c.stream.onRevoked = revoked
+	c.stream.useRebalance()
+}
+
 func (c *Consumer) ErrorHandler(callbackFunc ErrorCallbackFunc) {
 	c.callbackError = callbackFunc
 }
 
-func (c *Consumer) run(ctx context.Context) {
-	var wg sync.WaitGroup
-	wg.Add(len(c.stream.handlers))
-	c.stream.ctx = ctx
-	for range c.stream.handlers {
-		go c.stream.invoke(&wg)
+// run streams messages until reader closed, returns reader error which
+// stopped the stream, for example consumer group which could not be created
+func (c *Consumer) run(ctx context.Context) error {
+	if c.stream.routes() == 0 {
+		return nil
 	}
-	wg.Wait()
+	c.stream.ctx = ctx
+	c.stream.errorCallback = c.callbackError
+	return c.stream.stream()
 }
 
 func (c *Consumer) closeConsumers() error {
@@ -1,10 +1,12 @@
 package oni
 
 import (
+	"context"
 	"errors"
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/suite"
 	"testing"
+	"time"
 )
 
 type ConsumerTestSuite struct {
@@ -110,6 +112,154 @@ func (suite *ContextTestSuite) TestImplicit() {
 	})
 }
 
+func (suite *ContextTestSuite) TestCodec() {
+	suite.Run("TestCodec", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+			GroupID: "consumer-group-test",
+		}))
+
+		suite.Assert().Equal(consumer.stream.codec, JSONCodec())
+
+		// nil codec falls back to json codec instead of panicking on bind
+		consumer.Codec(nil)
+		suite.Assert().Equal(consumer.stream.codec, JSONCodec())
+		var v map[string]string
+		ctx := consumer.stream.newContext(kafka.Message{Value: []byte(`{"content":"foo"}`)})
+		suite.Assert().Nil(ctx.ShouldBind(&v))
+		suite.Assert().Equal(v, map[string]string{"content": "foo"})
+	})
+}
+
+func (suite *ContextTestSuite) TestValidator() {
+	suite.Run("TestValidator", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+			GroupID: "consumer-group-test",
+		}))
+
+		suite.Assert().Equal(consumer.stream.validator, TagValidator())
+		consumer.Validator(nil)
+		suite.Assert().Nil(consumer.stream.validator)
+	})
+}
+
+func (suite *ContextTestSuite) TestInvalidWith() {
+	suite.Run("TestInvalidWith", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+			GroupID: "consumer-group-test",
+		}))
+
+		consumer.InvalidWith("failures_producer")
+		suite.Assert().Equal(consumer.stream.invalidProducer, "failures_producer")
+		suite.Assert().Equal(consumer.stream.newContext(kafka.Message{}).invalidProducer, "failures_producer")
+	})
+}
+
+func (suite *ContextTestSuite) TestInvalidWithPlainHandler() {
+	suite.Run("TestInvalidWithPlainHandler", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		consumer.Producer("failures_producer", func() *kafka.Writer {
+			return &kafka.Writer{Topic: "failures"}
+		})
+		consumer.InvalidWith("failures_producer")
+
+		type foo struct {
+			Content string `json:"content" validate:"required"`
+		}
+		var plain []string
+		consumer.Handler("plain.foo", func(ctx Context) error {
+			plain = append(plain, ctx.ValueString())
+			return nil
+		})
+		Handle(consumer, "typed.foo", func(ctx Context, msg foo) error {
+			return nil
+		})
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("plain.foo"), Value: []byte("{}")},
+			kafka.Message{Key: []byte("typed.foo"), Value: []byte("{}")},
+		))
+
+		// plain handler receives invalid payload, only binding handler routes it
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().IsType(ValidationErrors{}, consumer.Poll(ctx))
+		suite.Assert().Equal(plain, []string{"{}"})
+		failures := transport.Messages("failures")
+		suite.Assert().Len(failures, 1)
+		suite.Assert().Equal(string(failures[0].Key), "failed.typed.foo")
+	})
+}
+
+func (suite *ContextTestSuite) TestReplyWith() {
+	suite.Run("TestReplyWith", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+			GroupID: "consumer-group-test",
+		}))
+
+		consumer.ReplyWith("reply_producer")
+		suite.Assert().Equal(consumer.stream.replyProducer, "reply_producer")
+		suite.Assert().Equal(consumer.stream.newContext(kafka.Message{}).replyProducer, "reply_producer")
+		suite.Assert().Same(consumer.stream.newContext(kafka.Message{}).pool, consumer.stream.pool)
+	})
+}
+
+func (suite *ContextTestSuite) TestTransport() {
+	suite.Run("TestTransport", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+			GroupID: "consumer-group-test",
+		}))
+
+		transport := NewMemoryTransport()
+		consumer.Transport(transport)
+		suite.Assert().Same(consumer.stream.transport, transport)
+		suite.Assert().IsType(&memoryReader{}, consumer.stream.reader)
+		suite.Assert().Equal(consumer.stream.reader.Config().GroupID, "consumer-group-test")
+		suite.Assert().Same(consumer.stream.pool.transport, transport)
+	})
+}
+
+func (suite *ContextTestSuite) TestPoll() {
+	suite.Run("TestPoll", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "test"}, TransportOpt(transport)))
+
+		var keys []string
+		consumer.Handler("event.create.test", func(ctx Context) error {
+			keys = append(keys, ctx.KeyString())
+			return nil
+		})
+		consumer.NoRoute(func(ctx Context) error {
+			return errors.New("no route")
+		})
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "test"})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("event.create.test")},
+			kafka.Message{Key: []byte("event.unknown.test")},
+		))
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().EqualError(consumer.Poll(ctx), "no route")
+		suite.Assert().Equal(keys, []string{"event.create.test"})
+
+		timeout, cancel := context.WithTimeout(ctx, time.Millisecond)
+		defer cancel()
+		suite.Assert().Equal(consumer.Poll(timeout), context.DeadlineExceeded)
+	})
+}
+
 func (suite *ContextTestSuite) TestErrorHandler() {
 	suite.Run("TestErrorHandler", func() {
 		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
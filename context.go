@@ -6,31 +6,60 @@ package oni
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/segmentio/kafka-go"
+	"sync"
+	"time"
 )
 
 type Context interface {
+	ShouldBind(v interface{}) error
 	ShouldBindJSON(v interface{}) error
+	ShouldBindAndValidate(v interface{}) error
 	ShouldRetryWith(producerFuncName string) error
 	ShouldErrorWith(producerFuncName string) error
 	ShouldReturnWith(producerFuncName string) error
 
+	Send(producerFuncName string, key string, value []byte, headers ...kafka.Header) error
+	SendJSON(producerFuncName string, key string, v interface{}) error
+	SendAt(producerFuncName string, at time.Time, key string, value []byte, headers ...kafka.Header) error
+	SendAfter(producerFuncName string, delay time.Duration, key string, value []byte, headers ...kafka.Header) error
+	Forward(producerFuncName string) error
+	Reply(v interface{}) error
+	Outbox(tx *sql.Tx) *OutboxTx
+
 	Ack() error
+	Nack() error
+	SeekTo(offset int64) error
+	PausePartition(d time.Duration)
 	ValueBytes() []byte
 	ValueString() string
 	KeyBytes() []byte
 	KeyString() string
+	Topic() string
+	Header(key string) string
+	HeaderBytes(key string) []byte
+	Headers() map[string][]string
+	SetHeader(key string, value string)
+	AddHeader(key string, value string)
 
 	Message() kafka.Message
+	Assignments() []Assignment
 	ReaderStats() kafka.ReaderStats
 	ReaderConfig() kafka.ReaderConfig
 	GetProducer(producerFuncName string) *kafka.Writer
 
 	OuterContext() context.Context
+	// Deprecated: use Get instead
 	FindKey(key string) interface{}
+	// Deprecated: use Set instead
 	CreateKeyVal(key string, val interface{})
+
+	Set(key interface{}, value interface{})
+	Get(key interface{}) (interface{}, bool)
+	MustGet(key interface{}) interface{}
 }
 
 type retry struct {
@@ -39,20 +68,62 @@ type retry struct {
 }
 
 type octx struct {
-	producers    map[string]ProducerFunc
-	outerContext context.Context
-	message      kafka.Message
-	reader       *kafka.Reader
+	producers       map[string]ProducerFunc
+	pool            *producerPool
+	outerContext    context.Context
+	message         kafka.Message
+	reader          Reader
+	codec           Codec
+	validator       Validator
+	invalidProducer string
+	replyProducer   string
+	outbox          *Outbox
+	pausePartition  func(d time.Duration)
+	acked           bool
+	nacked          bool
+	offsets         *offsetManager
+	seekOffset      *int64
+	redelivered     bool
+	headers         []kafka.Header
+	keys            map[interface{}]interface{}
+	kLock           sync.RWMutex
+}
+
+func newContext(ctx context.Context, r Reader, m kafka.Message, producers map[string]ProducerFunc) *octx {
+	return &octx{
+		outerContext: ctx,
+		reader:       r,
+		message:      m,
+		producers:    producers,
+		pool:         newProducerPool(producers, KafkaTransport()),
+		codec:        JSONCodec(),
+		validator:    TagValidator(),
+	}
 }
 
-func newContext(ctx context.Context, r *kafka.Reader, m kafka.Message, producers map[string]ProducerFunc) *octx {
-	return &octx{outerContext: ctx, reader: r, message: m, producers: producers}
+func (ctx *octx) ShouldBind(v interface{}) error {
+	return ctx.codec.Unmarshal(ctx.message.Value, v)
 }
 
 func (ctx *octx) ShouldBindJSON(v interface{}) error {
 	return json.Unmarshal(ctx.message.Value, v)
 }
 
+func (ctx *octx) ShouldBindAndValidate(v interface{}) error {
+	var err error
+	if bindErr := ctx.ShouldBind(v); bindErr != nil {
+		err = &DecodeError{Key: ctx.KeyString(), Err: bindErr}
+	} else if ctx.validator != nil {
+		err = ctx.validator.Validate(v)
+	}
+	if err != nil && len(ctx.invalidProducer) != 0 {
+		if produceErr := ctx.ShouldErrorWith(ctx.invalidProducer); produceErr != nil {
+			return produceErr
+		}
+	}
+	return err
+}
+
 func (ctx *octx) ValueBytes() []byte {
 	return ctx.message.Value
 }
@@ -69,14 +140,97 @@ func (ctx *octx) KeyString() string {
 	return string(ctx.message.Key)
 }
 
+// Topic returns topic which message consumed from
+func (ctx *octx) Topic() string {
+	return ctx.message.Topic
+}
+
+func (ctx *octx) Header(key string) string {
+	return string(ctx.HeaderBytes(key))
+}
+
+func (ctx *octx) HeaderBytes(key string) []byte {
+	for _, header := range ctx.message.Headers {
+		if header.Key == key {
+			return header.Value
+		}
+	}
+	return nil
+}
+
+func (ctx *octx) Headers() map[string][]string {
+	headers := make(map[string][]string, len(ctx.message.Headers))
+	for _, header := range ctx.message.Headers {
+		headers[header.Key] = append(headers[header.Key], string(header.Value))
+	}
+	return headers
+}
+
+func (ctx *octx) SetHeader(key string, value string) {
+	headers := make([]kafka.Header, 0, len(ctx.headers)+1)
+	for _, header := range ctx.headers {
+		if header.Key != key {
+			headers = append(headers, header)
+		}
+	}
+	ctx.headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (ctx *octx) AddHeader(key string, value string) {
+	ctx.headers = append(ctx.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
 func (ctx *octx) Ack() error {
+	// offset committed by offset manager in batch
+	if ctx.offsets != nil {
+		if !ctx.acked {
+			ctx.acked = true
+			ctx.offsets.done(ctx.message)
+		}
+		return nil
+	}
 	return ctx.reader.CommitMessages(ctx.outerContext, ctx.message)
 }
 
+// Nack leaves message uncommitted and redelivers it after nack delay of the
+// consumer, next messages of its partition wait until it is handled again
+func (ctx *octx) Nack() error {
+	ctx.nacked = true
+	return nil
+}
+
+// SeekTo moves partition of message to given offset once handler chain
+// finished, messages of the partition after current one are not handled,
+// reader with GroupID rejoins its group to seek which rebalances every member
+// of the group, seeks requested meanwhile are applied by single rejoin and
+// the group is rejoined at most once per 5 seconds
+func (ctx *octx) SeekTo(offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("invalid seek offset %d", offset)
+	}
+	ctx.seekOffset = &offset
+	return nil
+}
+
+// PausePartition holds next messages of message partition for given duration,
+// other partitions of the stream keep being consumed, the paused partition stops
+// being fetched once its queue is full until it is resumed
+func (ctx *octx) PausePartition(d time.Duration) {
+	if ctx.pausePartition != nil {
+		ctx.pausePartition(d)
+	}
+}
+
 func (ctx *octx) Message() kafka.Message {
 	return ctx.message
 }
 
+// Assignments returns partitions currently assigned to stream reader by
+// its consumer group, or nil when reader does not report its assignment
+func (ctx *octx) Assignments() []Assignment {
+	return assignments(ctx.reader)
+}
+
 func (ctx *octx) ReaderStats() kafka.ReaderStats {
 	return ctx.reader.Stats()
 }
@@ -89,12 +243,59 @@ func (ctx *octx) GetProducer(producerFuncName string) *kafka.Writer {
 	return ctx.producers[producerFuncName]()
 }
 
+// FindKey find key inside message key-value store then outer context
+//
+// Deprecated: use Context.Get instead
 func (ctx *octx) FindKey(key string) interface{} {
+	if val, ok := ctx.Get(key); ok {
+		return val
+	}
 	return ctx.outerContext.Value(key)
 }
 
+// CreateKeyVal create key with its value inside message key-value store
+//
+// Deprecated: use Context.Set instead
 func (ctx *octx) CreateKeyVal(key string, val interface{}) {
-	ctx.outerContext = context.WithValue(ctx.outerContext, key, val)
+	ctx.Set(key, val)
+}
+
+func (ctx *octx) Set(key interface{}, value interface{}) {
+	ctx.kLock.Lock()
+	defer ctx.kLock.Unlock()
+	if ctx.keys == nil {
+		ctx.keys = make(map[interface{}]interface{})
+	}
+	ctx.keys[key] = value
+}
+
+func (ctx *octx) Get(key interface{}) (interface{}, bool) {
+	ctx.kLock.RLock()
+	defer ctx.kLock.RUnlock()
+	value, ok := ctx.keys[key]
+	return value, ok
+}
+
+func (ctx *octx) MustGet(key interface{}) interface{} {
+	if value, ok := ctx.Get(key); ok {
+		return value
+	}
+	panic(fmt.Sprintf("key %v does not exist", key))
+}
+
+// GetAs returns value stored by Context.Set converted into T, returns
+// false when key does not exist or value is not T
+func GetAs[T any](ctx Context, key interface{}) (T, bool) {
+	var zero T
+	value, ok := ctx.Get(key)
+	if !ok {
+		return zero, false
+	}
+	typed, ok := value.(T)
+	if !ok {
+		return zero, false
+	}
+	return typed, true
 }
 
 func (ctx *octx) OuterContext() context.Context {
@@ -102,8 +303,6 @@ func (ctx *octx) OuterContext() context.Context {
 }
 
 func (ctx *octx) ShouldRetryWith(producerFuncName string) error {
-	w := ctx.producers[producerFuncName]()
-
 	retryDataByte, err := json.Marshal(retry{
 		OriginKey: ctx.KeyString(),
 		Value:     ctx.ValueString(),
@@ -112,20 +311,13 @@ func (ctx *octx) ShouldRetryWith(producerFuncName string) error {
 		return err
 	}
 
-	err = w.WriteMessages(ctx.outerContext, kafka.Message{
+	return ctx.produce(producerFuncName, kafka.Message{
 		Key:   []byte(fmt.Sprintf("%s.%s", "retry", ctx.KeyString())),
 		Value: retryDataByte,
 	})
-	if err != nil {
-		return err
-	}
-
-	return w.Close()
 }
 
 func (ctx *octx) ShouldErrorWith(producerFuncName string) error {
-	w := ctx.producers[producerFuncName]()
-
 	retryDataByte, err := json.Marshal(retry{
 		OriginKey: ctx.KeyString(),
 		Value:     ctx.ValueString(),
@@ -134,33 +326,121 @@ func (ctx *octx) ShouldErrorWith(producerFuncName string) error {
 		return err
 	}
 
-	err = w.WriteMessages(ctx.outerContext, kafka.Message{
+	return ctx.produce(producerFuncName, kafka.Message{
 		Key:   []byte(fmt.Sprintf("%s.%s", "failed", ctx.KeyString())),
 		Value: retryDataByte,
 	})
-	if err != nil {
-		return err
-	}
-
-	return w.Close()
 }
 
 func (ctx *octx) ShouldReturnWith(producerFuncName string) error {
-	w := ctx.producers[producerFuncName]()
-
 	var retryData retry
 	err := json.Unmarshal(ctx.message.Value, &retryData)
 	if err != nil {
 		return err
 	}
 
-	err = w.WriteMessages(ctx.outerContext, kafka.Message{
+	return ctx.produce(producerFuncName, kafka.Message{
 		Key:   []byte(retryData.OriginKey),
 		Value: []byte(retryData.Value),
 	})
+}
+
+func (ctx *octx) Send(producerFuncName string, key string, value []byte, headers ...kafka.Header) error {
+	return ctx.produce(producerFuncName, kafka.Message{
+		Key:     []byte(key),
+		Value:   value,
+		Headers: headers,
+	})
+}
+
+func (ctx *octx) SendJSON(producerFuncName string, key string, v interface{}) error {
+	value, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
+	return ctx.Send(producerFuncName, key, value)
+}
 
-	return w.Close()
+// SendAt sends message stamped with deliver-at header, consumer
+// using Delay middleware holds the message until given time
+func (ctx *octx) SendAt(producerFuncName string, at time.Time, key string, value []byte, headers ...kafka.Header) error {
+	return ctx.Send(producerFuncName, key, value, withDeliverAt(headers, at)...)
+}
+
+// SendAfter sends message which should be delivered after given delay
+func (ctx *octx) SendAfter(producerFuncName string, delay time.Duration, key string, value []byte, headers ...kafka.Header) error {
+	return ctx.SendAt(producerFuncName, time.Now().Add(delay), key, value, headers...)
+}
+
+func (ctx *octx) Forward(producerFuncName string) error {
+	return ctx.produce(producerFuncName, kafka.Message{
+		Key:     ctx.message.Key,
+		Value:   ctx.message.Value,
+		Headers: ctx.message.Headers,
+	})
+}
+
+func (ctx *octx) Reply(v interface{}) error {
+	replyTo := ctx.Header(HeaderReplyTo)
+	if len(replyTo) == 0 {
+		return ErrNoReplyTo
+	}
+
+	value, err := ctx.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return ctx.produce(ctx.replyProducer, kafka.Message{
+		Topic: replyTo,
+		Key:   ctx.message.Key,
+		Value: value,
+	})
+}
+
+// Outbox returns outbox storing messages inside given transaction
+// instead of producing them, outgoing headers are stored as well
+func (ctx *octx) Outbox(tx *sql.Tx) *OutboxTx {
+	return &OutboxTx{
+		outbox:    ctx.outbox,
+		tx:        tx,
+		ctx:       ctx.outerContext,
+		producers: ctx.producers,
+		outgoing:  ctx.outgoing,
+	}
+}
+
+// produce sends message using pooled writer of given producer
+func (ctx *octx) produce(producerFuncName string, m kafka.Message) error {
+	w, err := ctx.pool.writer(producerFuncName)
+	if err != nil {
+		return err
+	}
+	return w.WriteMessages(ctx.outerContext, ctx.outgoing(m))
+}
+
+// outgoing adds outgoing headers and incoming correlation id
+// unless message already defines them
+func (ctx *octx) outgoing(m kafka.Message) kafka.Message {
+	headers := make([]kafka.Header, 0, len(m.Headers)+len(ctx.headers)+1)
+	headers = append(headers, m.Headers...)
+	for _, header := range ctx.headers {
+		if !hasHeader(headers, header.Key) {
+			headers = append(headers, header)
+		}
+	}
+	if correlationID := ctx.HeaderBytes(HeaderCorrelationID); correlationID != nil && !hasHeader(headers, HeaderCorrelationID) {
+		headers = append(headers, kafka.Header{Key: HeaderCorrelationID, Value: correlationID})
+	}
+	m.Headers = headers
+	return m
+}
+
+func hasHeader(headers []kafka.Header, key string) bool {
+	for _, header := range headers {
+		if header.Key == key {
+			return true
+		}
+	}
+	return false
 }
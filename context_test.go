@@ -2,6 +2,7 @@ package oni
 
 import (
 	"context"
+	"errors"
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/suite"
 	"testing"
@@ -220,6 +221,53 @@ func (suite *ContextTestSuite) TestNewContextValueBytesFunc() {
 	})
 }
 
+func (suite *ContextTestSuite) TestNewContextHeaderFunc() {
+	suite.Run("TestNewContextHeaderFunc", func() {
+		ctx := context.Background()
+		oniCtx := newContext(ctx, nil, kafka.Message{
+			Key: []byte("event.create.bar"),
+			Headers: []kafka.Header{
+				{Key: "Content-Type", Value: []byte("application/json")},
+				{Key: "X-Trace", Value: []byte("a")},
+				{Key: "X-Trace", Value: []byte("b")},
+			},
+		}, nil)
+
+		suite.Assert().Equal(oniCtx.Header("Content-Type"), "application/json")
+		suite.Assert().Equal(oniCtx.HeaderBytes("Content-Type"), []byte("application/json"))
+		suite.Assert().Equal(oniCtx.Header("X-Trace"), "a")
+		suite.Assert().Equal(oniCtx.Header("X-Unknown"), "")
+		suite.Assert().Nil(oniCtx.HeaderBytes("X-Unknown"))
+		suite.Assert().Equal(oniCtx.Headers(), map[string][]string{
+			"Content-Type": {"application/json"},
+			"X-Trace":      {"a", "b"},
+		})
+	})
+}
+
+func (suite *ContextTestSuite) TestNewContextSetHeaderFunc() {
+	suite.Run("TestNewContextSetHeaderFunc", func() {
+		ctx := context.Background()
+		oniCtx := newContext(ctx, nil, kafka.Message{}, nil)
+
+		oniCtx.AddHeader("X-Trace", "a")
+		oniCtx.AddHeader("X-Trace", "b")
+		oniCtx.SetHeader("Content-Type", "text/plain")
+		oniCtx.SetHeader("Content-Type", "application/json")
+		suite.Assert().Equal(oniCtx.headers, []kafka.Header{
+			{Key: "X-Trace", Value: []byte("a")},
+			{Key: "X-Trace", Value: []byte("b")},
+			{Key: "Content-Type", Value: []byte("application/json")},
+		})
+
+		oniCtx.SetHeader("X-Trace", "c")
+		suite.Assert().Equal(oniCtx.headers, []kafka.Header{
+			{Key: "Content-Type", Value: []byte("application/json")},
+			{Key: "X-Trace", Value: []byte("c")},
+		})
+	})
+}
+
 func (suite *ContextTestSuite) TestNewContextShouldBindJSONFunc() {
 	suite.Run("TestNewContextShouldBindJSONFunc", func() {
 		t := time.Now()
@@ -255,6 +303,34 @@ func (suite *ContextTestSuite) TestNewContextShouldBindJSONFunc() {
 	})
 }
 
+func (suite *ContextTestSuite) TestNewContextShouldBindAndValidateFunc() {
+	suite.Run("TestNewContextShouldBindAndValidateFunc", func() {
+		ctx := context.Background()
+		type dummyStruct struct {
+			Content string `json:"content" validate:"required,min=5"`
+		}
+
+		oniCtx := newContext(ctx, nil, kafka.Message{
+			Value: []byte("{\"content\":\"this is message content\"}"),
+		}, nil)
+		var valid dummyStruct
+		suite.Assert().Nil(oniCtx.ShouldBindAndValidate(&valid))
+		suite.Assert().Equal(valid.Content, "this is message content")
+
+		oniCtx = newContext(ctx, nil, kafka.Message{
+			Value: []byte("{\"content\":\"abc\"}"),
+		}, nil)
+		var invalid dummyStruct
+		err := oniCtx.ShouldBindAndValidate(&invalid)
+		suite.Assert().IsType(ValidationErrors{}, err)
+		suite.Assert().Equal(err.(ValidationErrors)[0].Field, "Content")
+		suite.Assert().Equal(err.(ValidationErrors)[0].Tag, "min")
+
+		oniCtx = newContext(ctx, nil, kafka.Message{Value: []byte("{")}, nil)
+		suite.Assert().IsType(&DecodeError{}, oniCtx.ShouldBindAndValidate(&invalid))
+	})
+}
+
 func (suite *ContextTestSuite) TestNewContextOuterContextFunc() {
 	suite.Run("TestNewContextOuterContextFunc", func() {
 		t := time.Now()
@@ -290,6 +366,46 @@ func (suite *ContextTestSuite) TestNewContextCreateKeyValFunc() {
 		suite.Assert().Equal(oniCtx.OuterContext(), ctx)
 		oniCtx.CreateKeyVal("test_key", "29198385829")
 		suite.Assert().Equal(oniCtx.FindKey("test_key"), "29198385829")
+		suite.Assert().Equal(oniCtx.OuterContext(), ctx)
+	})
+}
+
+func (suite *ContextTestSuite) TestNewContextSetGetFunc() {
+	suite.Run("TestNewContextSetGetFunc", func() {
+		type userKey struct{}
+		ctx := context.Background()
+		oniCtx := newContext(ctx, nil, kafka.Message{}, nil)
+
+		oniCtx.Set("user", "string key")
+		oniCtx.Set(userKey{}, 29198385829)
+
+		val, ok := oniCtx.Get("user")
+		suite.Assert().True(ok)
+		suite.Assert().Equal(val, "string key")
+		suite.Assert().Equal(oniCtx.MustGet(userKey{}), 29198385829)
+		suite.Assert().Equal(oniCtx.OuterContext(), ctx)
+
+		_, ok = oniCtx.Get("unknown")
+		suite.Assert().False(ok)
+		suite.Assert().Panics(func() {
+			oniCtx.MustGet("unknown")
+		})
+	})
+}
+
+func (suite *ContextTestSuite) TestGetAs() {
+	suite.Run("TestGetAs", func() {
+		oniCtx := newContext(context.Background(), nil, kafka.Message{}, nil)
+		oniCtx.Set("user_id", 29198385829)
+
+		id, ok := GetAs[int](oniCtx, "user_id")
+		suite.Assert().True(ok)
+		suite.Assert().Equal(id, 29198385829)
+
+		_, ok = GetAs[string](oniCtx, "user_id")
+		suite.Assert().False(ok)
+		_, ok = GetAs[int](oniCtx, "unknown")
+		suite.Assert().False(ok)
 	})
 }
 
@@ -310,6 +426,29 @@ func (suite *ContextTestSuite) TestNewContextGetProducerFunc() {
 	})
 }
 
+func (suite *ContextTestSuite) TestNewContextSendFunc() {
+	suite.Run("TestNewContextSendFunc", func() {
+		oniCtx := newContext(context.Background(), nil, kafka.Message{}, map[string]ProducerFunc{})
+
+		suite.Assert().True(errors.Is(oniCtx.Send("unknown", "event.create.bar", nil), ErrProducerNotFound))
+		suite.Assert().True(errors.Is(oniCtx.SendJSON("unknown", "event.create.bar", nil), ErrProducerNotFound))
+		suite.Assert().True(errors.Is(oniCtx.Forward("unknown"), ErrProducerNotFound))
+		suite.Assert().NotNil(oniCtx.SendJSON("unknown", "event.create.bar", make(chan int)))
+	})
+}
+
+func (suite *ContextTestSuite) TestNewContextReplyFunc() {
+	suite.Run("TestNewContextReplyFunc", func() {
+		oniCtx := newContext(context.Background(), nil, kafka.Message{}, map[string]ProducerFunc{})
+		suite.Assert().Equal(oniCtx.Reply("pong"), ErrNoReplyTo)
+
+		oniCtx = newContext(context.Background(), nil, kafka.Message{
+			Headers: []kafka.Header{{Key: HeaderReplyTo, Value: []byte("replies")}},
+		}, map[string]ProducerFunc{})
+		suite.Assert().True(errors.Is(oniCtx.Reply("pong"), ErrProducerNotFound))
+	})
+}
+
 func (suite *ContextTestSuite) TestReaderStats() {
 	suite.Run("TestReaderStats", func() {
 		ctx := context.Background()
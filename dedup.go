@@ -0,0 +1,184 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HeaderDedupID header holding message id used by Dedup by default
+const HeaderDedupID = "message-id"
+
+// DedupStore keeps id of messages which already processed successfully
+type DedupStore interface {
+	Seen(ctx context.Context, id string) (bool, error)
+	Mark(ctx context.Context, id string) error
+}
+
+// MessageIDFunc extracts id used to deduplicate message,
+// message with empty id will not be deduplicated
+type MessageIDFunc func(ctx Context) string
+
+// HeaderMessageID uses value of given message header as message id
+func HeaderMessageID(key string) MessageIDFunc {
+	return func(ctx Context) string {
+		return ctx.Header(key)
+	}
+}
+
+// Dedup middleware skips message which id already marked inside store,
+// message id marked only after handler chain returns without error
+// so failed message still can be redelivered and processed again, nil
+// messageID uses HeaderMessageID(HeaderDedupID), message key is the
+// route of message so it must not be used as message id
+func Dedup(store DedupStore, messageID MessageIDFunc) Middleware {
+	if messageID == nil {
+		messageID = HeaderMessageID(HeaderDedupID)
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) error {
+			id := messageID(ctx)
+			if len(id) == 0 {
+				return next(ctx)
+			}
+
+			seen, err := store.Seen(ctx.OuterContext(), id)
+			if err != nil {
+				return err
+			}
+			if seen {
+				return nil
+			}
+
+			if err := next(ctx); err != nil {
+				return err
+			}
+			return store.Mark(ctx.OuterContext(), id)
+		}
+	}
+}
+
+// MemoryDedupStore keeps at most capacity message ids inside memory,
+// least recently used id evicted first and id expired after ttl,
+// zero capacity or ttl means unlimited
+type MemoryDedupStore struct {
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+	lock     sync.Mutex
+}
+
+type memoryDedupEntry struct {
+	id       string
+	markedAt time.Time
+}
+
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (s *MemoryDedupStore) Seen(ctx context.Context, id string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, ok := s.entries[id]
+	if !ok {
+		return false, nil
+	}
+	if s.ttl > 0 && time.Since(element.Value.(*memoryDedupEntry).markedAt) > s.ttl {
+		s.order.Remove(element)
+		delete(s.entries, id)
+		return false, nil
+	}
+	s.order.MoveToFront(element)
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Mark(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if element, ok := s.entries[id]; ok {
+		element.Value.(*memoryDedupEntry).markedAt = time.Now()
+		s.order.MoveToFront(element)
+		return nil
+	}
+
+	s.entries[id] = s.order.PushFront(&memoryDedupEntry{id: id, markedAt: time.Now()})
+	if s.capacity > 0 && s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryDedupEntry).id)
+	}
+	return nil
+}
+
+// SQLDedupStore keeps processed message ids inside SQL table
+// with id as primary key, table can be created by Migrate
+type SQLDedupStore struct {
+	db      *sql.DB
+	table   string
+	dialect SQLDialect
+}
+
+func NewSQLDedupStore(db *sql.DB, table string, dialect SQLDialect) *SQLDedupStore {
+	return &SQLDedupStore{db: db, table: table, dialect: dialect}
+}
+
+// Migrate creates dedup table when not exist
+func (s *SQLDedupStore) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (id VARCHAR(255) NOT NULL PRIMARY KEY, processed_at TIMESTAMP NOT NULL)",
+		s.table,
+	))
+	return err
+}
+
+func (s *SQLDedupStore) Seen(ctx context.Context, id string) (bool, error) {
+	var exists int
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT 1 FROM %s WHERE id = %s", s.table, s.dialect.Placeholder(1),
+	), id).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SQLDedupStore) Mark(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (id, processed_at) VALUES (%s, %s)", s.table, s.dialect.Placeholder(1), s.dialect.Placeholder(2),
+	), id, time.Now().UTC())
+	if err != nil {
+		// id inserted by other consumer processing the same message
+		if seen, seenErr := s.Seen(ctx, id); seenErr == nil && seen {
+			return nil
+		}
+	}
+	return err
+}
+
+// Purge deletes ids processed before given time
+func (s *SQLDedupStore) Purge(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE processed_at < %s", s.table, s.dialect.Placeholder(1),
+	), before.UTC())
+	return err
+}
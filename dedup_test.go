@@ -0,0 +1,143 @@
+package oni
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type TestDedupSuite struct {
+	suite.Suite
+}
+
+func TestDedupTestSuite(t *testing.T) {
+	suite.Run(t, new(TestDedupSuite))
+}
+
+func (suite *TestDedupSuite) TestDedup() {
+	suite.Run("TestDedup", func() {
+		calls := 0
+		failing := true
+		dedup := Dedup(NewMemoryDedupStore(10, time.Minute), HeaderMessageID("message-id"))(func(ctx Context) error {
+			calls++
+			if failing {
+				return errors.New("handler failed")
+			}
+			return nil
+		})
+		newMessage := func(id string) *octx {
+			return newContext(context.Background(), nil, kafka.Message{
+				Key:     []byte("create.foo"),
+				Headers: []kafka.Header{{Key: "message-id", Value: []byte(id)}},
+			}, nil)
+		}
+
+		// failed message is not marked so it can be processed again
+		suite.Assert().NotNil(dedup(newMessage("1")))
+		failing = false
+		suite.Assert().Nil(dedup(newMessage("1")))
+		suite.Assert().Nil(dedup(newMessage("1")))
+		suite.Assert().Equal(calls, 2)
+
+		// message without id always processed
+		suite.Assert().Nil(dedup(newMessage("")))
+		suite.Assert().Nil(dedup(newMessage("")))
+		suite.Assert().Equal(calls, 4)
+	})
+}
+
+func (suite *TestDedupSuite) TestMessageID() {
+	suite.Run("TestMessageID", func() {
+		ctx := newContext(context.Background(), nil, kafka.Message{
+			Key:     []byte("create.foo"),
+			Headers: []kafka.Header{{Key: "message-id", Value: []byte("1234")}},
+		}, nil)
+		suite.Assert().Equal(HeaderMessageID("message-id")(ctx), "1234")
+	})
+}
+
+func (suite *TestDedupSuite) TestDedupDefaultMessageID() {
+	suite.Run("TestDedupDefaultMessageID", func() {
+		calls := 0
+		dedup := Dedup(NewMemoryDedupStore(10, time.Minute), nil)(func(ctx Context) error {
+			calls++
+			return nil
+		})
+		// messages of the same route told apart by their message-id header
+		for _, id := range []string{"1", "2", "1"} {
+			suite.Assert().Nil(dedup(newContext(context.Background(), nil, kafka.Message{
+				Key:     []byte("create.foo"),
+				Headers: []kafka.Header{{Key: HeaderDedupID, Value: []byte(id)}},
+			}, nil)))
+		}
+		suite.Assert().Equal(calls, 2)
+	})
+}
+
+func (suite *TestDedupSuite) TestMemoryDedupStore() {
+	suite.Run("TestMemoryDedupStore", func() {
+		ctx := context.Background()
+		store := NewMemoryDedupStore(2, 0)
+		suite.Assert().Nil(store.Mark(ctx, "1"))
+		suite.Assert().Nil(store.Mark(ctx, "2"))
+
+		// "1" used recently so "2" evicted when capacity exceeded
+		seen, err := store.Seen(ctx, "1")
+		suite.Assert().Nil(err)
+		suite.Assert().True(seen)
+		suite.Assert().Nil(store.Mark(ctx, "3"))
+		seen, _ = store.Seen(ctx, "2")
+		suite.Assert().False(seen)
+		seen, _ = store.Seen(ctx, "1")
+		suite.Assert().True(seen)
+		seen, _ = store.Seen(ctx, "3")
+		suite.Assert().True(seen)
+	})
+}
+
+func (suite *TestDedupSuite) TestMemoryDedupStoreTTL() {
+	suite.Run("TestMemoryDedupStoreTTL", func() {
+		ctx := context.Background()
+		store := NewMemoryDedupStore(0, 10*time.Millisecond)
+		suite.Assert().Nil(store.Mark(ctx, "1"))
+		seen, _ := store.Seen(ctx, "1")
+		suite.Assert().True(seen)
+		time.Sleep(20 * time.Millisecond)
+		seen, _ = store.Seen(ctx, "1")
+		suite.Assert().False(seen)
+		suite.Assert().Len(store.entries, 0)
+	})
+}
+
+func (suite *TestDedupSuite) TestSQLDedupStore() {
+	suite.Run("TestSQLDedupStore", func() {
+		ctx := context.Background()
+		db, err := sql.Open("sqlite3", ":memory:")
+		suite.Require().Nil(err)
+		defer db.Close()
+		db.SetMaxOpenConns(1)
+
+		store := NewSQLDedupStore(db, "oni_dedup", SQLiteDialect)
+		suite.Assert().Nil(store.Migrate(ctx))
+		suite.Assert().Nil(store.Migrate(ctx))
+
+		seen, err := store.Seen(ctx, "1")
+		suite.Assert().Nil(err)
+		suite.Assert().False(seen)
+		suite.Assert().Nil(store.Mark(ctx, "1"))
+		suite.Assert().Nil(store.Mark(ctx, "1"))
+		seen, err = store.Seen(ctx, "1")
+		suite.Assert().Nil(err)
+		suite.Assert().True(seen)
+
+		suite.Assert().Nil(store.Purge(ctx, time.Now().Add(time.Minute)))
+		seen, _ = store.Seen(ctx, "1")
+		suite.Assert().False(seen)
+	})
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"time"
+)
+
+const HeaderDeliverAt = "deliver-at"
+
+// DeliverAtHeader returns deliver-at header of given time
+// formatted as RFC 3339 with nanoseconds in UTC
+func DeliverAtHeader(at time.Time) kafka.Header {
+	return kafka.Header{Key: HeaderDeliverAt, Value: []byte(at.UTC().Format(time.RFC3339Nano))}
+}
+
+// DeliverAt returns time stamped into message deliver-at header,
+// returns false when message has no valid deliver-at header
+func DeliverAt(m kafka.Message) (time.Time, bool) {
+	for _, header := range m.Headers {
+		if header.Key != HeaderDeliverAt {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, string(header.Value))
+		if err != nil {
+			return time.Time{}, false
+		}
+		return at, true
+	}
+	return time.Time{}, false
+}
+
+// withDeliverAt replaces deliver-at header of given headers
+func withDeliverAt(headers []kafka.Header, at time.Time) []kafka.Header {
+	stamped := make([]kafka.Header, 0, len(headers)+1)
+	for _, header := range headers {
+		if header.Key != HeaderDeliverAt {
+			stamped = append(stamped, header)
+		}
+	}
+	return append(stamped, DeliverAtHeader(at))
+}
+
+// delayed returned by Delay middleware while message is not due
+type delayed struct {
+	until time.Time
+}
+
+func (d *delayed) Error() string {
+	return fmt.Sprintf("message delayed until %s", d.until.Format(time.RFC3339Nano))
+}
+
+// Delay middleware holds message stamped by Context.SendAt or Context.SendAfter
+// until its deliver-at time, next messages of the same partition wait as well
+// while other partitions keep being consumed, handler chain invoked again once
+// message is due so Delay should be registered before other middlewares
+func Delay() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) error {
+			if at, ok := DeliverAt(ctx.Message()); ok && time.Now().Before(at) {
+				return &delayed{until: at}
+			}
+			return next(ctx)
+		}
+	}
+}
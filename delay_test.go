@@ -0,0 +1,260 @@
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestDelaySuite struct {
+	suite.Suite
+}
+
+func TestDelayTestSuite(t *testing.T) {
+	suite.Run(t, new(TestDelaySuite))
+}
+
+func (suite *TestDelaySuite) TestDeliverAt() {
+	suite.Run("TestDeliverAt", func() {
+		at := time.Date(2022, 10, 1, 10, 0, 0, 5, time.UTC)
+		header := DeliverAtHeader(at)
+		suite.Assert().Equal(header.Key, HeaderDeliverAt)
+		suite.Assert().Equal(string(header.Value), "2022-10-01T10:00:00.000000005Z")
+
+		deliverAt, ok := DeliverAt(kafka.Message{Headers: []kafka.Header{header}})
+		suite.Assert().True(ok)
+		suite.Assert().True(deliverAt.Equal(at))
+
+		_, ok = DeliverAt(kafka.Message{})
+		suite.Assert().False(ok)
+		_, ok = DeliverAt(kafka.Message{Headers: []kafka.Header{{Key: HeaderDeliverAt, Value: []byte("soon")}}})
+		suite.Assert().False(ok)
+
+		headers := withDeliverAt([]kafka.Header{{Key: "a", Value: []byte("b")}, DeliverAtHeader(time.Now())}, at)
+		suite.Assert().Equal(headers, []kafka.Header{{Key: "a", Value: []byte("b")}, header})
+	})
+}
+
+func (suite *TestDelaySuite) TestSendAfter() {
+	suite.Run("TestSendAfter", func() {
+		transport := NewMemoryTransport()
+		producers := map[string]ProducerFunc{
+			"retries_producer": func() *kafka.Writer {
+				return &kafka.Writer{Topic: "foos-retry-5s"}
+			},
+		}
+		ctx := newContext(context.Background(), nil, kafka.Message{Key: []byte("create.foo")}, producers)
+		ctx.pool = newProducerPool(producers, transport)
+
+		before := time.Now()
+		suite.Assert().Nil(ctx.SendAfter("retries_producer", 5*time.Second, "create.foo", []byte("foo")))
+		at := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+		suite.Assert().Nil(ctx.SendAt("retries_producer", at, "create.foo", []byte("foo"), DeliverAtHeader(time.Now())))
+
+		messages := transport.Messages("foos-retry-5s")
+		suite.Assert().Len(messages, 2)
+		deliverAt, ok := DeliverAt(messages[0])
+		suite.Assert().True(ok)
+		suite.Assert().False(deliverAt.Before(before.Add(5 * time.Second)))
+		suite.Assert().Equal(messages[1].Headers, []kafka.Header{DeliverAtHeader(at)})
+	})
+}
+
+func (suite *TestDelaySuite) TestDelay() {
+	suite.Run("TestDelay", func() {
+		calls := 0
+		delay := Delay()(func(ctx Context) error {
+			calls++
+			return nil
+		})
+
+		until := time.Now().Add(time.Minute)
+		err := delay(newContext(context.Background(), nil, kafka.Message{
+			Headers: []kafka.Header{DeliverAtHeader(until)},
+		}, nil))
+		var d *delayed
+		suite.Assert().True(errors.As(err, &d))
+		suite.Assert().True(d.until.Equal(until))
+		suite.Assert().Equal(calls, 0)
+
+		suite.Assert().Nil(delay(newContext(context.Background(), nil, kafka.Message{
+			Headers: []kafka.Header{DeliverAtHeader(time.Now().Add(-time.Minute))},
+		}, nil)))
+		suite.Assert().Nil(delay(newContext(context.Background(), nil, kafka.Message{}, nil)))
+		suite.Assert().Equal(calls, 2)
+	})
+}
+
+func (suite *TestDelaySuite) TestDelayPartition() {
+	suite.Run("TestDelayPartition", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		transport.CreateTopic("foos", 2)
+
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Use(Delay())
+
+		var errs []error
+		consumer.ErrorHandler(func(err error) {
+			errs = append(errs, err)
+		})
+		var lock sync.Mutex
+		var handled []string
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.ValueString())
+			return nil
+		})
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos", Balancer: kafka.BalancerFunc(
+			func(m kafka.Message, partitions ...int) int {
+				if string(m.Value) == "other" {
+					return 1
+				}
+				return 0
+			},
+		)})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("delayed"), Headers: []kafka.Header{
+				DeliverAtHeader(time.Now().Add(100 * time.Millisecond)),
+			}},
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("after")},
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("other")},
+		))
+
+		// other partition is not blocked by delayed message
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(handled) == 1
+		}, 50*time.Millisecond, time.Millisecond)
+		lock.Lock()
+		suite.Assert().Equal(handled, []string{"other"})
+		lock.Unlock()
+
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(handled) == 3
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		suite.Assert().Equal(handled, []string{"other", "delayed", "after"})
+		suite.Assert().Len(errs, 0)
+	})
+}
+
+func (suite *TestDelaySuite) TestDelayPoll() {
+	suite.Run("TestDelayPoll", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		consumer.Use(Delay())
+		consumer.Handler("create.foo", func(ctx Context) error {
+			return nil
+		})
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create.foo"), Headers: []kafka.Header{
+			DeliverAtHeader(time.Now().Add(20 * time.Millisecond)),
+		}}))
+
+		start := time.Now()
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().GreaterOrEqual(time.Since(start), 20*time.Millisecond)
+
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create.foo"), Headers: []kafka.Header{
+			DeliverAtHeader(time.Now().Add(time.Minute)),
+		}}))
+		timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		var d *delayed
+		suite.Assert().True(errors.As(consumer.Poll(timeout), &d))
+	})
+}
+
+func (suite *TestDelaySuite) TestDelayBounded() {
+	suite.Run("TestDelayBounded", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		transport.CreateTopic("foos", 2)
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Use(Delay())
+		consumer.PartitionQueue(2)
+
+		var lock sync.Mutex
+		handled := make(map[int]int)
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled[ctx.Message().Partition]++
+			return nil
+		})
+		count := func(partition int) int {
+			lock.Lock()
+			defer lock.Unlock()
+			return handled[partition]
+		}
+
+		// partition 0 starts with delayed message, partition 1 is not delayed
+		messages := []kafka.Message{{Key: []byte("create.foo"), Value: []byte("0"), Headers: []kafka.Header{
+			DeliverAtHeader(time.Now().Add(300 * time.Millisecond)),
+		}}}
+		for i := 0; i < 5; i++ {
+			messages = append(messages, kafka.Message{Key: []byte("create.foo"), Value: []byte("0")})
+		}
+		for i := 0; i < 10; i++ {
+			messages = append(messages, kafka.Message{Key: []byte("create.foo"), Value: []byte("1")})
+		}
+		w := transport.Writer("test_producer", &kafka.Writer{
+			Topic: "foos",
+			Balancer: kafka.BalancerFunc(func(m kafka.Message, partitions ...int) int {
+				return int(m.Value[0] - '0')
+			}),
+		})
+		suite.Assert().Nil(w.WriteMessages(ctx, messages...))
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		// delayed partition paused once its queue is full while the other is consumed,
+		// implicit mode commits nothing of delayed partition before its message due
+		suite.Assert().Eventually(func() bool {
+			return count(1) == 10
+		}, time.Second, time.Millisecond)
+		suite.Assert().Equal(count(0), 0)
+		suite.Assert().Equal(consumer.stream.reader.Stats().Messages, int64(13))
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(-1))
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 1), int64(10))
+
+		suite.Assert().Eventually(func() bool {
+			return count(0) == 6
+		}, time.Second, time.Millisecond)
+		suite.Assert().Eventually(func() bool {
+			return transport.CommittedOffset("consumer-group-foos", "foos", 0) == 6
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-done
+	})
+}
@@ -0,0 +1,22 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+type TypedHandlerFunc[T any] func(ctx Context, msg T) error
+
+// Handle registers typed handler for specific key event, message value
+// decoded into T using configured Codec and validated using configured
+// Validator before handler invoked, decode and validation failures are
+// returned through error handler and routed by IConsumer.InvalidWith
+// like Context.ShouldBindAndValidate does
+func Handle[T any](c *Consumer, key string, handlerFunc TypedHandlerFunc[T]) {
+	c.Handler(key, func(ctx Context) error {
+		var msg T
+		if err := ctx.ShouldBindAndValidate(&msg); err != nil {
+			return err
+		}
+		return handlerFunc(ctx, msg)
+	})
+}
@@ -0,0 +1,106 @@
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type TestHandleSuite struct {
+	suite.Suite
+}
+
+func TestHandleTestSuite(t *testing.T) {
+	suite.Run(t, new(TestHandleSuite))
+}
+
+type dummyFoo struct {
+	FooContent string `json:"foo_content" validate:"required"`
+}
+
+func (suite *TestHandleSuite) TestHandle() {
+	suite.Run("TestHandle", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+			GroupID: "consumer-group-test",
+		}))
+		consumer.stream.ctx = context.Background()
+
+		var received dummyFoo
+		Handle(consumer.Group("event"), "create.foo", func(ctx Context, msg dummyFoo) error {
+			received = msg
+			return nil
+		})
+
+		handlers := consumer.stream.handlers["event.create.foo"]
+		suite.Assert().Len(handlers, 1)
+
+		err := handlers[0].HandlerFunc(consumer.stream.newContext(kafka.Message{
+			Key:   []byte("event.create.foo"),
+			Value: []byte("{\"foo_content\":\"this is foo\"}"),
+		}))
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(received.FooContent, "this is foo")
+	})
+}
+
+func (suite *TestHandleSuite) TestHandleDecodeError() {
+	suite.Run("TestHandleDecodeError", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+			GroupID: "consumer-group-test",
+		}))
+		consumer.stream.ctx = context.Background()
+
+		called := false
+		Handle(consumer, "create.foo", func(ctx Context, msg *dummyFoo) error {
+			called = true
+			return nil
+		})
+
+		err := consumer.stream.handlers["create.foo"][0].HandlerFunc(consumer.stream.newContext(kafka.Message{
+			Key:   []byte("create.foo"),
+			Value: []byte("{\"foo_content\":"),
+		}))
+		var decodeError *DecodeError
+		suite.Assert().True(errors.As(err, &decodeError))
+		suite.Assert().Equal(decodeError.Key, "create.foo")
+		suite.Assert().False(called)
+	})
+}
+
+func (suite *TestHandleSuite) TestHandleValidationError() {
+	suite.Run("TestHandleValidationError", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+			GroupID: "consumer-group-test",
+		}))
+		consumer.stream.ctx = context.Background()
+
+		called := false
+		Handle(consumer, "create.foo", func(ctx Context, msg dummyFoo) error {
+			called = true
+			return nil
+		})
+
+		err := consumer.stream.handlers["create.foo"][0].HandlerFunc(consumer.stream.newContext(kafka.Message{
+			Key:   []byte("create.foo"),
+			Value: []byte("{}"),
+		}))
+		suite.Assert().IsType(ValidationErrors{}, err)
+		suite.Assert().False(called)
+
+		consumer.Validator(nil)
+		err = consumer.stream.handlers["create.foo"][0].HandlerFunc(consumer.stream.newContext(kafka.Message{
+			Key:   []byte("create.foo"),
+			Value: []byte("{}"),
+		}))
+		suite.Assert().Nil(err)
+		suite.Assert().True(called)
+	})
+}
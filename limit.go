@@ -0,0 +1,164 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit of messages handled by consumer, group or key, zero field is disabled
+type Limit struct {
+	// Rate messages per second refilled into token bucket
+	Rate float64
+	// Burst size of token bucket, default 1
+	Burst int
+	// MaxInFlight messages handled at the same time
+	MaxInFlight int
+}
+
+// limiter token bucket and in flight slots of one Limit
+type limiter struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+	slots  chan struct{}
+	lock   sync.Mutex
+}
+
+func newLimiter(limit Limit) *limiter {
+	if limit.Burst <= 0 {
+		limit.Burst = 1
+	}
+	l := &limiter{limit: limit, tokens: float64(limit.Burst)}
+	if limit.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, limit.MaxInFlight)
+	}
+	return l
+}
+
+// acquire takes in flight slot then waits for token, slot given back
+// when ctx done or stop closed before token taken
+func (l *limiter) acquire(ctx context.Context, stop <-chan struct{}) error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-stop:
+			return errStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := l.take(ctx, stop); err != nil {
+		l.release()
+		return err
+	}
+	return nil
+}
+
+func (l *limiter) take(ctx context.Context, stop <-chan struct{}) error {
+	if l.limit.Rate <= 0 {
+		return nil
+	}
+	for {
+		l.lock.Lock()
+		now := time.Now()
+		if !l.last.IsZero() {
+			l.tokens += now.Sub(l.last).Seconds() * l.limit.Rate
+			if burst := float64(l.limit.Burst); l.tokens > burst {
+				l.tokens = burst
+			}
+		}
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.lock.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) / l.limit.Rate * float64(time.Second))
+		l.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return errStopped
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *limiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// limits of stream registered by Consumer.Limit and Consumer.LimitKey,
+// message acquires limit of consumer, every group its key belongs to and
+// its key in order, then gives back in flight slots once handled
+type limits struct {
+	consumer *limiter
+	groups   map[string]*limiter
+	keys     map[string]*limiter
+}
+
+func newLimits() *limits {
+	return &limits{
+		groups: make(map[string]*limiter),
+		keys:   make(map[string]*limiter),
+	}
+}
+
+func (ls *limits) matching(m kafka.Message) []*limiter {
+	key := string(m.Key)
+	var matched []*limiter
+	if ls.consumer != nil {
+		matched = append(matched, ls.consumer)
+	}
+	if len(ls.groups) != 0 {
+		groups := make([]string, 0, len(ls.groups))
+		for group := range ls.groups {
+			if strings.HasPrefix(key, group+".") {
+				groups = append(groups, group)
+			}
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			matched = append(matched, ls.groups[group])
+		}
+	}
+	if l, ok := ls.keys[key]; ok {
+		matched = append(matched, l)
+	}
+	return matched
+}
+
+// acquire blocks until every limit of message allows it to be handled
+func (ls *limits) acquire(ctx context.Context, m kafka.Message, stop <-chan struct{}) error {
+	matched := ls.matching(m)
+	for i, l := range matched {
+		if err := l.acquire(ctx, stop); err != nil {
+			for _, acquired := range matched[:i] {
+				acquired.release()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (ls *limits) release(m kafka.Message) {
+	for _, l := range ls.matching(m) {
+		l.release()
+	}
+}
@@ -0,0 +1,178 @@
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestLimitSuite struct {
+	suite.Suite
+}
+
+func TestLimitTestSuite(t *testing.T) {
+	suite.Run(t, new(TestLimitSuite))
+}
+
+func (suite *TestLimitSuite) TestLimiterRate() {
+	suite.Run("TestLimiterRate", func() {
+		ctx := context.Background()
+		l := newLimiter(Limit{Rate: 50, Burst: 2})
+
+		// burst taken immediately, the rest refilled every 20ms
+		start := time.Now()
+		suite.Assert().Nil(l.acquire(ctx, nil))
+		suite.Assert().Nil(l.acquire(ctx, nil))
+		suite.Assert().Less(time.Since(start), 20*time.Millisecond)
+		suite.Assert().Nil(l.acquire(ctx, nil))
+		suite.Assert().Nil(l.acquire(ctx, nil))
+		suite.Assert().GreaterOrEqual(time.Since(start), 35*time.Millisecond)
+
+		stop := make(chan struct{})
+		close(stop)
+		suite.Assert().ErrorIs(l.acquire(ctx, stop), errStopped)
+	})
+}
+
+func (suite *TestLimitSuite) TestLimiterMaxInFlight() {
+	suite.Run("TestLimiterMaxInFlight", func() {
+		ctx := context.Background()
+		l := newLimiter(Limit{MaxInFlight: 2})
+		suite.Assert().Nil(l.acquire(ctx, nil))
+		suite.Assert().Nil(l.acquire(ctx, nil))
+
+		stop := make(chan struct{})
+		close(stop)
+		suite.Assert().ErrorIs(l.acquire(ctx, stop), errStopped)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		suite.Assert().ErrorIs(l.acquire(cancelled, nil), context.Canceled)
+
+		acquired := make(chan error)
+		go func() {
+			acquired <- l.acquire(ctx, nil)
+		}()
+		l.release()
+		suite.Assert().Nil(<-acquired)
+		suite.Assert().Len(l.slots, 2)
+	})
+}
+
+func (suite *TestLimitSuite) TestLimits() {
+	suite.Run("TestLimits", func() {
+		ctx := context.Background()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(NewMemoryTransport())))
+		consumer.Limit(Limit{MaxInFlight: 3})
+		consumer.Group("event").Limit(Limit{MaxInFlight: 2})
+		consumer.Group("event.notification").LimitKey("blast", Limit{MaxInFlight: 1})
+
+		limits := consumer.stream.limits
+		blast := kafka.Message{Key: []byte("event.notification.blast")}
+		suite.Assert().Equal(limits.matching(blast), []*limiter{
+			limits.consumer, limits.groups["event"], limits.keys["event.notification.blast"],
+		})
+		suite.Assert().Equal(limits.matching(kafka.Message{Key: []byte("create.foo")}), []*limiter{limits.consumer})
+
+		// slots of acquired limits given back when the next one is full
+		suite.Assert().Nil(limits.acquire(ctx, blast, nil))
+		stop := make(chan struct{})
+		close(stop)
+		suite.Assert().ErrorIs(limits.acquire(ctx, blast, stop), errStopped)
+		suite.Assert().Len(limits.consumer.slots, 1)
+		suite.Assert().Len(limits.groups["event"].slots, 1)
+
+		limits.release(blast)
+		suite.Assert().Len(limits.consumer.slots, 0)
+		suite.Assert().Len(limits.keys["event.notification.blast"].slots, 0)
+	})
+}
+
+func (suite *TestLimitSuite) TestLimitStream() {
+	suite.Run("TestLimitStream", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		transport.CreateTopic("foos", 2)
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Explicit()
+
+		var lock sync.Mutex
+		var inFlight, maxInFlight int
+		var handled []string
+		consumer.Use(func(next HandlerFunc) HandlerFunc {
+			return func(ctx Context) error {
+				lock.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				lock.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+				err := next(ctx)
+
+				lock.Lock()
+				inFlight--
+				lock.Unlock()
+				return err
+			}
+		})
+		consumer.Group("create").Handler("foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.ValueString())
+			return ctx.Ack()
+		})
+		consumer.Group("create").LimitKey("foo", Limit{MaxInFlight: 1})
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos", Balancer: &kafka.RoundRobin{}})
+		for _, value := range []string{"1", "2", "3", "4", "5", "6"} {
+			suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create.foo"), Value: []byte(value)}))
+		}
+
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(handled) == 6
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		suite.Assert().Equal(maxInFlight, 1)
+		suite.Assert().Len(consumer.stream.limits.keys["create.foo"].slots, 0)
+	})
+}
+
+func (suite *TestLimitSuite) TestLimitPoll() {
+	suite.Run("TestLimitPoll", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		consumer.Handler("create.foo", func(ctx Context) error {
+			return nil
+		})
+		consumer.Limit(Limit{Rate: 50})
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		for _, value := range []string{"1", "2", "3"} {
+			suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create.foo"), Value: []byte(value)}))
+		}
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			suite.Assert().Nil(consumer.Poll(ctx))
+		}
+		suite.Assert().GreaterOrEqual(time.Since(start), 35*time.Millisecond)
+	})
+}
@@ -0,0 +1,581 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryTransport keeps every produced message inside memory
+// and serves them to readers of the same transport, useful
+// for testing consumers and producers without kafka brokers
+//
+// topics are created on first write or read with one partition
+// unless created before using CreateTopic, readers with GroupID
+// share partitions and committed offsets with other readers in
+// the same group like kafka consumer group does, once any member listens to
+// revocation every member gives its partitions up and new assignment starts
+// only after every revoked hook returned
+type MemoryTransport struct {
+	topics map[string][][]kafka.Message
+	groups map[string]*memoryGroup
+	notify chan struct{}
+	lock   sync.Mutex
+}
+
+type memoryGroup struct {
+	transport *MemoryTransport
+	members   []*memoryReader
+	offsets   map[string]map[int]int64
+	revoking  int
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		topics: make(map[string][][]kafka.Message),
+		groups: make(map[string]*memoryGroup),
+		notify: make(chan struct{}),
+	}
+}
+
+// CreateTopic creates topic with given number of partitions,
+// existing topic partitions only can be increased
+func (t *MemoryTransport) CreateTopic(topic string, partitions int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for len(t.topics[topic]) < partitions {
+		t.topics[topic] = append(t.topics[topic], nil)
+	}
+	t.rebalance(topic)
+	t.broadcast()
+}
+
+func (t *MemoryTransport) Reader(config kafka.ReaderConfig) Reader {
+	return t.RebalanceReader(config, nil, nil)
+}
+
+// RebalanceReader creates reader which hooks invoked on every rebalance of its group
+func (t *MemoryTransport) RebalanceReader(config kafka.ReaderConfig, assigned RebalanceFunc, revoked RebalanceFunc) RebalanceReader {
+	r := &memoryReader{
+		transport: t,
+		config:    config,
+		positions: make(map[string]map[int]int64),
+		closed:    make(chan struct{}),
+		assigned:  assigned,
+		revoked:   revoked,
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, topic := range r.topics() {
+		t.topic(topic)
+	}
+	if len(config.GroupID) == 0 {
+		r.assign(map[string][]int{config.Topic: {config.Partition}}, nil)
+		return r
+	}
+
+	group, ok := t.groups[config.GroupID]
+	if !ok {
+		group = &memoryGroup{transport: t, offsets: make(map[string]map[int]int64)}
+		t.groups[config.GroupID] = group
+	}
+	group.members = append(group.members, r)
+	group.rebalance()
+	return r
+}
+
+func (t *MemoryTransport) Writer(name string, w *kafka.Writer) Writer {
+	return t.writer(w)
+}
+
+func (t *MemoryTransport) writer(w *kafka.Writer) *memoryWriter {
+	balancer := w.Balancer
+	if balancer == nil {
+		balancer = &kafka.RoundRobin{}
+	}
+	return &memoryWriter{transport: t, topic: w.Topic, balancer: balancer}
+}
+
+// Messages returns copy of every message written to given topic
+// ordered by partition then offset
+func (t *MemoryTransport) Messages(topic string) []kafka.Message {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var messages []kafka.Message
+	for _, partition := range t.topics[topic] {
+		messages = append(messages, partition...)
+	}
+	return messages
+}
+
+// CommittedOffset returns next offset to be consumed by given group
+// for topic partition, or -1 when group has not committed it yet
+func (t *MemoryTransport) CommittedOffset(groupID string, topic string, partition int) int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	group, ok := t.groups[groupID]
+	if !ok {
+		return -1
+	}
+	if offset, ok := group.offsets[topic][partition]; ok {
+		return offset
+	}
+	return -1
+}
+
+// OffsetsAt returns offset of first message produced at or after given
+// time for every partition of topic, or zero offsets when time is zero
+func (t *MemoryTransport) OffsetsAt(ctx context.Context, config kafka.ReaderConfig, topic string, at time.Time) (map[int]int64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	offsets := make(map[int]int64)
+	for partition, messages := range t.topic(topic) {
+		offsets[partition] = offsetAt(messages, at)
+	}
+	return offsets, nil
+}
+
+func offsetAt(messages []kafka.Message, at time.Time) int64 {
+	return int64(sort.Search(len(messages), func(i int) bool {
+		return !messages[i].Time.Before(at)
+	}))
+}
+
+// topic returns partitions of given topic, creating it when not exist
+// caller must hold transport lock
+func (t *MemoryTransport) topic(topic string) [][]kafka.Message {
+	if _, ok := t.topics[topic]; !ok {
+		t.topics[topic] = make([][]kafka.Message, 1)
+		t.rebalance(topic)
+	}
+	return t.topics[topic]
+}
+
+// rebalance every group subscribed to given topic
+// caller must hold transport lock
+func (t *MemoryTransport) rebalance(topic string) {
+	for _, group := range t.groups {
+		if group.subscribes(topic) {
+			group.rebalance()
+		}
+	}
+}
+
+// broadcast wakes up every reader waiting for new message
+// caller must hold transport lock
+func (t *MemoryTransport) broadcast() {
+	close(t.notify)
+	t.notify = make(chan struct{})
+}
+
+// rebalance revokes partitions of every member listening to revocation,
+// then assigns partitions once every revoked hook returned
+// caller must hold transport lock
+func (g *memoryGroup) rebalance() {
+	for _, member := range g.members {
+		g.revoke(member)
+	}
+	if g.revoking != 0 {
+		// members read nothing until revocation finished
+		for _, member := range g.members {
+			member.assign(nil, nil)
+		}
+		return
+	}
+	g.assign()
+}
+
+// revoke invokes revoked hook of member holding any partition
+// caller must hold transport lock
+func (g *memoryGroup) revoke(r *memoryReader) {
+	if r.revoked == nil || len(r.assignment) == 0 {
+		return
+	}
+	revoked := r.assignments()
+	r.assign(nil, nil)
+	g.revoking++
+	r.notify(func() {
+		r.revoked(revoked)
+		g.transport.lock.Lock()
+		defer g.transport.lock.Unlock()
+		g.revoking--
+		if g.revoking == 0 {
+			g.assign()
+			g.transport.broadcast()
+		}
+	})
+}
+
+// assign assigns partitions of every topic subscribed by group
+// members in round-robin fashion ordered by join time
+// caller must hold transport lock
+func (g *memoryGroup) assign() {
+	assignments := make([]map[string][]int, len(g.members))
+	for i := range assignments {
+		assignments[i] = make(map[string][]int)
+	}
+
+	topics := make(map[string][]int)
+	for i, member := range g.members {
+		for _, topic := range member.topics() {
+			topics[topic] = append(topics[topic], i)
+		}
+	}
+	for topic, members := range topics {
+		for partition := range g.transport.topics[topic] {
+			member := members[partition%len(members)]
+			assignments[member][topic] = append(assignments[member][topic], partition)
+		}
+	}
+
+	for i, member := range g.members {
+		member.assign(assignments[i], g.offsets)
+		if member.assigned != nil {
+			r, assigned := member, member.assignments()
+			r.notify(func() {
+				r.assigned(assigned)
+			})
+		}
+	}
+}
+
+func (g *memoryGroup) subscribes(topic string) bool {
+	for _, member := range g.members {
+		for _, subscribed := range member.topics() {
+			if subscribed == topic {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g *memoryGroup) leave(r *memoryReader) {
+	for i, member := range g.members {
+		if member == r {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.revoke(r)
+	g.rebalance()
+}
+
+type memoryReader struct {
+	transport  *MemoryTransport
+	config     kafka.ReaderConfig
+	assignment []topicPartition
+	positions  map[string]map[int]int64
+	paused     map[topicPartition]bool
+	next       int
+	messages   int64
+	closed     chan struct{}
+	closeOnce  sync.Once
+	assigned   RebalanceFunc
+	revoked    RebalanceFunc
+	hooks      []func()
+}
+
+func (r *memoryReader) topics() []string {
+	if len(r.config.GroupTopics) != 0 {
+		return r.config.GroupTopics
+	}
+	return []string{r.config.Topic}
+}
+
+// assign replaces reader assignment, positions of assigned partition
+// start from committed offsets or reader StartOffset
+// caller must hold transport lock
+func (r *memoryReader) assign(assignment map[string][]int, committed map[string]map[int]int64) {
+	r.assignment = r.assignment[:0]
+	r.positions = make(map[string]map[int]int64)
+	for topic, partitions := range assignment {
+		r.positions[topic] = make(map[int]int64)
+		for _, partition := range partitions {
+			r.assignment = append(r.assignment, topicPartition{topic: topic, partition: partition})
+			if offset, ok := committed[topic][partition]; ok {
+				r.positions[topic][partition] = offset
+				continue
+			}
+			r.positions[topic][partition] = 0
+			if len(r.config.GroupID) != 0 && r.config.StartOffset == kafka.LastOffset {
+				r.positions[topic][partition] = int64(len(r.transport.topics[topic][partition]))
+			}
+		}
+	}
+	sort.Slice(r.assignment, func(i, j int) bool {
+		if r.assignment[i].topic != r.assignment[j].topic {
+			return r.assignment[i].topic < r.assignment[j].topic
+		}
+		return r.assignment[i].partition < r.assignment[j].partition
+	})
+	r.next = 0
+}
+
+// Assignments returns partitions assigned to reader
+func (r *memoryReader) Assignments() []Assignment {
+	r.transport.lock.Lock()
+	defer r.transport.lock.Unlock()
+	return r.assignments()
+}
+
+// assignments caller must hold transport lock
+func (r *memoryReader) assignments() []Assignment {
+	assignments := make([]Assignment, 0, len(r.assignment))
+	for _, tp := range r.assignment {
+		assignments = append(assignments, Assignment{Topic: tp.topic, Partition: tp.partition})
+	}
+	return assignments
+}
+
+// notify queues hook invoked outside transport lock, hooks
+// of the same reader invoked in order they are queued
+// caller must hold transport lock
+func (r *memoryReader) notify(hook func()) {
+	r.hooks = append(r.hooks, hook)
+	if len(r.hooks) == 1 {
+		go r.invokeHooks()
+	}
+}
+
+func (r *memoryReader) invokeHooks() {
+	r.transport.lock.Lock()
+	defer r.transport.lock.Unlock()
+	for len(r.hooks) != 0 {
+		hook := r.hooks[0]
+		r.transport.lock.Unlock()
+		hook()
+		r.transport.lock.Lock()
+		r.hooks = r.hooks[1:]
+	}
+}
+
+func (r *memoryReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	m, err := r.FetchMessage(ctx)
+	if err != nil {
+		return m, err
+	}
+	if len(r.config.GroupID) != 0 {
+		if err := r.CommitMessages(ctx, m); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+func (r *memoryReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		r.transport.lock.Lock()
+		for i := range r.assignment {
+			tp := r.assignment[(r.next+i)%len(r.assignment)]
+			if r.paused[tp] {
+				continue
+			}
+			messages := r.transport.topics[tp.topic][tp.partition]
+			offset := r.positions[tp.topic][tp.partition]
+			if offset < int64(len(messages)) {
+				m := messages[offset]
+				r.positions[tp.topic][tp.partition] = offset + 1
+				r.next = (r.next + i + 1) % len(r.assignment)
+				r.messages++
+				r.transport.lock.Unlock()
+				return m, nil
+			}
+		}
+		notify := r.transport.notify
+		r.transport.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-r.closed:
+			return kafka.Message{}, io.EOF
+		case <-notify:
+		}
+	}
+}
+
+// PausePartition stops fetching messages of partition until resumed
+func (r *memoryReader) PausePartition(topic string, partition int) {
+	r.transport.lock.Lock()
+	defer r.transport.lock.Unlock()
+	if r.paused == nil {
+		r.paused = make(map[topicPartition]bool)
+	}
+	r.paused[topicPartition{topic: topic, partition: partition}] = true
+}
+
+// ResumePartition fetches messages of paused partition again
+func (r *memoryReader) ResumePartition(topic string, partition int) {
+	r.transport.lock.Lock()
+	defer r.transport.lock.Unlock()
+	delete(r.paused, topicPartition{topic: topic, partition: partition})
+	r.transport.broadcast()
+}
+
+func (r *memoryReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if len(r.config.GroupID) == 0 {
+		return errors.New("kafka.(*Reader).CommitMessages: unavailable when GroupID is not set")
+	}
+
+	r.transport.lock.Lock()
+	defer r.transport.lock.Unlock()
+	r.commit(msgs)
+	return nil
+}
+
+// commit stores next offset of messages into reader group, highest offset
+// of each partition within msgs replaces committed one like kafka does
+// so lower offset can be committed to rewind the group
+// caller must hold transport lock
+func (r *memoryReader) commit(msgs []kafka.Message) {
+	group := r.transport.groups[r.config.GroupID]
+	committed := make(map[topicPartition]int64)
+	for _, m := range msgs {
+		tp := topicPartition{topic: m.Topic, partition: m.Partition}
+		if offset, ok := committed[tp]; !ok || offset < m.Offset+1 {
+			committed[tp] = m.Offset + 1
+		}
+	}
+	for tp, offset := range committed {
+		if _, ok := group.offsets[tp.topic]; !ok {
+			group.offsets[tp.topic] = make(map[int]int64)
+		}
+		group.offsets[tp.topic][tp.partition] = offset
+	}
+}
+
+// SetOffset moves reader without GroupID to given offset of its partition
+func (r *memoryReader) SetOffset(offset int64) error {
+	if len(r.config.GroupID) != 0 {
+		return errors.New("unavailable when GroupID is set")
+	}
+
+	r.transport.lock.Lock()
+	defer r.transport.lock.Unlock()
+	messages := r.transport.topics[r.config.Topic][r.config.Partition]
+	switch {
+	case offset == kafka.FirstOffset:
+		offset = 0
+	case offset == kafka.LastOffset || offset > int64(len(messages)):
+		offset = int64(len(messages))
+	}
+	r.positions[r.config.Topic][r.config.Partition] = offset
+	return nil
+}
+
+// SetOffsetAt moves reader without GroupID to first message produced at or after given time
+func (r *memoryReader) SetOffsetAt(ctx context.Context, t time.Time) error {
+	if len(r.config.GroupID) != 0 {
+		return errors.New("unavailable when GroupID is set")
+	}
+
+	r.transport.lock.Lock()
+	defer r.transport.lock.Unlock()
+	messages := r.transport.topics[r.config.Topic][r.config.Partition]
+	r.positions[r.config.Topic][r.config.Partition] = offsetAt(messages, t)
+	return nil
+}
+
+func (r *memoryReader) Stats() kafka.ReaderStats {
+	r.transport.lock.Lock()
+	defer r.transport.lock.Unlock()
+
+	stats := kafka.ReaderStats{Topic: r.config.Topic, Messages: r.messages}
+	if len(r.config.GroupID) == 0 {
+		stats.Partition = strconv.Itoa(r.config.Partition)
+		stats.Offset = r.positions[r.config.Topic][r.config.Partition]
+	}
+	return stats
+}
+
+func (r *memoryReader) Config() kafka.ReaderConfig {
+	return r.config
+}
+
+func (r *memoryReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+
+		r.transport.lock.Lock()
+		defer r.transport.lock.Unlock()
+		if group, ok := r.transport.groups[r.config.GroupID]; ok {
+			group.leave(r)
+		}
+	})
+	return nil
+}
+
+type memoryWriter struct {
+	transport *MemoryTransport
+	topic     string
+	balancer  kafka.Balancer
+}
+
+func (w *memoryWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	written, err := w.prepare(msgs)
+	if err != nil {
+		return err
+	}
+
+	w.transport.lock.Lock()
+	defer w.transport.lock.Unlock()
+	w.append(written)
+	w.transport.broadcast()
+	return nil
+}
+
+// prepare validates topic of messages the same way kafka writer does
+func (w *memoryWriter) prepare(msgs []kafka.Message) ([]kafka.Message, error) {
+	written := make([]kafka.Message, 0, len(msgs))
+	for _, m := range msgs {
+		switch {
+		case len(w.topic) != 0 && len(m.Topic) != 0:
+			return nil, errors.New("kafka.(*Writer): Topic must not be specified for both Writer and Message")
+		case len(w.topic) == 0 && len(m.Topic) == 0:
+			return nil, errors.New("kafka.(*Writer): Topic must be specified for Writer or Message")
+		case len(m.Topic) == 0:
+			m.Topic = w.topic
+		}
+		written = append(written, m)
+	}
+	return written, nil
+}
+
+// append writes messages into partitions chosen by writer balancer
+// caller must hold transport lock
+func (w *memoryWriter) append(msgs []kafka.Message) {
+	for _, m := range msgs {
+		partitions := w.transport.topic(m.Topic)
+		available := make([]int, len(partitions))
+		for i := range available {
+			available[i] = i
+		}
+
+		m.Partition = w.balancer.Balance(m, available...)
+		m.Offset = int64(len(partitions[m.Partition]))
+		if m.Time.IsZero() {
+			m.Time = time.Now()
+		}
+		partitions[m.Partition] = append(partitions[m.Partition], m)
+	}
+}
+
+func (w *memoryWriter) Close() error {
+	return nil
+}
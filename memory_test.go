@@ -0,0 +1,160 @@
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"testing"
+	"time"
+)
+
+type TestMemorySuite struct {
+	suite.Suite
+}
+
+func TestMemoryTestSuite(t *testing.T) {
+	suite.Run(t, new(TestMemorySuite))
+}
+
+func (suite *TestMemorySuite) TestMemoryWriteRead() {
+	suite.Run("TestMemoryWriteRead", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		w := transport.Writer("test_producer", BasicWriter(kafka.TCP("localhost:8097"), "test"))
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("a"), Value: []byte("1")},
+			kafka.Message{Key: []byte("b"), Value: []byte("2")},
+		))
+
+		r := transport.Reader(kafka.ReaderConfig{Topic: "test"})
+		m, err := r.FetchMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Key), "a")
+		suite.Assert().Equal(m.Topic, "test")
+		suite.Assert().Equal(m.Offset, int64(0))
+		m, err = r.ReadMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Key), "b")
+		suite.Assert().Equal(m.Offset, int64(1))
+		suite.Assert().Len(transport.Messages("test"), 2)
+	})
+}
+
+func (suite *TestMemorySuite) TestMemoryReadBlocking() {
+	suite.Run("TestMemoryReadBlocking", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		r := transport.Reader(kafka.ReaderConfig{Topic: "test"})
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			_ = transport.Writer("test_producer", &kafka.Writer{}).WriteMessages(ctx, kafka.Message{Topic: "test", Key: []byte("a")})
+		}()
+		m, err := r.FetchMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Key), "a")
+
+		timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = r.FetchMessage(timeout)
+		suite.Assert().Equal(err, context.DeadlineExceeded)
+
+		suite.Assert().Nil(r.Close())
+		_, err = r.FetchMessage(ctx)
+		suite.Assert().Equal(err, io.EOF)
+	})
+}
+
+func (suite *TestMemorySuite) TestMemoryWriterTopic() {
+	suite.Run("TestMemoryWriterTopic", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		suite.Assert().NotNil(transport.Writer("test_producer", &kafka.Writer{Topic: "test"}).WriteMessages(ctx, kafka.Message{Topic: "test"}))
+		suite.Assert().NotNil(transport.Writer("test_producer", &kafka.Writer{}).WriteMessages(ctx, kafka.Message{}))
+		suite.Assert().Len(transport.Messages("test"), 0)
+	})
+}
+
+func (suite *TestMemorySuite) TestMemoryPartitions() {
+	suite.Run("TestMemoryPartitions", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		transport.CreateTopic("test", 3)
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "test", Balancer: &kafka.Hash{}})
+		for i := 0; i < 6; i++ {
+			suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("same-key")}))
+		}
+
+		messages := transport.Messages("test")
+		suite.Assert().Len(messages, 6)
+		for i, m := range messages {
+			suite.Assert().Equal(m.Partition, messages[0].Partition)
+			suite.Assert().Equal(m.Offset, int64(i))
+		}
+
+		r := transport.Reader(kafka.ReaderConfig{Topic: "test", Partition: messages[0].Partition})
+		m, err := r.FetchMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(m.Partition, messages[0].Partition)
+		suite.Assert().NotNil(r.CommitMessages(ctx, m))
+	})
+}
+
+func (suite *TestMemorySuite) TestMemoryConsumerGroup() {
+	suite.Run("TestMemoryConsumerGroup", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		transport.CreateTopic("test", 2)
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "test"})
+		for i := 0; i < 4; i++ {
+			suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("a")}))
+		}
+
+		r1 := transport.Reader(kafka.ReaderConfig{Topic: "test", GroupID: "group"})
+		r2 := transport.Reader(kafka.ReaderConfig{Topic: "test", GroupID: "group"})
+
+		m1, err := r1.ReadMessage(ctx)
+		suite.Assert().Nil(err)
+		m2, err := r2.ReadMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().NotEqual(m1.Partition, m2.Partition)
+		suite.Assert().Equal(transport.CommittedOffset("group", "test", m1.Partition), int64(1))
+		suite.Assert().Equal(transport.CommittedOffset("group", "test", m2.Partition), int64(1))
+
+		// uncommitted message is delivered again to remaining member after rebalance
+		m3, err := r2.FetchMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(m3.Offset, int64(1))
+		suite.Assert().Nil(r2.Close())
+
+		seen := map[int]int64{}
+		for i := 0; i < 2; i++ {
+			m, err := r1.FetchMessage(ctx)
+			suite.Assert().Nil(err)
+			seen[m.Partition] = m.Offset
+			suite.Assert().Nil(r1.CommitMessages(ctx, m))
+		}
+		suite.Assert().Equal(seen, map[int]int64{0: 1, 1: 1})
+		suite.Assert().Equal(transport.CommittedOffset("group", "test", m2.Partition), int64(2))
+		suite.Assert().Equal(transport.CommittedOffset("other", "test", 0), int64(-1))
+	})
+}
+
+func (suite *TestMemorySuite) TestMemoryStartOffset() {
+	suite.Run("TestMemoryStartOffset", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "test"})
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("old")}))
+
+		r := transport.Reader(kafka.ReaderConfig{Topic: "test", GroupID: "group", StartOffset: kafka.LastOffset})
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("new")}))
+		m, err := r.FetchMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Key), "new")
+		suite.Assert().Equal(r.Stats().Messages, int64(1))
+	})
+}
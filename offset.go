@@ -0,0 +1,161 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"github.com/segmentio/kafka-go"
+	"sync"
+	"time"
+)
+
+// offsetManager collects acknowledged messages of explicit mode and commits
+// highest offset of each partition which every fetched message before it is
+// acknowledged, so message not acknowledged yet is consumed again after restart,
+// message without handler or failed by its handler is marked by the stream
+type offsetManager struct {
+	interval   time.Duration
+	count      int
+	partitions map[topicPartition]*partitionOffsets
+	ready      map[topicPartition]kafka.Message
+	acked      int
+	flushed    time.Time
+	signal     chan struct{}
+	lock       sync.Mutex
+	cLock      sync.Mutex
+}
+
+// partitionOffsets offsets fetched but not committed yet in fetch order
+type partitionOffsets struct {
+	offsets []int64
+	done    map[int64]bool
+}
+
+func newOffsetManager(interval time.Duration, count int) *offsetManager {
+	return &offsetManager{
+		interval:   interval,
+		count:      count,
+		partitions: make(map[topicPartition]*partitionOffsets),
+		ready:      make(map[topicPartition]kafka.Message),
+		flushed:    time.Now(),
+		signal:     make(chan struct{}, 1),
+	}
+}
+
+func (om *offsetManager) track(m kafka.Message) {
+	om.lock.Lock()
+	defer om.lock.Unlock()
+	tp := topicPartition{topic: m.Topic, partition: m.Partition}
+	p, ok := om.partitions[tp]
+	if !ok {
+		p = &partitionOffsets{done: make(map[int64]bool)}
+		om.partitions[tp] = p
+	}
+	p.offsets = append(p.offsets, m.Offset)
+}
+
+// done marks message acknowledged, message which is not tracked is ignored
+func (om *offsetManager) done(m kafka.Message) {
+	om.lock.Lock()
+	defer om.lock.Unlock()
+	p, ok := om.partitions[topicPartition{topic: m.Topic, partition: m.Partition}]
+	if !ok {
+		return
+	}
+	p.done[m.Offset] = true
+	om.acked++
+	if om.count > 0 && om.acked >= om.count {
+		select {
+		case om.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// due reports whether acknowledged count or interval since last flush reached
+func (om *offsetManager) due() bool {
+	om.lock.Lock()
+	defer om.lock.Unlock()
+	return (om.count > 0 && om.acked >= om.count) ||
+		(om.interval > 0 && time.Since(om.flushed) >= om.interval)
+}
+
+// take moves acknowledged prefix of every partition into ready offsets
+// and returns ready offsets, caller must hold commit lock
+func (om *offsetManager) take() []kafka.Message {
+	om.lock.Lock()
+	defer om.lock.Unlock()
+	for tp, p := range om.partitions {
+		i := 0
+		for i < len(p.offsets) && p.done[p.offsets[i]] {
+			delete(p.done, p.offsets[i])
+			i++
+		}
+		if i != 0 {
+			om.ready[tp] = kafka.Message{Topic: tp.topic, Partition: tp.partition, Offset: p.offsets[i-1]}
+			p.offsets = p.offsets[i:]
+		}
+	}
+	om.acked = 0
+	om.flushed = time.Now()
+
+	msgs := make([]kafka.Message, 0, len(om.ready))
+	for _, m := range om.ready {
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// flush commits ready offsets, offsets which commit failed are kept and
+// committed again on next flush unless higher offset acknowledged meanwhile
+func (om *offsetManager) flush(commit func(msgs []kafka.Message) error) error {
+	om.cLock.Lock()
+	defer om.cLock.Unlock()
+
+	msgs := om.take()
+	if len(msgs) == 0 {
+		return nil
+	}
+	if err := commit(msgs); err != nil {
+		return err
+	}
+
+	om.lock.Lock()
+	defer om.lock.Unlock()
+	for _, m := range msgs {
+		tp := topicPartition{topic: m.Topic, partition: m.Partition}
+		if ready, ok := om.ready[tp]; ok && ready.Offset == m.Offset {
+			delete(om.ready, tp)
+		}
+	}
+	return nil
+}
+
+// reset forgets every tracked offset once reader starts from other offsets
+func (om *offsetManager) reset() {
+	om.lock.Lock()
+	defer om.lock.Unlock()
+	om.partitions = make(map[topicPartition]*partitionOffsets)
+	om.ready = make(map[topicPartition]kafka.Message)
+	om.acked = 0
+}
+
+// run flushes every interval or once acknowledged count reached until stop closed
+func (om *offsetManager) run(stop <-chan struct{}, flush func()) {
+	var tick <-chan time.Time
+	if om.interval > 0 {
+		ticker := time.NewTicker(om.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-om.signal:
+		case <-stop:
+			return
+		}
+		flush()
+	}
+}
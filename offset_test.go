@@ -0,0 +1,289 @@
+package oni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestOffsetSuite struct {
+	suite.Suite
+}
+
+func TestOffsetTestSuite(t *testing.T) {
+	suite.Run(t, new(TestOffsetSuite))
+}
+
+func (suite *TestOffsetSuite) TestOffsetManager() {
+	suite.Run("TestOffsetManager", func() {
+		om := newOffsetManager(0, 3)
+		for _, offset := range []int64{0, 1, 2, 4} {
+			om.track(kafka.Message{Topic: "foos", Partition: 0, Offset: offset})
+		}
+		om.track(kafka.Message{Topic: "foos", Partition: 1, Offset: 7})
+
+		var committed [][]kafka.Message
+		commit := func(msgs []kafka.Message) error {
+			committed = append(committed, msgs)
+			return nil
+		}
+
+		// highest acknowledged offset which every offset before it acknowledged
+		om.done(kafka.Message{Topic: "foos", Partition: 0, Offset: 0})
+		om.done(kafka.Message{Topic: "foos", Partition: 0, Offset: 2})
+		om.done(kafka.Message{Topic: "bars", Partition: 0, Offset: 2})
+		suite.Assert().False(om.due())
+		suite.Assert().Nil(om.flush(commit))
+		suite.Assert().Equal(committed, [][]kafka.Message{{{Topic: "foos", Partition: 0, Offset: 0}}})
+
+		// nothing acknowledged since last flush
+		suite.Assert().Nil(om.flush(commit))
+		suite.Assert().Len(committed, 1)
+
+		om.done(kafka.Message{Topic: "foos", Partition: 0, Offset: 1})
+		om.done(kafka.Message{Topic: "foos", Partition: 0, Offset: 4})
+		om.done(kafka.Message{Topic: "foos", Partition: 1, Offset: 7})
+		suite.Assert().True(om.due())
+		suite.Assert().Nil(om.flush(commit))
+		suite.Assert().ElementsMatch(committed[1], []kafka.Message{
+			{Topic: "foos", Partition: 0, Offset: 4},
+			{Topic: "foos", Partition: 1, Offset: 7},
+		})
+		suite.Assert().False(om.due())
+	})
+}
+
+func (suite *TestOffsetSuite) TestOffsetManagerRetry() {
+	suite.Run("TestOffsetManagerRetry", func() {
+		om := newOffsetManager(10*time.Millisecond, 0)
+		m := kafka.Message{Topic: "foos", Partition: 0, Offset: 3}
+		om.track(m)
+		om.done(m)
+
+		errCommit := errors.New("commit failed")
+		suite.Assert().ErrorIs(om.flush(func(msgs []kafka.Message) error {
+			return errCommit
+		}), errCommit)
+		suite.Assert().False(om.due())
+		suite.Assert().Eventually(om.due, time.Second, time.Millisecond)
+
+		// failed offsets committed again on next flush
+		var committed []kafka.Message
+		suite.Assert().Nil(om.flush(func(msgs []kafka.Message) error {
+			committed = msgs
+			return nil
+		}))
+		suite.Assert().Equal(committed, []kafka.Message{m})
+
+		om.track(kafka.Message{Topic: "foos", Partition: 0, Offset: 4})
+		om.reset()
+		om.done(kafka.Message{Topic: "foos", Partition: 0, Offset: 4})
+		suite.Assert().Nil(om.flush(func(msgs []kafka.Message) error {
+			suite.Fail("nothing should be committed after reset")
+			return nil
+		}))
+	})
+}
+
+func (suite *TestOffsetSuite) TestStreamBatchCommit() {
+	suite.Run("TestStreamBatchCommit", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Explicit()
+		consumer.BatchCommit(time.Hour, 3)
+
+		var lock sync.Mutex
+		var handled []string
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.ValueString())
+			if ctx.ValueString() == "5" {
+				// never acknowledged, blocks commit of offsets after it
+				return nil
+			}
+			return ctx.Ack()
+		})
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		suite.Assert().Nil(writeFoos(transport, "0", "1", "2", "3"))
+		suite.Assert().Eventually(func() bool {
+			return transport.CommittedOffset("consumer-group-foos", "foos", 0) >= 3
+		}, time.Second, time.Millisecond)
+
+		suite.Assert().Nil(writeFoos(transport, "4", "5", "6"))
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(handled) == 7
+		}, time.Second, time.Millisecond)
+
+		// remaining acknowledged offsets committed once stream stopped
+		cancel()
+		<-done
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(5))
+	})
+}
+
+func (suite *TestOffsetSuite) TestStreamBatchCommitUnhandled() {
+	suite.Run("TestStreamBatchCommitUnhandled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Explicit()
+		consumer.BatchCommit(0, 1)
+
+		var lock sync.Mutex
+		var errs []error
+		var handled []string
+		consumer.ErrorHandler(func(err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			errs = append(errs, err)
+		})
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.ValueString())
+			if ctx.ValueString() == "3" {
+				return errors.New("failed")
+			}
+			return ctx.Ack()
+		})
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		// message without handler and message failed by handler do not block commit
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		for i, key := range []string{"create.foo", "unknown", "create.foo", "create.foo", "create.foo"} {
+			suite.Assert().Nil(w.WriteMessages(context.Background(), kafka.Message{
+				Key:   []byte(key),
+				Value: []byte(fmt.Sprint(i)),
+			}))
+		}
+		suite.Assert().Eventually(func() bool {
+			return transport.CommittedOffset("consumer-group-foos", "foos", 0) == 5
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		lock.Lock()
+		defer lock.Unlock()
+		suite.Assert().Equal(handled, []string{"0", "2", "3", "4"})
+		suite.Assert().Equal(errs, []error{errors.New("failed")})
+		suite.Assert().Empty(consumer.stream.offsets.partitions[topicPartition{topic: "foos"}].done)
+	})
+}
+
+func (suite *TestOffsetSuite) TestStreamBatchCommitClose() {
+	suite.Run("TestStreamBatchCommitClose", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Explicit()
+		consumer.BatchCommit(time.Hour, 0)
+
+		var lock sync.Mutex
+		var handled int
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled++
+			return ctx.Ack()
+		})
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		suite.Assert().Nil(writeFoos(transport, "0", "1"))
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return handled == 2
+		}, time.Second, time.Millisecond)
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(-1))
+
+		suite.Assert().Nil(consumer.closeConsumers())
+		<-done
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(2))
+	})
+}
+
+func (suite *TestOffsetSuite) TestPollBatchCommit() {
+	suite.Run("TestPollBatchCommit", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		consumer.Explicit()
+		consumer.BatchCommit(0, 2)
+		consumer.Handler("create.foo", func(ctx Context) error {
+			return ctx.Ack()
+		})
+		suite.Assert().Nil(writeFoos(transport, "0", "1"))
+
+		// commit error returned by poll which made the batch due
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().EqualError(consumer.Poll(ctx), "kafka.(*Reader).CommitMessages: unavailable when GroupID is not set")
+	})
+}
+
+func (suite *TestOffsetSuite) TestStreamBatchCommitError() {
+	suite.Run("TestStreamBatchCommitError", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		consumer.Explicit()
+		consumer.BatchCommit(0, 1)
+
+		errs := make(chan error, 1)
+		consumer.ErrorHandler(func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+		consumer.Handler("create.foo", func(ctx Context) error {
+			return ctx.Ack()
+		})
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+		suite.Assert().Nil(writeFoos(transport, "0"))
+
+		// commit error reported to error handler
+		suite.Assert().EqualError(<-errs, "kafka.(*Reader).CommitMessages: unavailable when GroupID is not set")
+		cancel()
+		<-done
+	})
+}
@@ -0,0 +1,438 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package onitest
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/xoxoist/oni"
+	"sync"
+	"time"
+)
+
+var _ oni.Context = (*Context)(nil)
+
+type Option func(c *Context)
+
+// WithContext sets outer context returned by Context.OuterContext
+func WithContext(ctx context.Context) Option {
+	return func(c *Context) {
+		c.outerContext = ctx
+	}
+}
+
+// WithCodec sets codec used by Context.ShouldBind and Context.Reply,
+// nil codec keeps default json codec
+func WithCodec(codec oni.Codec) Option {
+	return func(c *Context) {
+		if codec != nil {
+			c.codec = codec
+		}
+	}
+}
+
+// WithValidator sets validator used by Context.ShouldBindAndValidate
+func WithValidator(validator oni.Validator) Option {
+	return func(c *Context) {
+		c.validator = validator
+	}
+}
+
+// WithReaderConfig sets config returned by Context.ReaderConfig
+func WithReaderConfig(config kafka.ReaderConfig) Option {
+	return func(c *Context) {
+		c.readerConfig = config
+	}
+}
+
+// WithProducer sets writer returned by Context.GetProducer
+func WithProducer(name string, w *kafka.Writer) Option {
+	return func(c *Context) {
+		c.writers[name] = w
+	}
+}
+
+// WithAssignments sets partitions returned by Context.Assignments
+func WithAssignments(assignments ...oni.Assignment) Option {
+	return func(c *Context) {
+		c.assignments = assignments
+	}
+}
+
+// WithOutbox sets outbox returned by Context.Outbox
+func WithOutbox(outbox *oni.Outbox) Option {
+	return func(c *Context) {
+		c.outbox = outbox
+	}
+}
+
+type retry struct {
+	OriginKey string `json:"origin_key"`
+	Value     string `json:"value"`
+}
+
+// Context fake implementation of oni.Context, every message produced
+// through it is recorded instead of sent so handler can be tested
+// by calling it directly with this context
+type Context struct {
+	outerContext context.Context
+	message      kafka.Message
+	codec        oni.Codec
+	validator    oni.Validator
+	readerConfig kafka.ReaderConfig
+	writers      map[string]*kafka.Writer
+	outbox       *oni.Outbox
+	assignments  []oni.Assignment
+	headers      []kafka.Header
+	keys         map[interface{}]interface{}
+	produced     map[string][]kafka.Message
+	replies      []kafka.Message
+	acked        int
+	nacked       int
+	seekOffset   int64
+	paused       time.Duration
+	lock         sync.Mutex
+}
+
+func NewContext(msg kafka.Message, opts ...Option) *Context {
+	c := &Context{
+		outerContext: context.Background(),
+		message:      msg,
+		codec:        oni.JSONCodec(),
+		validator:    oni.TagValidator(),
+		writers:      make(map[string]*kafka.Writer),
+		keys:         make(map[interface{}]interface{}),
+		produced:     make(map[string][]kafka.Message),
+		seekOffset:   -1,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Produced returns messages produced to producer with given name
+func (c *Context) Produced(producerFuncName string) []kafka.Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]kafka.Message(nil), c.produced[producerFuncName]...)
+}
+
+// Replies returns messages sent by Context.Reply
+func (c *Context) Replies() []kafka.Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]kafka.Message(nil), c.replies...)
+}
+
+// Acked returns number of Context.Ack calls
+func (c *Context) Acked() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.acked
+}
+
+func (c *Context) ShouldBind(v interface{}) error {
+	return c.codec.Unmarshal(c.message.Value, v)
+}
+
+func (c *Context) ShouldBindJSON(v interface{}) error {
+	return json.Unmarshal(c.message.Value, v)
+}
+
+func (c *Context) ShouldBindAndValidate(v interface{}) error {
+	if err := c.ShouldBind(v); err != nil {
+		return &oni.DecodeError{Key: c.KeyString(), Err: err}
+	}
+	if c.validator != nil {
+		return c.validator.Validate(v)
+	}
+	return nil
+}
+
+func (c *Context) ShouldRetryWith(producerFuncName string) error {
+	value, err := json.Marshal(retry{OriginKey: c.KeyString(), Value: c.ValueString()})
+	if err != nil {
+		return err
+	}
+	return c.produce(producerFuncName, kafka.Message{
+		Key:   []byte(fmt.Sprintf("%s.%s", "retry", c.KeyString())),
+		Value: value,
+	})
+}
+
+func (c *Context) ShouldErrorWith(producerFuncName string) error {
+	value, err := json.Marshal(retry{OriginKey: c.KeyString(), Value: c.ValueString()})
+	if err != nil {
+		return err
+	}
+	return c.produce(producerFuncName, kafka.Message{
+		Key:   []byte(fmt.Sprintf("%s.%s", "failed", c.KeyString())),
+		Value: value,
+	})
+}
+
+func (c *Context) ShouldReturnWith(producerFuncName string) error {
+	var retryData retry
+	if err := json.Unmarshal(c.message.Value, &retryData); err != nil {
+		return err
+	}
+	return c.produce(producerFuncName, kafka.Message{
+		Key:   []byte(retryData.OriginKey),
+		Value: []byte(retryData.Value),
+	})
+}
+
+func (c *Context) Send(producerFuncName string, key string, value []byte, headers ...kafka.Header) error {
+	return c.produce(producerFuncName, kafka.Message{Key: []byte(key), Value: value, Headers: headers})
+}
+
+func (c *Context) SendJSON(producerFuncName string, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(producerFuncName, key, value)
+}
+
+func (c *Context) SendAt(producerFuncName string, at time.Time, key string, value []byte, headers ...kafka.Header) error {
+	stamped := make([]kafka.Header, 0, len(headers)+1)
+	for _, header := range headers {
+		if header.Key != oni.HeaderDeliverAt {
+			stamped = append(stamped, header)
+		}
+	}
+	return c.Send(producerFuncName, key, value, append(stamped, oni.DeliverAtHeader(at))...)
+}
+
+func (c *Context) SendAfter(producerFuncName string, delay time.Duration, key string, value []byte, headers ...kafka.Header) error {
+	return c.SendAt(producerFuncName, time.Now().Add(delay), key, value, headers...)
+}
+
+func (c *Context) Forward(producerFuncName string) error {
+	return c.produce(producerFuncName, kafka.Message{
+		Key:     c.message.Key,
+		Value:   c.message.Value,
+		Headers: c.message.Headers,
+	})
+}
+
+func (c *Context) Reply(v interface{}) error {
+	replyTo := c.Header(oni.HeaderReplyTo)
+	if len(replyTo) == 0 {
+		return oni.ErrNoReplyTo
+	}
+	value, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.replies = append(c.replies, c.outgoing(kafka.Message{Topic: replyTo, Key: c.message.Key, Value: value}))
+	return nil
+}
+
+// Outbox returns outbox of given transaction, messages are stored
+// into outbox table configured by WithOutbox without being recorded
+func (c *Context) Outbox(tx *sql.Tx) *oni.OutboxTx {
+	return c.outbox.Tx(tx)
+}
+
+func (c *Context) produce(producerFuncName string, m kafka.Message) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.produced[producerFuncName] = append(c.produced[producerFuncName], c.outgoing(m))
+	return nil
+}
+
+// outgoing adds outgoing headers and incoming correlation id
+// the same way oni context does before producing message
+func (c *Context) outgoing(m kafka.Message) kafka.Message {
+	headers := append([]kafka.Header(nil), m.Headers...)
+	for _, header := range c.headers {
+		if !hasHeader(headers, header.Key) {
+			headers = append(headers, header)
+		}
+	}
+	if correlationID := c.HeaderBytes(oni.HeaderCorrelationID); correlationID != nil && !hasHeader(headers, oni.HeaderCorrelationID) {
+		headers = append(headers, kafka.Header{Key: oni.HeaderCorrelationID, Value: correlationID})
+	}
+	m.Headers = headers
+	return m
+}
+
+func hasHeader(headers []kafka.Header, key string) bool {
+	for _, header := range headers {
+		if header.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Context) Ack() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.acked++
+	return nil
+}
+
+func (c *Context) Nack() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nacked++
+	return nil
+}
+
+// Nacked returns how many times Context.Nack called
+func (c *Context) Nacked() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nacked
+}
+
+func (c *Context) SeekTo(offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("invalid seek offset %d", offset)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seekOffset = offset
+	return nil
+}
+
+// SoughtOffset returns offset given to the last Context.SeekTo call, or -1 when not called
+func (c *Context) SoughtOffset() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.seekOffset
+}
+
+func (c *Context) PausePartition(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.paused = d
+}
+
+// PausedPartition returns duration given to the last Context.PausePartition call
+func (c *Context) PausedPartition() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.paused
+}
+
+func (c *Context) ValueBytes() []byte {
+	return c.message.Value
+}
+
+func (c *Context) ValueString() string {
+	return string(c.message.Value)
+}
+
+func (c *Context) KeyBytes() []byte {
+	return c.message.Key
+}
+
+func (c *Context) KeyString() string {
+	return string(c.message.Key)
+}
+
+func (c *Context) Topic() string {
+	return c.message.Topic
+}
+
+func (c *Context) Header(key string) string {
+	return string(c.HeaderBytes(key))
+}
+
+func (c *Context) HeaderBytes(key string) []byte {
+	for _, header := range c.message.Headers {
+		if header.Key == key {
+			return header.Value
+		}
+	}
+	return nil
+}
+
+func (c *Context) Headers() map[string][]string {
+	headers := make(map[string][]string, len(c.message.Headers))
+	for _, header := range c.message.Headers {
+		headers[header.Key] = append(headers[header.Key], string(header.Value))
+	}
+	return headers
+}
+
+func (c *Context) SetHeader(key string, value string) {
+	headers := make([]kafka.Header, 0, len(c.headers)+1)
+	for _, header := range c.headers {
+		if header.Key != key {
+			headers = append(headers, header)
+		}
+	}
+	c.headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c *Context) AddHeader(key string, value string) {
+	c.headers = append(c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c *Context) Message() kafka.Message {
+	return c.message
+}
+
+func (c *Context) Assignments() []oni.Assignment {
+	return c.assignments
+}
+
+func (c *Context) ReaderStats() kafka.ReaderStats {
+	return kafka.ReaderStats{Topic: c.readerConfig.Topic}
+}
+
+func (c *Context) ReaderConfig() kafka.ReaderConfig {
+	return c.readerConfig
+}
+
+func (c *Context) GetProducer(producerFuncName string) *kafka.Writer {
+	return c.writers[producerFuncName]
+}
+
+func (c *Context) OuterContext() context.Context {
+	return c.outerContext
+}
+
+func (c *Context) FindKey(key string) interface{} {
+	if val, ok := c.Get(key); ok {
+		return val
+	}
+	return c.outerContext.Value(key)
+}
+
+func (c *Context) CreateKeyVal(key string, val interface{}) {
+	c.Set(key, val)
+}
+
+func (c *Context) Set(key interface{}, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.keys[key] = value
+}
+
+func (c *Context) Get(key interface{}) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, ok := c.keys[key]
+	return value, ok
+}
+
+func (c *Context) MustGet(key interface{}) interface{} {
+	if value, ok := c.Get(key); ok {
+		return value
+	}
+	panic(fmt.Sprintf("key %v does not exist", key))
+}
@@ -0,0 +1,160 @@
+package onitest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"github.com/xoxoist/oni"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type TestContextSuite struct {
+	suite.Suite
+}
+
+func TestContextTestSuite(t *testing.T) {
+	suite.Run(t, new(TestContextSuite))
+}
+
+func (suite *TestContextSuite) TestNewContext() {
+	suite.Run("TestNewContext", func() {
+		type outerKey struct{}
+		outer := context.WithValue(context.Background(), outerKey{}, "outer")
+		w := &kafka.Writer{Topic: "bars"}
+		ctx := NewContext(kafka.Message{
+			Topic: "foos",
+			Key:   []byte("create.foo"),
+			Value: []byte("{\"content\":\"foo\"}"),
+			Headers: []kafka.Header{
+				{Key: "Content-Type", Value: []byte("application/json")},
+			},
+		}, WithContext(outer), WithReaderConfig(kafka.ReaderConfig{Topic: "foos"}), WithProducer("bars_producer", w),
+			WithAssignments(oni.Assignment{Topic: "foos", Partition: 1}))
+
+		suite.Assert().Equal(ctx.KeyString(), "create.foo")
+		suite.Assert().Equal(ctx.Topic(), "foos")
+		suite.Assert().Equal(ctx.ValueString(), "{\"content\":\"foo\"}")
+		suite.Assert().Equal(ctx.Header("Content-Type"), "application/json")
+		suite.Assert().Equal(ctx.Headers(), map[string][]string{"Content-Type": {"application/json"}})
+		suite.Assert().Equal(ctx.ReaderConfig().Topic, "foos")
+		suite.Assert().Equal(ctx.ReaderStats().Topic, "foos")
+		suite.Assert().Same(ctx.GetProducer("bars_producer"), w)
+		suite.Assert().Equal(ctx.Assignments(), []oni.Assignment{{Topic: "foos", Partition: 1}})
+		suite.Assert().Equal(ctx.OuterContext().Value(outerKey{}), "outer")
+
+		var content struct {
+			Content string `json:"content" validate:"required"`
+		}
+		suite.Assert().Nil(ctx.ShouldBindAndValidate(&content))
+		suite.Assert().Equal(content.Content, "foo")
+
+		ctx.Set("user", 1)
+		id, ok := oni.GetAs[int](ctx, "user")
+		suite.Assert().True(ok)
+		suite.Assert().Equal(id, 1)
+		suite.Assert().Nil(ctx.Ack())
+		suite.Assert().Equal(ctx.Acked(), 1)
+	})
+}
+
+func (suite *TestContextSuite) TestContextProduce() {
+	suite.Run("TestContextProduce", func() {
+		ctx := NewContext(kafka.Message{
+			Key:   []byte("create.foo"),
+			Value: []byte("foo"),
+			Headers: []kafka.Header{
+				{Key: oni.HeaderCorrelationID, Value: []byte("1234")},
+				{Key: oni.HeaderReplyTo, Value: []byte("replies")},
+			},
+		})
+		ctx.SetHeader("X-Source", "foos")
+
+		suite.Assert().Nil(ctx.SendJSON("bars_producer", "create.bar", map[string]int{"id": 1}))
+		suite.Assert().Nil(ctx.ShouldRetryWith("retries_producer"))
+		suite.Assert().Nil(ctx.ShouldErrorWith("failures_producer"))
+		suite.Assert().Nil(ctx.Reply("pong"))
+
+		bars := ctx.Produced("bars_producer")
+		suite.Assert().Len(bars, 1)
+		suite.Assert().Equal(string(bars[0].Value), "{\"id\":1}")
+		suite.Assert().Equal(bars[0].Headers, []kafka.Header{
+			{Key: "X-Source", Value: []byte("foos")},
+			{Key: oni.HeaderCorrelationID, Value: []byte("1234")},
+		})
+		suite.Assert().Equal(string(ctx.Produced("retries_producer")[0].Key), "retry.create.foo")
+		suite.Assert().Equal(string(ctx.Produced("failures_producer")[0].Value), "{\"origin_key\":\"create.foo\",\"value\":\"foo\"}")
+		suite.Assert().Equal(ctx.Replies()[0].Topic, "replies")
+		suite.Assert().Equal(string(ctx.Replies()[0].Value), "\"pong\"")
+
+		suite.Assert().True(errors.Is(NewContext(kafka.Message{}).Reply("pong"), oni.ErrNoReplyTo))
+	})
+}
+
+func (suite *TestContextSuite) TestContextOutbox() {
+	suite.Run("TestContextOutbox", func() {
+		db, err := sql.Open("sqlite3", ":memory:")
+		suite.Require().Nil(err)
+		defer db.Close()
+		db.SetMaxOpenConns(1)
+
+		outbox := oni.NewOutbox(db, "oni_outbox", oni.SQLiteDialect)
+		suite.Require().Nil(outbox.Migrate(context.Background()))
+		tx, err := db.Begin()
+		suite.Require().Nil(err)
+		defer tx.Rollback()
+
+		ctx := NewContext(kafka.Message{Key: []byte("create.foo")})
+		suite.Assert().ErrorIs(ctx.Outbox(tx).Send("bars_producer", "create.bar", nil), oni.ErrNoOutbox)
+
+		ctx = NewContext(kafka.Message{Key: []byte("create.foo")}, WithOutbox(outbox))
+		suite.Assert().Nil(ctx.Outbox(tx).Send("bars_producer", "create.bar", []byte("bar")))
+		suite.Assert().Len(ctx.Produced("bars_producer"), 0)
+
+		var rows int
+		suite.Assert().Nil(tx.QueryRow("SELECT COUNT(*) FROM oni_outbox").Scan(&rows))
+		suite.Assert().Equal(rows, 1)
+	})
+}
+
+func (suite *TestContextSuite) TestContextSendAfter() {
+	suite.Run("TestContextSendAfter", func() {
+		ctx := NewContext(kafka.Message{Key: []byte("create.foo")})
+		at := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+		suite.Assert().Nil(ctx.SendAt("retries_producer", at, "create.foo", nil, oni.DeliverAtHeader(time.Now())))
+		suite.Assert().Nil(ctx.SendAfter("retries_producer", time.Minute, "create.foo", nil))
+
+		produced := ctx.Produced("retries_producer")
+		suite.Assert().Len(produced, 2)
+		suite.Assert().Equal(produced[0].Headers, []kafka.Header{oni.DeliverAtHeader(at)})
+		deliverAt, ok := oni.DeliverAt(produced[1])
+		suite.Assert().True(ok)
+		suite.Assert().True(deliverAt.After(time.Now()))
+	})
+}
+
+func (suite *TestContextSuite) TestContextPausePartition() {
+	suite.Run("TestContextPausePartition", func() {
+		ctx := NewContext(kafka.Message{Key: []byte("create.foo")})
+		suite.Assert().Equal(ctx.PausedPartition(), time.Duration(0))
+		ctx.PausePartition(time.Minute)
+		suite.Assert().Equal(ctx.PausedPartition(), time.Minute)
+	})
+}
+
+func (suite *TestContextSuite) TestContextNackSeekTo() {
+	suite.Run("TestContextNackSeekTo", func() {
+		ctx := NewContext(kafka.Message{Key: []byte("create.foo")})
+		suite.Assert().Nil(ctx.Nack())
+		suite.Assert().Equal(ctx.Nacked(), 1)
+
+		suite.Assert().Equal(ctx.SoughtOffset(), int64(-1))
+		suite.Assert().NotNil(ctx.SeekTo(-2))
+		suite.Assert().Nil(ctx.SeekTo(5))
+		suite.Assert().Equal(ctx.SoughtOffset(), int64(5))
+	})
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package onitest
+
+import (
+	"bytes"
+	"context"
+	"github.com/segmentio/kafka-go"
+	"github.com/xoxoist/oni"
+	"sync"
+	"time"
+)
+
+// Harness replaces transport of configured consumer with in-memory
+// transport, published message runs through routing, handler chain
+// and error handler synchronously and every produced and committed
+// message is recorded for assertion
+type Harness struct {
+	consumer  *oni.Consumer
+	transport *oni.MemoryTransport
+	config    kafka.ReaderConfig
+	produced  map[string][]kafka.Message
+	committed []kafka.Message
+	lock      sync.Mutex
+}
+
+func NewHarness(consumer *oni.Consumer) *Harness {
+	h := &Harness{
+		consumer:  consumer,
+		transport: oni.NewMemoryTransport(),
+		produced:  make(map[string][]kafka.Message),
+	}
+	consumer.Transport(h)
+	return h
+}
+
+func (h *Harness) Reader(config kafka.ReaderConfig) oni.Reader {
+	h.config = config
+	return &harnessReader{Reader: h.transport.Reader(config), harness: h}
+}
+
+// OffsetsAt looks up offsets of in-memory transport so consumer can be seeked
+func (h *Harness) OffsetsAt(ctx context.Context, config kafka.ReaderConfig, topic string, at time.Time) (map[int]int64, error) {
+	return h.transport.OffsetsAt(ctx, config, topic, at)
+}
+
+func (h *Harness) Writer(name string, w *kafka.Writer) oni.Writer {
+	return &harnessWriter{Writer: h.transport.Writer(name, w), harness: h, name: name}
+}
+
+// Publish sends message with given key and value to consumer topic
+// and returns error of the handler which stopped the handler chain
+func (h *Harness) Publish(key string, value []byte, headers ...kafka.Header) error {
+	return h.PublishMessage(kafka.Message{Key: []byte(key), Value: value, Headers: headers})
+}
+
+// PublishMessage sends message to consumer topic and returns error
+// of the handler which stopped the handler chain
+func (h *Harness) PublishMessage(m kafka.Message) error {
+	ctx := context.Background()
+	if len(m.Topic) == 0 {
+		m.Topic = h.config.Topic
+		if len(h.config.GroupTopics) != 0 {
+			m.Topic = h.config.GroupTopics[0]
+		}
+	}
+	if err := h.transport.Writer("", &kafka.Writer{}).WriteMessages(ctx, m); err != nil {
+		return err
+	}
+	return h.consumer.Poll(ctx)
+}
+
+// Produced returns messages produced to producer with given name
+func (h *Harness) Produced(producerFuncName string) []kafka.Message {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]kafka.Message(nil), h.produced[producerFuncName]...)
+}
+
+// Committed returns messages committed by consumer
+func (h *Harness) Committed() []kafka.Message {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]kafka.Message(nil), h.committed...)
+}
+
+// Retried returns messages sent by Context.ShouldRetryWith
+func (h *Harness) Retried() []kafka.Message {
+	return h.producedWithPrefix("retry.")
+}
+
+// DeadLettered returns messages sent by Context.ShouldErrorWith
+func (h *Harness) DeadLettered() []kafka.Message {
+	return h.producedWithPrefix("failed.")
+}
+
+func (h *Harness) producedWithPrefix(prefix string) []kafka.Message {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var messages []kafka.Message
+	for _, produced := range h.produced {
+		for _, m := range produced {
+			if bytes.HasPrefix(m.Key, []byte(prefix)) {
+				messages = append(messages, m)
+			}
+		}
+	}
+	return messages
+}
+
+type harnessReader struct {
+	oni.Reader
+	harness *Harness
+}
+
+func (r *harnessReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	m, err := r.Reader.FetchMessage(ctx)
+	if err != nil {
+		return m, err
+	}
+	if len(r.Config().GroupID) != 0 {
+		if err := r.CommitMessages(ctx, m); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+func (r *harnessReader) SetOffset(offset int64) error {
+	if reader, ok := r.Reader.(oni.SeekableReader); ok {
+		return reader.SetOffset(offset)
+	}
+	return oni.ErrSeekUnsupported
+}
+
+func (r *harnessReader) SetOffsetAt(ctx context.Context, t time.Time) error {
+	if reader, ok := r.Reader.(oni.SeekableReader); ok {
+		return reader.SetOffsetAt(ctx, t)
+	}
+	return oni.ErrSeekUnsupported
+}
+
+func (r *harnessReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if err := r.Reader.CommitMessages(ctx, msgs...); err != nil {
+		return err
+	}
+
+	r.harness.lock.Lock()
+	defer r.harness.lock.Unlock()
+	r.harness.committed = append(r.harness.committed, msgs...)
+	return nil
+}
+
+type harnessWriter struct {
+	oni.Writer
+	harness *Harness
+	name    string
+}
+
+func (w *harnessWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if err := w.Writer.WriteMessages(ctx, msgs...); err != nil {
+		return err
+	}
+
+	w.harness.lock.Lock()
+	defer w.harness.lock.Unlock()
+	w.harness.produced[w.name] = append(w.harness.produced[w.name], msgs...)
+	return nil
+}
@@ -0,0 +1,105 @@
+package onitest
+
+import (
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"github.com/xoxoist/oni"
+	"testing"
+)
+
+type TestHarnessSuite struct {
+	suite.Suite
+}
+
+func TestHarnessTestSuite(t *testing.T) {
+	suite.Run(t, new(TestHarnessSuite))
+}
+
+type foo struct {
+	FooContent string `json:"foo_content" validate:"required"`
+}
+
+func newFoosConsumer() *oni.Consumer {
+	consumer := oni.NewConsumer(oni.NewStream(kafka.ReaderConfig{
+		Brokers: []string{"localhost:8097"},
+		Topic:   "foos",
+		GroupID: "consumer-group-foos",
+	}))
+	consumer.Producer("bars_producer", func() *kafka.Writer {
+		return oni.BasicWriter(kafka.TCP("localhost:8097"), "bars")
+	})
+	consumer.Producer("retries_producer", func() *kafka.Writer {
+		return oni.BasicWriter(kafka.TCP("localhost:8097"), "foos-retries")
+	})
+	consumer.Producer("failures_producer", func() *kafka.Writer {
+		return oni.BasicWriter(kafka.TCP("localhost:8097"), "foos-failures")
+	})
+	consumer.InvalidWith("failures_producer")
+	return consumer
+}
+
+func (suite *TestHarnessSuite) TestHarnessPublish() {
+	suite.Run("TestHarnessPublish", func() {
+		consumer := newFoosConsumer()
+		oni.Handle(consumer, "create.foo", func(ctx oni.Context, msg foo) error {
+			return ctx.SendJSON("bars_producer", "create.bar", msg)
+		})
+		h := NewHarness(consumer)
+
+		suite.Assert().Nil(h.Publish("create.foo", []byte("{\"foo_content\":\"foo\"}")))
+		bars := h.Produced("bars_producer")
+		suite.Assert().Len(bars, 1)
+		suite.Assert().Equal(string(bars[0].Key), "create.bar")
+		suite.Assert().Equal(string(bars[0].Value), "{\"foo_content\":\"foo\"}")
+		suite.Assert().Len(h.Committed(), 1)
+		suite.Assert().Equal(h.Committed()[0].Topic, "foos")
+	})
+}
+
+func (suite *TestHarnessSuite) TestHarnessRetryAndDeadLetter() {
+	suite.Run("TestHarnessRetryAndDeadLetter", func() {
+		consumer := newFoosConsumer()
+		var handled []error
+		consumer.ErrorHandler(func(err error) {
+			handled = append(handled, err)
+		})
+		oni.Handle(consumer, "create.foo", func(ctx oni.Context, msg foo) error {
+			if err := ctx.ShouldRetryWith("retries_producer"); err != nil {
+				return err
+			}
+			return errors.New("downstream unavailable")
+		})
+		h := NewHarness(consumer)
+
+		suite.Assert().EqualError(h.Publish("create.foo", []byte("{\"foo_content\":\"foo\"}")), "downstream unavailable")
+		suite.Assert().IsType(oni.ValidationErrors{}, h.Publish("create.foo", []byte("{}")))
+
+		suite.Assert().Len(h.Retried(), 1)
+		suite.Assert().Equal(string(h.Retried()[0].Key), "retry.create.foo")
+		suite.Assert().Len(h.DeadLettered(), 1)
+		suite.Assert().Equal(string(h.DeadLettered()[0].Key), "failed.create.foo")
+		suite.Assert().Len(handled, 2)
+		suite.Assert().Len(h.Committed(), 2)
+	})
+}
+
+func (suite *TestHarnessSuite) TestHarnessExplicit() {
+	suite.Run("TestHarnessExplicit", func() {
+		consumer := newFoosConsumer()
+		consumer.Explicit()
+		consumer.Handler("create.foo", func(ctx oni.Context) error {
+			return nil
+		})
+		consumer.Handler("update.foo", func(ctx oni.Context) error {
+			return ctx.Ack()
+		})
+		h := NewHarness(consumer)
+
+		suite.Assert().Nil(h.Publish("create.foo", nil))
+		suite.Assert().Len(h.Committed(), 0)
+		suite.Assert().Nil(h.Publish("update.foo", nil))
+		suite.Assert().Len(h.Committed(), 1)
+		suite.Assert().Equal(string(h.Committed()[0].Key), "update.foo")
+	})
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"sync"
+	"time"
+)
+
+const outboxBatch = 100
+
+var ErrNoOutbox = errors.New("outbox is not configured")
+
+// Outbox keeps messages inside SQL table using the same transaction as
+// handler business data, messages published later by OutboxRelay so they
+// are sent only when the transaction committed, table can be created by Migrate
+type Outbox struct {
+	db      *sql.DB
+	table   string
+	dialect SQLDialect
+}
+
+func NewOutbox(db *sql.DB, table string, dialect SQLDialect) *Outbox {
+	return &Outbox{db: db, table: table, dialect: dialect}
+}
+
+// Migrate creates outbox table when not exist
+func (o *Outbox) Migrate(ctx context.Context) error {
+	_, err := o.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (id %s, producer VARCHAR(255) NOT NULL, message_key %s, message_value %s, "+
+			"headers %s, created_at TIMESTAMP NOT NULL, sent_at TIMESTAMP NULL)",
+		o.table, o.dialect.Serial, o.dialect.Blob, o.dialect.Blob, o.dialect.Blob,
+	))
+	return err
+}
+
+// Tx returns outbox writing messages inside given transaction,
+// use Context.Outbox inside handler to keep outgoing headers
+func (o *Outbox) Tx(tx *sql.Tx) *OutboxTx {
+	return &OutboxTx{outbox: o, tx: tx, ctx: context.Background()}
+}
+
+// Relay creates relay publishing stored messages every interval
+// using producers registered to given consumer
+func (o *Outbox) Relay(consumer *Consumer, interval time.Duration) *OutboxRelay {
+	return &OutboxRelay{
+		outbox:   o,
+		consumer: consumer,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Purge deletes messages sent before given time
+func (o *Outbox) Purge(ctx context.Context, before time.Time) error {
+	_, err := o.db.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE sent_at IS NOT NULL AND sent_at < %s", o.table, o.dialect.Placeholder(1),
+	), before.UTC())
+	return err
+}
+
+type outboxMessage struct {
+	id       int64
+	producer string
+	message  kafka.Message
+}
+
+func (o *Outbox) pending(ctx context.Context, limit int) ([]outboxMessage, error) {
+	rows, err := o.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, producer, message_key, message_value, headers FROM %s WHERE sent_at IS NULL ORDER BY id LIMIT %d",
+		o.table, limit,
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []outboxMessage
+	for rows.Next() {
+		var om outboxMessage
+		var headers []byte
+		if err := rows.Scan(&om.id, &om.producer, &om.message.Key, &om.message.Value, &headers); err != nil {
+			return nil, err
+		}
+		if len(headers) != 0 {
+			if err := json.Unmarshal(headers, &om.message.Headers); err != nil {
+				return nil, err
+			}
+		}
+		messages = append(messages, om)
+	}
+	return messages, rows.Err()
+}
+
+func (o *Outbox) markSent(ctx context.Context, id int64) error {
+	_, err := o.db.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET sent_at = %s WHERE id = %s", o.table, o.dialect.Placeholder(1), o.dialect.Placeholder(2),
+	), time.Now().UTC(), id)
+	return err
+}
+
+// OutboxTx writes messages into outbox table inside caller transaction,
+// nothing is stored when the transaction rolled back
+type OutboxTx struct {
+	outbox    *Outbox
+	tx        *sql.Tx
+	ctx       context.Context
+	producers map[string]ProducerFunc
+	outgoing  func(m kafka.Message) kafka.Message
+}
+
+func (t *OutboxTx) Send(producerFuncName string, key string, value []byte, headers ...kafka.Header) error {
+	return t.store(producerFuncName, kafka.Message{
+		Key:     []byte(key),
+		Value:   value,
+		Headers: headers,
+	})
+}
+
+func (t *OutboxTx) SendJSON(producerFuncName string, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.Send(producerFuncName, key, value)
+}
+
+func (t *OutboxTx) store(producerFuncName string, m kafka.Message) error {
+	if t.outbox == nil {
+		return ErrNoOutbox
+	}
+	if t.producers != nil {
+		if _, ok := t.producers[producerFuncName]; !ok {
+			return fmt.Errorf("%w: %s", ErrProducerNotFound, producerFuncName)
+		}
+	}
+	if t.outgoing != nil {
+		m = t.outgoing(m)
+	}
+
+	var headers []byte
+	if len(m.Headers) != 0 {
+		var err error
+		if headers, err = json.Marshal(m.Headers); err != nil {
+			return err
+		}
+	}
+
+	placeholder := t.outbox.dialect.Placeholder
+	_, err := t.tx.ExecContext(t.ctx, fmt.Sprintf(
+		"INSERT INTO %s (producer, message_key, message_value, headers, created_at) VALUES (%s, %s, %s, %s, %s)",
+		t.outbox.table, placeholder(1), placeholder(2), placeholder(3), placeholder(4), placeholder(5),
+	), producerFuncName, m.Key, m.Value, headers, time.Now().UTC())
+	return err
+}
+
+// OutboxRelay publishes messages stored inside outbox in the order they
+// were stored and marks them sent, message which failed to be published
+// stops the relay until next interval so order is kept, message may be
+// published more than once when marking fails or multiple relays running
+type OutboxRelay struct {
+	outbox   *Outbox
+	consumer *Consumer
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	started  bool
+	lock     sync.Mutex
+}
+
+// Flush publishes pending messages once and returns number of sent messages
+func (r *OutboxRelay) Flush(ctx context.Context) (int, error) {
+	sent := 0
+	for {
+		messages, err := r.outbox.pending(ctx, outboxBatch)
+		if err != nil {
+			return sent, err
+		}
+
+		for _, om := range messages {
+			w, err := r.consumer.stream.pool.writer(om.producer)
+			if err != nil {
+				return sent, err
+			}
+			if err := w.WriteMessages(ctx, om.message); err != nil {
+				return sent, err
+			}
+			if err := r.outbox.markSent(ctx, om.id); err != nil {
+				return sent, err
+			}
+			sent++
+		}
+
+		if len(messages) < outboxBatch {
+			return sent, nil
+		}
+	}
+}
+
+func (r *OutboxRelay) run(ctx context.Context) {
+	r.lock.Lock()
+	select {
+	case <-r.stop:
+		r.lock.Unlock()
+		return
+	default:
+	}
+	if r.started {
+		r.lock.Unlock()
+		return
+	}
+	r.started = true
+	r.lock.Unlock()
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Flush(ctx); err != nil && r.consumer.callbackError != nil {
+			r.consumer.callbackError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// close stops the relay and waits until running flush finished
+func (r *OutboxRelay) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	select {
+	case <-r.stop:
+		return
+	default:
+		close(r.stop)
+	}
+	if r.started {
+		<-r.done
+	}
+}
@@ -0,0 +1,211 @@
+package oni
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type TestOutboxSuite struct {
+	suite.Suite
+}
+
+func TestOutboxTestSuite(t *testing.T) {
+	suite.Run(t, new(TestOutboxSuite))
+}
+
+func (suite *TestOutboxSuite) newOutbox() (*sql.DB, *Outbox) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	suite.Require().Nil(err)
+	db.SetMaxOpenConns(1)
+
+	outbox := NewOutbox(db, "oni_outbox", SQLiteDialect)
+	suite.Require().Nil(outbox.Migrate(context.Background()))
+	suite.Require().Nil(outbox.Migrate(context.Background()))
+	return db, outbox
+}
+
+func (suite *TestOutboxSuite) TestOutbox() {
+	suite.Run("TestOutbox", func() {
+		ctx := context.Background()
+		db, outbox := suite.newOutbox()
+		defer db.Close()
+
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		consumer.Producer("bars_producer", func() *kafka.Writer {
+			return &kafka.Writer{Topic: "bars"}
+		})
+		consumer.Outbox(outbox)
+		consumer.Handler("create.foo", func(ctx Context) error {
+			ctx.SetHeader("trace-id", "1234")
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			if err := ctx.Outbox(tx).Send("bars_producer", "create.bar", []byte("first")); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			if err := ctx.Outbox(tx).SendJSON("bars_producer", "update.bar", map[string]string{"id": "1"}); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			if ctx.Header("rollback") == "true" {
+				return tx.Rollback()
+			}
+			return tx.Commit()
+		})
+
+		w := transport.Writer("", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("create.foo"), Headers: []kafka.Header{
+				{Key: HeaderCorrelationID, Value: []byte("abcd")},
+			}},
+			kafka.Message{Key: []byte("create.foo"), Headers: []kafka.Header{
+				{Key: "rollback", Value: []byte("true")},
+			}},
+		))
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Nil(consumer.Poll(ctx))
+
+		// nothing published until relay flushed
+		suite.Assert().Len(transport.Messages("bars"), 0)
+
+		relay := outbox.Relay(consumer, time.Minute)
+		sent, err := relay.Flush(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(sent, 2)
+
+		messages := transport.Messages("bars")
+		suite.Assert().Len(messages, 2)
+		suite.Assert().Equal(string(messages[0].Key), "create.bar")
+		suite.Assert().Equal(string(messages[0].Value), "first")
+		suite.Assert().Equal(string(messages[1].Key), "update.bar")
+		suite.Assert().Equal(string(messages[1].Value), `{"id":"1"}`)
+		suite.Assert().Equal(messages[0].Headers, []kafka.Header{
+			{Key: "trace-id", Value: []byte("1234")},
+			{Key: HeaderCorrelationID, Value: []byte("abcd")},
+		})
+
+		// sent messages are not published twice
+		sent, err = relay.Flush(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(sent, 0)
+		suite.Assert().Len(transport.Messages("bars"), 2)
+
+		suite.Assert().Nil(outbox.Purge(ctx, time.Now().Add(time.Minute)))
+		var rows int
+		suite.Assert().Nil(db.QueryRow("SELECT COUNT(*) FROM oni_outbox").Scan(&rows))
+		suite.Assert().Equal(rows, 0)
+	})
+}
+
+func (suite *TestOutboxSuite) TestOutboxRelayOrder() {
+	suite.Run("TestOutboxRelayOrder", func() {
+		ctx := context.Background()
+		db, outbox := suite.newOutbox()
+		defer db.Close()
+
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		consumer.Producer("bars_producer", func() *kafka.Writer {
+			return &kafka.Writer{Topic: "bars"}
+		})
+
+		tx, err := db.Begin()
+		suite.Require().Nil(err)
+		suite.Assert().Nil(outbox.Tx(tx).Send("bars_producer", "1", nil))
+		suite.Assert().Nil(outbox.Tx(tx).Send("unknown_producer", "2", nil))
+		suite.Assert().Nil(outbox.Tx(tx).Send("bars_producer", "3", nil))
+		suite.Assert().Nil(tx.Commit())
+
+		// failed message stops relay so later messages keep waiting
+		relay := outbox.Relay(consumer, time.Minute)
+		sent, err := relay.Flush(ctx)
+		suite.Assert().ErrorIs(err, ErrProducerNotFound)
+		suite.Assert().Equal(sent, 1)
+		sent, err = relay.Flush(ctx)
+		suite.Assert().ErrorIs(err, ErrProducerNotFound)
+		suite.Assert().Equal(sent, 0)
+		suite.Assert().Len(transport.Messages("bars"), 1)
+
+		consumer.Producer("unknown_producer", func() *kafka.Writer {
+			return &kafka.Writer{Topic: "bars"}
+		})
+		sent, err = relay.Flush(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(sent, 2)
+
+		var keys []string
+		for _, m := range transport.Messages("bars") {
+			keys = append(keys, string(m.Key))
+		}
+		suite.Assert().Equal(keys, []string{"1", "2", "3"})
+	})
+}
+
+func (suite *TestOutboxSuite) TestOutboxRelayRun() {
+	suite.Run("TestOutboxRelayRun", func() {
+		ctx := context.Background()
+		db, outbox := suite.newOutbox()
+		defer db.Close()
+
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		consumer.Producer("bars_producer", func() *kafka.Writer {
+			return &kafka.Writer{Topic: "bars"}
+		})
+		errs := make(chan error, 1)
+		consumer.ErrorHandler(func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+
+		relay := outbox.Relay(consumer, 10*time.Millisecond)
+		go relay.run(ctx)
+
+		tx, err := db.Begin()
+		suite.Require().Nil(err)
+		suite.Assert().Nil(outbox.Tx(tx).Send("bars_producer", "1", nil))
+		suite.Assert().Nil(outbox.Tx(tx).Send("missing_producer", "2", nil))
+		suite.Assert().Nil(tx.Commit())
+
+		suite.Assert().ErrorIs(<-errs, ErrProducerNotFound)
+		relay.close()
+		relay.close()
+		suite.Assert().Len(transport.Messages("bars"), 1)
+	})
+}
+
+func (suite *TestOutboxSuite) TestOutboxTx() {
+	suite.Run("TestOutboxTx", func() {
+		db, outbox := suite.newOutbox()
+		defer db.Close()
+
+		tx, err := db.Begin()
+		suite.Require().Nil(err)
+		defer tx.Rollback()
+
+		// context of consumer without outbox
+		ctx := newContext(context.Background(), nil, kafka.Message{}, map[string]ProducerFunc{})
+		suite.Assert().ErrorIs(ctx.Outbox(tx).Send("bars_producer", "1", nil), ErrNoOutbox)
+
+		// producer must be registered to consumer
+		ctx.outbox = outbox
+		suite.Assert().ErrorIs(ctx.Outbox(tx).Send("bars_producer", "1", nil), ErrProducerNotFound)
+		suite.Assert().NotNil(ctx.Outbox(tx).SendJSON("bars_producer", "1", make(chan int)))
+
+		var nilOutbox *Outbox
+		suite.Assert().ErrorIs(nilOutbox.Tx(tx).Send("bars_producer", "1", nil), ErrNoOutbox)
+		suite.Assert().False(errors.Is(outbox.Tx(tx).Send("bars_producer", "1", nil), ErrNoOutbox))
+	})
+}
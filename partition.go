@@ -0,0 +1,146 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"sync"
+)
+
+const defaultPartitionQueue = 100
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// PartitionPausableReader implemented by reader which fetches every assigned
+// partition on its own, so fetching of one partition can be paused while the
+// others keep being fetched, message fetched before pause may still be returned
+type PartitionPausableReader interface {
+	Reader
+	PausePartition(topic string, partition int)
+	ResumePartition(topic string, partition int)
+}
+
+// partitionWorker queues fetched messages of one partition so they
+// are processed in order, waiting partition does not block the others,
+// once its queue is full fetching of the partition is paused by pause
+// until half of the queue handled, or fetching waits when reader cannot
+// pause single partition
+type partitionWorker struct {
+	queue    []kafka.Message
+	capacity int
+	signal   chan struct{}
+	space    chan struct{}
+	stop     chan struct{}
+	closed   bool
+	pause    func()
+	resume   func()
+	held     bool
+	lock     sync.Mutex
+}
+
+func newPartitionWorker(capacity int) *partitionWorker {
+	return &partitionWorker{
+		capacity: capacity,
+		signal:   make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+}
+
+// push queues message, blocks while queue is full until worker takes
+// next message, returns errStopped when closed and ctx error when done
+func (w *partitionWorker) push(ctx context.Context, m kafka.Message, closed <-chan struct{}) error {
+	for {
+		w.lock.Lock()
+		if len(w.queue) < w.capacity {
+			w.queue = append(w.queue, m)
+			w.lock.Unlock()
+			w.notify()
+			return nil
+		}
+		w.lock.Unlock()
+
+		select {
+		case <-w.space:
+		case <-closed:
+			return errStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// offer queues message without waiting and pauses fetching of its
+// partition once queue is full, used when reader can pause partitions
+func (w *partitionWorker) offer(m kafka.Message) {
+	w.lock.Lock()
+	w.queue = append(w.queue, m)
+	if !w.held && len(w.queue) >= w.capacity {
+		w.held = true
+		w.pause()
+	}
+	w.lock.Unlock()
+	w.notify()
+}
+
+// unhold resumes fetching of paused partition, caller must hold lock
+func (w *partitionWorker) unhold() {
+	if w.held {
+		w.held = false
+		w.resume()
+	}
+}
+
+// pop returns next queued message, blocks until message pushed
+// and returns false when worker closed and queue is empty
+func (w *partitionWorker) pop() (kafka.Message, bool) {
+	for {
+		w.lock.Lock()
+		if len(w.queue) != 0 {
+			m := w.queue[0]
+			w.queue = w.queue[1:]
+			if len(w.queue) <= w.capacity/2 {
+				w.unhold()
+			}
+			w.lock.Unlock()
+			select {
+			case w.space <- struct{}{}:
+			default:
+			}
+			return m, true
+		}
+		if w.closed {
+			w.lock.Unlock()
+			return kafka.Message{}, false
+		}
+		w.lock.Unlock()
+		<-w.signal
+	}
+}
+
+// close lets worker finish queued messages and stops waiting ones,
+// paused partition is resumed since stream stopped fetching
+func (w *partitionWorker) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	w.unhold()
+	w.closed = true
+	close(w.stop)
+	w.notify()
+}
+
+func (w *partitionWorker) notify() {
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
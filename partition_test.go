@@ -0,0 +1,83 @@
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type TestPartitionSuite struct {
+	suite.Suite
+}
+
+func TestPartitionTestSuite(t *testing.T) {
+	suite.Run(t, new(TestPartitionSuite))
+}
+
+func (suite *TestPartitionSuite) TestPartitionWorker() {
+	suite.Run("TestPartitionWorker", func() {
+		ctx := context.Background()
+		w := newPartitionWorker(2)
+		popped := make(chan kafka.Message)
+		go func() {
+			for {
+				m, ok := w.pop()
+				if !ok {
+					close(popped)
+					return
+				}
+				popped <- m
+			}
+		}()
+
+		suite.Assert().Nil(w.push(ctx, kafka.Message{Offset: 1}, nil))
+		suite.Assert().Equal((<-popped).Offset, int64(1))
+
+		// queued messages still returned after worker closed
+		suite.Assert().Nil(w.push(ctx, kafka.Message{Offset: 2}, nil))
+		suite.Assert().Nil(w.push(ctx, kafka.Message{Offset: 3}, nil))
+		w.close()
+		w.close()
+		suite.Assert().Equal((<-popped).Offset, int64(2))
+		suite.Assert().Equal((<-popped).Offset, int64(3))
+		_, ok := <-popped
+		suite.Assert().False(ok)
+
+		select {
+		case <-w.stop:
+		default:
+			suite.Fail("stop channel should be closed")
+		}
+	})
+}
+
+func (suite *TestPartitionSuite) TestPartitionWorkerFull() {
+	suite.Run("TestPartitionWorkerFull", func() {
+		w := newPartitionWorker(1)
+		suite.Assert().Nil(w.push(context.Background(), kafka.Message{Offset: 1}, nil))
+
+		// push waits until worker takes next message
+		pushed := make(chan error)
+		go func() {
+			pushed <- w.push(context.Background(), kafka.Message{Offset: 2}, nil)
+		}()
+		select {
+		case <-pushed:
+			suite.Fail("push should wait while queue is full")
+		case <-time.After(20 * time.Millisecond):
+		}
+		m, ok := w.pop()
+		suite.Assert().True(ok)
+		suite.Assert().Equal(m.Offset, int64(1))
+		suite.Assert().Nil(<-pushed)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		suite.Assert().ErrorIs(w.push(ctx, kafka.Message{Offset: 3}, nil), context.Canceled)
+		closed := make(chan struct{})
+		close(closed)
+		suite.Assert().ErrorIs(w.push(context.Background(), kafka.Message{Offset: 3}, closed), errStopped)
+	})
+}
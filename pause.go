@@ -0,0 +1,179 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errStopped = errors.New("stream stopped")
+
+// ConsumerState describes consumer stream state reported by Runner health handler
+type ConsumerState struct {
+	Topic      string           `json:"topic"`
+	Topics     []string         `json:"topics,omitempty"`
+	GroupID    string           `json:"group_id,omitempty"`
+	Paused     bool             `json:"paused"`
+	Partitions []PartitionState `json:"partitions,omitempty"`
+}
+
+// PartitionState describes partition paused by Context.PausePartition
+type PartitionState struct {
+	Topic       string    `json:"topic"`
+	Partition   int       `json:"partition"`
+	PausedUntil time.Time `json:"paused_until"`
+}
+
+// pauser keeps pause state of stream and its partitions, changed
+// channel closed and recreated every time the state changes, stream
+// stays paused while paused by Pause or held by any owner
+type pauser struct {
+	paused     bool
+	holders    map[interface{}]struct{}
+	partitions map[topicPartition]time.Time
+	changed    chan struct{}
+	closed     chan struct{}
+	closeOnce  sync.Once
+	lock       sync.Mutex
+}
+
+func newPauser() *pauser {
+	return &pauser{
+		holders:    make(map[interface{}]struct{}),
+		partitions: make(map[topicPartition]time.Time),
+		changed:    make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (p *pauser) pause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.paused = true
+	p.broadcast()
+}
+
+// resume resumes stream and every paused partition,
+// holds of owners are kept until released
+func (p *pauser) resume() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.paused = false
+	p.partitions = make(map[topicPartition]time.Time)
+	p.broadcast()
+}
+
+// hold pauses stream on behalf of owner until owner releases it
+func (p *pauser) hold(owner interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.holders[owner] = struct{}{}
+	p.broadcast()
+}
+
+// release removes hold of owner, stream stays paused while
+// paused by Pause or held by other owners
+func (p *pauser) release(owner interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.holders[owner]; !ok {
+		return
+	}
+	delete(p.holders, owner)
+	p.broadcast()
+}
+
+func (p *pauser) pausePartition(tp topicPartition, d time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	until := time.Now().Add(d)
+	if current, ok := p.partitions[tp]; !ok || current.Before(until) {
+		p.partitions[tp] = until
+	}
+	p.broadcast()
+}
+
+// close stops every wait of stream which consumers are closed
+func (p *pauser) close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+// broadcast caller must hold pauser lock
+func (p *pauser) broadcast() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// wait blocks while stream paused, or given partition paused when it is not
+// nil, returns errStopped when stop or pauser closed while waiting
+func (p *pauser) wait(ctx context.Context, tp *topicPartition, stop <-chan struct{}) error {
+	for {
+		p.lock.Lock()
+		paused := p.paused || len(p.holders) != 0
+		var until time.Time
+		if tp != nil {
+			until = p.partitions[*tp]
+			if !paused && !until.IsZero() && !time.Now().Before(until) {
+				delete(p.partitions, *tp)
+				until = time.Time{}
+			}
+		}
+		changed := p.changed
+		p.lock.Unlock()
+
+		if !paused && until.IsZero() {
+			return nil
+		}
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !paused {
+			timer = time.NewTimer(time.Until(until))
+			due = timer.C
+		}
+		var err error
+		select {
+		case <-changed:
+		case <-due:
+		case <-stop:
+			err = errStopped
+		case <-p.closed:
+			err = errStopped
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *pauser) state(s *ConsumerState) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s.Paused = p.paused || len(p.holders) != 0
+	now := time.Now()
+	for tp, until := range p.partitions {
+		if now.Before(until) {
+			s.Partitions = append(s.Partitions, PartitionState{Topic: tp.topic, Partition: tp.partition, PausedUntil: until})
+		}
+	}
+	sort.Slice(s.Partitions, func(i, j int) bool {
+		if s.Partitions[i].Topic != s.Partitions[j].Topic {
+			return s.Partitions[i].Topic < s.Partitions[j].Topic
+		}
+		return s.Partitions[i].Partition < s.Partitions[j].Partition
+	})
+}
@@ -0,0 +1,253 @@
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestPauseSuite struct {
+	suite.Suite
+}
+
+func TestPauseTestSuite(t *testing.T) {
+	suite.Run(t, new(TestPauseSuite))
+}
+
+func (suite *TestPauseSuite) TestPauser() {
+	suite.Run("TestPauser", func() {
+		ctx := context.Background()
+		p := newPauser()
+		tp := topicPartition{topic: "foos", partition: 1}
+		suite.Assert().Nil(p.wait(ctx, &tp, nil))
+
+		// paused partition released once due
+		p.pausePartition(tp, 20*time.Millisecond)
+		suite.Assert().Nil(p.wait(ctx, nil, nil))
+		start := time.Now()
+		suite.Assert().Nil(p.wait(ctx, &tp, nil))
+		suite.Assert().GreaterOrEqual(time.Since(start), 20*time.Millisecond)
+
+		// paused stream released by resume
+		p.pause()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			p.resume()
+		}()
+		suite.Assert().Nil(p.wait(ctx, nil, nil))
+
+		stop := make(chan struct{})
+		close(stop)
+		p.pause()
+		suite.Assert().ErrorIs(p.wait(ctx, nil, stop), errStopped)
+		timeout, cancel := context.WithTimeout(ctx, time.Millisecond)
+		defer cancel()
+		suite.Assert().ErrorIs(p.wait(timeout, nil, nil), context.DeadlineExceeded)
+		p.close()
+		p.close()
+		suite.Assert().ErrorIs(p.wait(ctx, nil, nil), errStopped)
+	})
+}
+
+func (suite *TestPauseSuite) TestConsumerPause() {
+	suite.Run("TestConsumerPause", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+
+		var lock sync.Mutex
+		handled := 0
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled++
+			return nil
+		})
+		count := func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return handled
+		}
+
+		consumer.Pause()
+		suite.Assert().True(consumer.Paused())
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create.foo")}))
+		time.Sleep(20 * time.Millisecond)
+		suite.Assert().Equal(count(), 0)
+		suite.Assert().Equal(consumer.State(), ConsumerState{Topic: "foos", GroupID: "consumer-group-foos", Paused: true})
+
+		consumer.Resume()
+		suite.Assert().False(consumer.Paused())
+		suite.Assert().Eventually(func() bool {
+			return count() == 1
+		}, time.Second, time.Millisecond)
+
+		// paused consumer stops when its reader closed
+		consumer.Pause()
+		suite.Assert().Nil(consumer.closeConsumers())
+		<-done
+		cancel()
+	})
+}
+
+func (suite *TestPauseSuite) TestPausePartition() {
+	suite.Run("TestPausePartition", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		transport.CreateTopic("foos", 2)
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+
+		var lock sync.Mutex
+		var handled []string
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.ValueString())
+			if ctx.ValueString() == "unavailable" {
+				ctx.PausePartition(100 * time.Millisecond)
+			}
+			return nil
+		})
+		handledValues := func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return append([]string(nil), handled...)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos", Balancer: kafka.BalancerFunc(
+			func(m kafka.Message, partitions ...int) int {
+				if string(m.Value) == "other" {
+					return 1
+				}
+				return 0
+			},
+		)})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("unavailable")},
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("after")},
+		))
+		suite.Assert().Eventually(func() bool {
+			return len(handledValues()) == 1
+		}, time.Second, time.Millisecond)
+
+		state := consumer.State()
+		suite.Assert().False(state.Paused)
+		suite.Assert().Len(state.Partitions, 1)
+		suite.Assert().Equal(state.Partitions[0].Topic, "foos")
+		suite.Assert().Equal(state.Partitions[0].Partition, 0)
+
+		// other partition keeps being consumed
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create.foo"), Value: []byte("other")}))
+		suite.Assert().Eventually(func() bool {
+			return len(handledValues()) == 2
+		}, 50*time.Millisecond, time.Millisecond)
+		suite.Assert().Equal(handledValues(), []string{"unavailable", "other"})
+
+		suite.Assert().Eventually(func() bool {
+			return len(handledValues()) == 3
+		}, time.Second, time.Millisecond)
+		suite.Assert().Equal(handledValues(), []string{"unavailable", "other", "after"})
+		suite.Assert().Len(consumer.State().Partitions, 0)
+		cancel()
+		<-done
+	})
+}
+
+func (suite *TestPauseSuite) TestResumePartition() {
+	suite.Run("TestResumePartition", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		consumer.Handler("create.foo", func(ctx Context) error {
+			ctx.PausePartition(time.Minute)
+			return nil
+		})
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create.foo")}, kafka.Message{Key: []byte("create.foo")}))
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Len(consumer.State().Partitions, 1)
+
+		// resume releases paused partitions as well
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			consumer.Resume()
+		}()
+		suite.Assert().Nil(consumer.Poll(ctx))
+	})
+}
+
+func (suite *TestPauseSuite) TestPausePartitionBounded() {
+	suite.Run("TestPausePartitionBounded", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.PartitionQueue(2)
+
+		var lock sync.Mutex
+		var handled int
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled++
+			if handled == 1 {
+				ctx.PausePartition(time.Hour)
+			}
+			return nil
+		})
+
+		messages := make([]kafka.Message, 10)
+		for i := range messages {
+			messages[i] = kafka.Message{Key: []byte("create.foo")}
+		}
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx, messages...))
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		// fetching of paused partition stops once its queue is full
+		suite.Assert().Eventually(func() bool {
+			return consumer.stream.reader.Stats().Messages == 4
+		}, time.Second, time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		suite.Assert().Equal(consumer.stream.reader.Stats().Messages, int64(4))
+
+		consumer.Resume()
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return handled == 10
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-done
+	})
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"sync"
+)
+
+const (
+	HeaderCorrelationID = "correlation-id"
+	HeaderReplyTo       = "reply-to"
+)
+
+var (
+	ErrProducerNotFound = errors.New("producer not found")
+	ErrNoReplyTo        = errors.New("message has no reply-to header")
+)
+
+// producerPool keeps one writer for each registered producer
+// created on first use and shared by every message of the stream
+// until the stream producers are closed, kafka writer returned by
+// producer function is kept so its settings can be inspected
+type producerPool struct {
+	transport Transport
+	producers map[string]ProducerFunc
+	writers   map[string]Writer
+	sources   map[string]*kafka.Writer
+	lock      sync.Mutex
+}
+
+func newProducerPool(producers map[string]ProducerFunc, transport Transport) *producerPool {
+	return &producerPool{
+		transport: transport,
+		producers: producers,
+		writers:   make(map[string]Writer),
+		sources:   make(map[string]*kafka.Writer),
+	}
+}
+
+func (p *producerPool) writer(name string) (Writer, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.open(name)
+}
+
+// source returns kafka writer which pooled writer of producer created
+// from, pooled writer created on first use like writer does
+func (p *producerPool) source(name string) (*kafka.Writer, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, err := p.open(name); err != nil {
+		return nil, err
+	}
+	return p.sources[name], nil
+}
+
+// open caller must hold pool lock
+func (p *producerPool) open(name string) (Writer, error) {
+	if w, ok := p.writers[name]; ok {
+		return w, nil
+	}
+	producerFunc, ok := p.producers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProducerNotFound, name)
+	}
+	source := producerFunc()
+	w := p.transport.Writer(name, source)
+	p.writers[name] = w
+	p.sources[name] = source
+	return w, nil
+}
+
+func (p *producerPool) close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	for name, w := range p.writers {
+		if closeErr := w.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(p.writers, name)
+		delete(p.sources, name)
+	}
+	return err
+}
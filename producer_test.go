@@ -0,0 +1,58 @@
+package oni
+
+import (
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type TestProducerSuite struct {
+	suite.Suite
+}
+
+func TestProducerTestSuite(t *testing.T) {
+	suite.Run(t, new(TestProducerSuite))
+}
+
+func (suite *TestProducerSuite) TestProducerPoolWriter() {
+	suite.Run("TestProducerPoolWriter", func() {
+		created := 0
+		pool := newProducerPool(map[string]ProducerFunc{
+			"producer_func_1": func() *kafka.Writer {
+				created++
+				return BasicWriter(kafka.TCP("localhost:8097"), "test-topic")
+			},
+		}, KafkaTransport())
+
+		w1, err := pool.writer("producer_func_1")
+		suite.Assert().Nil(err)
+		w2, err := pool.writer("producer_func_1")
+		suite.Assert().Nil(err)
+		suite.Assert().Same(w1, w2)
+		source, err := pool.source("producer_func_1")
+		suite.Assert().Nil(err)
+		suite.Assert().Same(source, w1)
+		suite.Assert().Equal(created, 1)
+
+		_, err = pool.writer("unknown")
+		suite.Assert().True(errors.Is(err, ErrProducerNotFound))
+	})
+}
+
+func (suite *TestProducerSuite) TestProducerPoolClose() {
+	suite.Run("TestProducerPoolClose", func() {
+		pool := newProducerPool(map[string]ProducerFunc{
+			"producer_func_1": func() *kafka.Writer {
+				return BasicWriter(kafka.TCP("localhost:8097"), "test-topic")
+			},
+		}, KafkaTransport())
+
+		_, err := pool.writer("producer_func_1")
+		suite.Assert().Nil(err)
+		suite.Assert().Len(pool.writers, 1)
+		suite.Assert().Nil(pool.close())
+		suite.Assert().Len(pool.writers, 0)
+		suite.Assert().Len(pool.sources, 0)
+	})
+}
@@ -0,0 +1,296 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultProvisionTimeout = 30 * time.Second
+
+var ErrProvisionUnsupported = errors.New("transport does not support creating topics")
+
+// AdminTransport implemented by transport which can create topics
+// using brokers of reader configuration
+type AdminTransport interface {
+	TopicTransport
+	ProvisionTopic(ctx context.Context, config kafka.ReaderConfig, topic string, spec TopicSpec) error
+}
+
+// TopicSpec partitions, replication factor and configuration entries of created
+// topic, zero partitions or replication factor uses default of kafka brokers
+type TopicSpec struct {
+	Partitions        int               `json:"partitions" yaml:"partitions"`
+	ReplicationFactor int               `json:"replication_factor" yaml:"replication_factor"`
+	Config            map[string]string `json:"config" yaml:"config"`
+}
+
+// Provisioning verifies every topic referenced by runner consumers, topics
+// read by streams and topics of their producers, before consumers started,
+// missing topics are created using Default spec or spec of their name in
+// Topics when Create is set, transport must implement TopicTransport and
+// AdminTransport to create topics
+type Provisioning struct {
+	Create  bool                 `json:"create" yaml:"create"`
+	Default TopicSpec            `json:"default" yaml:"default"`
+	Topics  map[string]TopicSpec `json:"topics" yaml:"topics"`
+}
+
+func (p *Provisioning) spec(topic string) TopicSpec {
+	if spec, ok := p.Topics[topic]; ok {
+		return spec
+	}
+	return p.Default
+}
+
+// ProvisionError reports every missing topic with consumers and producers
+// referencing it, and every topic which could not be created
+type ProvisionError struct {
+	Missing map[string][]string
+	Failed  map[string]error
+}
+
+func (e *ProvisionError) Error() string {
+	var lines []string
+	for _, topic := range sortedKeys(e.Missing) {
+		lines = append(lines, fmt.Sprintf("topic %s does not exist, referenced by %s", topic, strings.Join(e.Missing[topic], ", ")))
+	}
+	for _, topic := range sortedKeys(e.Failed) {
+		lines = append(lines, fmt.Sprintf("topic %s could not be created: %s", topic, e.Failed[topic]))
+	}
+	return "topic provisioning failed: " + strings.Join(lines, "; ")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ProducerAdminTransport implemented by transport which lists and creates
+// topics using address and transport of producer writer, so producer writing
+// into other cluster than its stream reader is verified against that cluster
+type ProducerAdminTransport interface {
+	ProducerTopics(ctx context.Context, w *kafka.Writer) ([]string, error)
+	ProvisionProducerTopic(ctx context.Context, w *kafka.Writer, topic string, spec TopicSpec) error
+}
+
+// Provision verifies or creates topics referenced by runner consumers using
+// its Provisioning, called by Start before consumers started when Provisioning
+// is set, topics of producers are verified using their writer when transport
+// implements ProducerAdminTransport, writers are created through producer pool
+// of the stream and reused once consumers started, topics of stream subscribed
+// by TopicPatternOpt are neither verified nor created since pattern matches
+// existing topics only, pattern which matches no topic is not reported, returns
+// ProvisionError listing every topic which is still missing
+func (r *Runner) Provision() error {
+	p := r.Provisioning
+	if p == nil {
+		p = &Provisioning{}
+	}
+	ctx, cancel := context.WithTimeout(r.Context, defaultProvisionTimeout)
+	defer cancel()
+
+	report := &ProvisionError{Missing: make(map[string][]string), Failed: make(map[string]error)}
+	for i, consumer := range r.Consumers {
+		name := fmt.Sprintf("consumer %d", i)
+		s := consumer.stream
+		config := s.reader.Config()
+		references := s.readerReferences(name)
+		writers, err := s.producerWriters()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		pt, byWriter := s.transport.(ProducerAdminTransport)
+		if !byWriter {
+			// producers of transport without writer clusters share reader cluster
+			for _, producer := range sortedKeys(writers) {
+				topic := writers[producer].Topic
+				references[topic] = append(references[topic], fmt.Sprintf("%s producer %s", name, producer))
+			}
+		}
+		if len(references) != 0 {
+			t, ok := s.transport.(TopicTransport)
+			if !ok {
+				return fmt.Errorf("%s: %w", name, ErrTopicsUnsupported)
+			}
+			var create func(topic string) error
+			if admin, ok := t.(AdminTransport); ok {
+				create = func(topic string) error {
+					return admin.ProvisionTopic(ctx, config, topic, p.spec(topic))
+				}
+			}
+			if err := p.check(report, references, func() ([]string, error) {
+				return t.Topics(ctx, config)
+			}, create); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if !byWriter {
+			continue
+		}
+		for _, producer := range sortedKeys(writers) {
+			w := writers[producer]
+			references := map[string][]string{w.Topic: {fmt.Sprintf("%s producer %s", name, producer)}}
+			if err := p.check(report, references, func() ([]string, error) {
+				return pt.ProducerTopics(ctx, w)
+			}, func(topic string) error {
+				return pt.ProvisionProducerTopic(ctx, w, topic, p.spec(topic))
+			}); err != nil {
+				return fmt.Errorf("%s producer %s: %w", name, producer, err)
+			}
+		}
+	}
+	if len(report.Missing) != 0 || len(report.Failed) != 0 {
+		return report
+	}
+	return nil
+}
+
+// check lists existing topics of one cluster then reports or creates every
+// referenced topic which is missing, nil create cannot create topics
+func (p *Provisioning) check(report *ProvisionError, references map[string][]string, list func() ([]string, error), create func(topic string) error) error {
+	topics, err := list()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		existing[topic] = true
+	}
+
+	for _, topic := range sortedKeys(references) {
+		if existing[topic] {
+			continue
+		}
+		if !p.Create {
+			report.Missing[topic] = append(report.Missing[topic], references[topic]...)
+			continue
+		}
+		if create == nil {
+			report.Failed[topic] = ErrProvisionUnsupported
+			continue
+		}
+		if err := create(topic); err != nil {
+			report.Failed[topic] = err
+		}
+	}
+	return nil
+}
+
+// readerReferences returns topics read by stream, topics matched by
+// pattern are not included
+func (s *Stream) readerReferences(name string) map[string][]string {
+	references := make(map[string][]string)
+	config := s.reader.Config()
+	if len(config.Topic) != 0 {
+		references[config.Topic] = append(references[config.Topic], name+" reader")
+	}
+	for _, topic := range config.GroupTopics {
+		references[topic] = append(references[topic], name+" reader")
+	}
+	return references
+}
+
+// producerWriters returns kafka writer of every stream producer with topic,
+// taken from producer pool so each producer function called once and its
+// writer reused by stream then closed together with stream producers
+func (s *Stream) producerWriters() (map[string]*kafka.Writer, error) {
+	writers := make(map[string]*kafka.Writer)
+	for producer := range s.producers {
+		w, err := s.pool.source(producer)
+		if err != nil {
+			return nil, err
+		}
+		if w != nil && len(w.Topic) != 0 {
+			writers[producer] = w
+		}
+	}
+	return writers, nil
+}
+
+// ProvisionTopic creates topic using brokers of reader configuration, topic
+// created meanwhile by other client is not an error
+func (kafkaTransport) ProvisionTopic(ctx context.Context, config kafka.ReaderConfig, topic string, spec TopicSpec) error {
+	return createTopic(ctx, kafkaClient(config), topic, spec)
+}
+
+// ProducerTopics lists every topic except kafka internal topics using
+// address and transport of producer writer
+func (kafkaTransport) ProducerTopics(ctx context.Context, w *kafka.Writer) ([]string, error) {
+	return clientTopics(ctx, writerClient(w))
+}
+
+// ProvisionProducerTopic creates topic using address and transport of producer writer
+func (kafkaTransport) ProvisionProducerTopic(ctx context.Context, w *kafka.Writer, topic string, spec TopicSpec) error {
+	return createTopic(ctx, writerClient(w), topic, spec)
+}
+
+// writerClient connects to cluster of writer the same way the writer does
+func writerClient(w *kafka.Writer) *kafka.Client {
+	return &kafka.Client{Addr: w.Addr, Transport: w.Transport}
+}
+
+func createTopic(ctx context.Context, client *kafka.Client, topic string, spec TopicSpec) error {
+	topicConfig := kafka.TopicConfig{
+		Topic:             topic,
+		NumPartitions:     spec.Partitions,
+		ReplicationFactor: spec.ReplicationFactor,
+	}
+	if topicConfig.NumPartitions <= 0 {
+		topicConfig.NumPartitions = -1
+	}
+	if topicConfig.ReplicationFactor <= 0 {
+		topicConfig.ReplicationFactor = -1
+	}
+	for _, name := range sortedKeys(spec.Config) {
+		topicConfig.ConfigEntries = append(topicConfig.ConfigEntries, kafka.ConfigEntry{
+			ConfigName:  name,
+			ConfigValue: spec.Config[name],
+		})
+	}
+
+	res, err := client.CreateTopics(ctx, &kafka.CreateTopicsRequest{
+		Topics: []kafka.TopicConfig{topicConfig},
+	})
+	if err != nil {
+		return err
+	}
+	if err := res.Errors[topic]; err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+// ProvisionTopic creates topic with given partitions in memory transport,
+// at least one partition, replication factor and configuration are ignored
+func (t *MemoryTransport) ProvisionTopic(ctx context.Context, config kafka.ReaderConfig, topic string, spec TopicSpec) error {
+	partitions := spec.Partitions
+	if partitions <= 0 {
+		partitions = 1
+	}
+	t.CreateTopic(topic, partitions)
+	return nil
+}
+
+// ProducerTopics lists every topic of memory transport, producers of memory
+// transport write into the same cluster its readers read
+func (t *MemoryTransport) ProducerTopics(ctx context.Context, w *kafka.Writer) ([]string, error) {
+	return t.Topics(ctx, kafka.ReaderConfig{})
+}
+
+// ProvisionProducerTopic creates topic in memory transport like ProvisionTopic
+func (t *MemoryTransport) ProvisionProducerTopic(ctx context.Context, w *kafka.Writer, topic string, spec TopicSpec) error {
+	return t.ProvisionTopic(ctx, kafka.ReaderConfig{}, topic, spec)
+}
@@ -0,0 +1,163 @@
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type TestProvisionSuite struct {
+	suite.Suite
+}
+
+func TestProvisionTestSuite(t *testing.T) {
+	suite.Run(t, new(TestProvisionSuite))
+}
+
+func (suite *TestProvisionSuite) runner(transport Transport) *Runner {
+	consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+		Topic:   "foos",
+		GroupID: "consumer-group-foos",
+	}, TransportOpt(transport)))
+	consumer.Producer("bars", func() *kafka.Writer {
+		return &kafka.Writer{Topic: "bars"}
+	})
+	tiers := RetryTopology("foos", []time.Duration{5 * time.Second}, "foos-dlq").Bind(consumer)
+	runner := &Runner{Context: context.Background(), Consumers: append([]*Consumer{consumer}, tiers...)}
+	suite.T().Cleanup(func() {
+		closeConsumers(runner.Consumers)
+		for _, consumer := range runner.Consumers {
+			_ = consumer.closeProducers()
+		}
+	})
+	return runner
+}
+
+func (suite *TestProvisionSuite) TestProvision() {
+	suite.Run("TestProvision", func() {
+		transport := NewMemoryTransport()
+		transport.CreateTopic("bars", 1)
+		runner := suite.runner(transport)
+
+		// every missing topic reported with its references
+		err := runner.Provision()
+		suite.Assert().Equal(err, &ProvisionError{
+			Missing: map[string][]string{"foos-dlq": {"consumer 0 producer foos-dlq"}},
+			Failed:  map[string]error{},
+		})
+		suite.Assert().EqualError(err, "topic provisioning failed: topic foos-dlq does not exist, referenced by consumer 0 producer foos-dlq")
+
+		// runner not started and report returned to caller
+		runner.Provisioning = &Provisioning{}
+		var report *ProvisionError
+		err = runner.Start()
+		suite.Assert().ErrorAs(err, &report)
+		suite.Assert().EqualError(err, "runner not started: topic provisioning failed: topic foos-dlq does not exist, referenced by consumer 0 producer foos-dlq")
+
+		runner.Provisioning = &Provisioning{
+			Create: true,
+			Topics: map[string]TopicSpec{"foos-dlq": {Partitions: 3}},
+		}
+		suite.Assert().Nil(runner.Provision())
+		topics, err := transport.Topics(context.Background(), kafka.ReaderConfig{})
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(topics, []string{"bars", "foos", "foos-dlq", "foos-retry-5s"})
+		suite.Assert().Len(transport.topics["foos-dlq"], 3)
+	})
+}
+
+// clusterTransport serves producers from other memory cluster than readers
+type clusterTransport struct {
+	*MemoryTransport
+	producers *MemoryTransport
+}
+
+func (t clusterTransport) ProducerTopics(ctx context.Context, w *kafka.Writer) ([]string, error) {
+	return t.producers.ProducerTopics(ctx, w)
+}
+
+func (t clusterTransport) ProvisionProducerTopic(ctx context.Context, w *kafka.Writer, topic string, spec TopicSpec) error {
+	return t.producers.ProvisionProducerTopic(ctx, w, topic, spec)
+}
+
+func (suite *TestProvisionSuite) TestProvisionProducerCluster() {
+	suite.Run("TestProvisionProducerCluster", func() {
+		transport := clusterTransport{MemoryTransport: NewMemoryTransport(), producers: NewMemoryTransport()}
+		transport.CreateTopic("bars", 1)
+		transport.producers.CreateTopic("foos", 1)
+		runner := suite.runner(transport)
+
+		// producer topics verified in cluster of their writer
+		err := runner.Provision()
+		suite.Assert().Equal(err, &ProvisionError{
+			Missing: map[string][]string{
+				"bars":          {"consumer 0 producer bars"},
+				"foos-dlq":      {"consumer 0 producer foos-dlq"},
+				"foos-retry-5s": {"consumer 0 producer foos-retry-5s"},
+			},
+			Failed: map[string]error{},
+		})
+
+		runner.Provisioning = &Provisioning{Create: true}
+		suite.Assert().Nil(runner.Provision())
+		topics, err := transport.producers.Topics(context.Background(), kafka.ReaderConfig{})
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(topics, []string{"bars", "foos", "foos-dlq", "foos-retry-5s"})
+		topics, err = transport.Topics(context.Background(), kafka.ReaderConfig{})
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(topics, []string{"bars", "foos", "foos-retry-5s"})
+	})
+}
+
+func (suite *TestProvisionSuite) TestProvisionProducerPool() {
+	suite.Run("TestProvisionProducerPool", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		transport.CreateTopic("foos", 1)
+		transport.CreateTopic("bars", 1)
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		created := 0
+		consumer.Producer("bars", func() *kafka.Writer {
+			created++
+			return &kafka.Writer{Topic: "bars"}
+		})
+		runner := &Runner{Context: ctx, Consumers: []*Consumer{consumer}}
+
+		// writer inspected by provisioning is the one used by stream
+		suite.Assert().Nil(runner.Provision())
+		suite.Assert().Nil(runner.Provision())
+		suite.Assert().Equal(created, 1)
+		w, err := consumer.stream.pool.writer("bars")
+		suite.Assert().Nil(err)
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create.bar")}))
+		suite.Assert().Equal(created, 1)
+		suite.Assert().Len(transport.Messages("bars"), 1)
+
+		suite.Assert().Nil(consumer.closeConsumers())
+		suite.Assert().Nil(consumer.closeProducers())
+		suite.Assert().Len(consumer.stream.pool.writers, 0)
+	})
+}
+
+func (suite *TestProvisionSuite) TestProvisionUnsupported() {
+	suite.Run("TestProvisionUnsupported", func() {
+		runner := suite.runner(struct{ Transport }{NewMemoryTransport()})
+		suite.Assert().ErrorIs(runner.Provision(), ErrTopicsUnsupported)
+
+		runner = suite.runner(struct{ TopicTransport }{NewMemoryTransport()})
+		runner.Provisioning = &Provisioning{Create: true}
+		err := runner.Provision()
+		suite.Assert().Equal(err, &ProvisionError{
+			Missing: map[string][]string{},
+			Failed: map[string]error{
+				"bars":     ErrProvisionUnsupported,
+				"foos-dlq": ErrProvisionUnsupported,
+			},
+		})
+	})
+}
@@ -0,0 +1,463 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const groupReaderBackoff = time.Second
+
+var ErrRebalanceUnsupported = errors.New("transport does not support partition assignment hooks")
+
+// Assignment partition of topic assigned to stream reader by its consumer group
+type Assignment struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+}
+
+// RebalanceFunc invoked with partitions assigned to or revoked from stream reader
+type RebalanceFunc func(partitions []Assignment)
+
+// RebalanceReader implemented by reader of consumer group which reports
+// partitions currently assigned to it
+type RebalanceReader interface {
+	Reader
+	Assignments() []Assignment
+}
+
+// RebalanceTransport implemented by transport which creates reader of consumer
+// group invoking assigned with partitions of every new assignment and revoked
+// before partitions are given up, group waits for revoked to return before
+// its partitions assigned to other members
+type RebalanceTransport interface {
+	Transport
+	RebalanceReader(config kafka.ReaderConfig, assigned RebalanceFunc, revoked RebalanceFunc) RebalanceReader
+}
+
+// revocation of partitions finished by stream once in-flight
+// messages handled and their offsets committed
+type revocation struct {
+	partitions []Assignment
+	once       sync.Once
+	done       chan struct{}
+}
+
+func (r *revocation) finish(revoked RebalanceFunc) {
+	r.once.Do(func() {
+		if revoked != nil {
+			revoked(r.partitions)
+		}
+		close(r.done)
+	})
+}
+
+// rebalancing reports whether partition assignment hooks registered
+func (s *Stream) rebalancing() bool {
+	return s.onAssigned != nil || s.onRevoked != nil
+}
+
+// useRebalance recreates reader of consumer group listening to its
+// partition assignment once hooks registered
+func (s *Stream) useRebalance() {
+	if s.listening {
+		return
+	}
+	config := s.reader.Config()
+	if _, ok := s.transport.(RebalanceTransport); !ok || len(config.GroupID) == 0 {
+		return
+	}
+	_ = s.reader.Close()
+	s.reader = s.newReader(config)
+}
+
+// rebalanceReader creates reader listening to partition assignment
+// of its consumer group when hooks registered
+func (s *Stream) rebalanceReader(config kafka.ReaderConfig) (Reader, bool) {
+	t, ok := s.transport.(RebalanceTransport)
+	if !ok || !s.rebalancing() || len(config.GroupID) == 0 {
+		return nil, false
+	}
+	s.listening = true
+	return t.RebalanceReader(config, s.assign, s.revoke), true
+}
+
+func (s *Stream) assign(partitions []Assignment) {
+	if s.onAssigned != nil {
+		s.onAssigned(partitions)
+	}
+}
+
+// revoke waits until running stream handled messages fetched before and
+// committed their offsets, stream which is not running commits offsets
+// acknowledged so far, then invokes revoked hook
+func (s *Stream) revoke(partitions []Assignment) {
+	r := &revocation{partitions: partitions, done: make(chan struct{})}
+	s.sLock.Lock()
+	streaming := s.streaming
+	s.sLock.Unlock()
+
+	if streaming != nil {
+		s.requestSeek(seek{revocation: r})
+		select {
+		case <-r.done:
+			return
+		case <-streaming:
+		case <-s.pauser.closed:
+		}
+	} else if err := s.flushOffsets(); err != nil {
+		s.callbackError(err)
+	}
+	r.finish(s.onRevoked)
+}
+
+// assignments returns partitions assigned to stream reader, or nil
+// when reader does not report its assignment
+func assignments(reader Reader) []Assignment {
+	if r, ok := reader.(RebalanceReader); ok {
+		return r.Assignments()
+	}
+	return nil
+}
+
+func sortAssignments(assignments []Assignment) {
+	sort.Slice(assignments, func(i, j int) bool {
+		if assignments[i].Topic != assignments[j].Topic {
+			return assignments[i].Topic < assignments[j].Topic
+		}
+		return assignments[i].Partition < assignments[j].Partition
+	})
+}
+
+// RebalanceReader creates reader of consumer group which reads every assigned
+// partition using its own reader, hooks invoked on every generation of the group
+func (kafkaTransport) RebalanceReader(config kafka.ReaderConfig, assigned RebalanceFunc, revoked RebalanceFunc) RebalanceReader {
+	return newGroupReader(config, assigned, revoked)
+}
+
+// groupReader reads partitions assigned to generation of kafka consumer
+// group, generation ends once revoked hook returned so group rejoined
+// only after stream committed offsets of revoked partitions, offsets
+// committed every CommitInterval of reader configuration when it is set
+// and before generation ends, otherwise synchronously
+type groupReader struct {
+	config      kafka.ReaderConfig
+	group       *kafka.ConsumerGroup
+	err         error
+	assigned    RebalanceFunc
+	revoked     RebalanceFunc
+	messages    chan kafka.Message
+	generation  *kafka.Generation
+	assignments []Assignment
+	pending     map[string]map[int]int64
+	paused      map[topicPartition]chan struct{}
+	fetched     int64
+	lock        sync.Mutex
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newGroupReader(config kafka.ReaderConfig, assigned RebalanceFunc, revoked RebalanceFunc) *groupReader {
+	r := &groupReader{
+		config:   config,
+		assigned: assigned,
+		revoked:  revoked,
+		messages: make(chan kafka.Message),
+		closed:   make(chan struct{}),
+	}
+	topics := config.GroupTopics
+	if len(topics) == 0 {
+		topics = []string{config.Topic}
+	}
+	r.group, r.err = kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:                     config.GroupID,
+		Brokers:                config.Brokers,
+		Dialer:                 config.Dialer,
+		Topics:                 topics,
+		GroupBalancers:         config.GroupBalancers,
+		HeartbeatInterval:      config.HeartbeatInterval,
+		PartitionWatchInterval: config.PartitionWatchInterval,
+		WatchPartitionChanges:  config.WatchPartitionChanges,
+		SessionTimeout:         config.SessionTimeout,
+		RebalanceTimeout:       config.RebalanceTimeout,
+		JoinGroupBackoff:       config.JoinGroupBackoff,
+		RetentionTime:          config.RetentionTime,
+		StartOffset:            config.StartOffset,
+		Logger:                 config.Logger,
+		ErrorLogger:            config.ErrorLogger,
+	})
+	if r.err == nil {
+		go r.run()
+	}
+	return r
+}
+
+func (r *groupReader) run() {
+	for {
+		gen, err := r.group.Next(context.Background())
+		if errors.Is(err, kafka.ErrGroupClosed) {
+			return
+		}
+		if err == nil {
+			r.start(gen)
+		}
+	}
+}
+
+// start reads every partition of generation until it ends, then waits
+// for partition readers to stop before invoking revoked hook
+func (r *groupReader) start(gen *kafka.Generation) {
+	var partitions []Assignment
+	for topic, assigned := range gen.Assignments {
+		for _, p := range assigned {
+			partitions = append(partitions, Assignment{Topic: topic, Partition: p.ID})
+		}
+	}
+	sortAssignments(partitions)
+
+	r.lock.Lock()
+	r.generation = gen
+	r.assignments = partitions
+	r.lock.Unlock()
+	if r.assigned != nil {
+		r.assigned(partitions)
+	}
+
+	var wg sync.WaitGroup
+	for topic, assigned := range gen.Assignments {
+		for _, p := range assigned {
+			topic, p := topic, p
+			wg.Add(1)
+			gen.Start(func(ctx context.Context) {
+				defer wg.Done()
+				r.read(ctx, topic, p)
+			})
+		}
+	}
+	gen.Start(func(ctx context.Context) {
+		var tick <-chan time.Time
+		if r.config.CommitInterval > 0 {
+			ticker := time.NewTicker(r.config.CommitInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for done := false; !done; {
+			select {
+			case <-tick:
+				r.flush(gen)
+			case <-ctx.Done():
+				done = true
+			}
+		}
+		wg.Wait()
+		if r.revoked != nil {
+			r.revoked(partitions)
+		}
+		r.flush(gen)
+		r.lock.Lock()
+		r.assignments = nil
+		r.lock.Unlock()
+	})
+}
+
+// flush commits offsets collected since last commit interval through
+// given generation, offsets which commit failed are committed again later
+func (r *groupReader) flush(gen *kafka.Generation) {
+	r.lock.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if err := gen.CommitOffsets(pending); err != nil {
+		r.lock.Lock()
+		r.merge(pending)
+		r.lock.Unlock()
+	}
+}
+
+// merge keeps highest offset of every partition, caller must hold lock
+func (r *groupReader) merge(offsets map[string]map[int]int64) {
+	if r.pending == nil {
+		r.pending = make(map[string]map[int]int64)
+	}
+	for topic, partitions := range offsets {
+		if _, ok := r.pending[topic]; !ok {
+			r.pending[topic] = make(map[int]int64)
+		}
+		for partition, offset := range partitions {
+			if offset > r.pending[topic][partition] {
+				r.pending[topic][partition] = offset
+			}
+		}
+	}
+}
+
+// read hands messages of partition to FetchMessage until generation ends,
+// partition reader uses every setting of reader configuration except its
+// consumer group which is managed by groupReader
+func (r *groupReader) read(ctx context.Context, topic string, assigned kafka.PartitionAssignment) {
+	reader := kafka.NewReader(r.partitionConfig(topic, assigned.ID))
+	defer reader.Close()
+	if err := reader.SetOffset(assigned.Offset); err != nil {
+		return
+	}
+
+	tp := topicPartition{topic: topic, partition: assigned.ID}
+	for {
+		if resumed := r.resumed(tp); resumed != nil {
+			select {
+			case <-resumed:
+			case <-ctx.Done():
+				return
+			}
+		}
+		m, err := reader.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(groupReaderBackoff):
+			}
+			continue
+		}
+		select {
+		case r.messages <- m:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resumed returns channel closed once paused partition resumed,
+// or nil when partition is not paused
+func (r *groupReader) resumed(tp topicPartition) <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.paused[tp]
+}
+
+// PausePartition stops reader of partition fetching until resumed
+func (r *groupReader) PausePartition(topic string, partition int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.paused == nil {
+		r.paused = make(map[topicPartition]chan struct{})
+	}
+	tp := topicPartition{topic: topic, partition: partition}
+	if _, ok := r.paused[tp]; !ok {
+		r.paused[tp] = make(chan struct{})
+	}
+}
+
+// ResumePartition lets reader of paused partition fetch again
+func (r *groupReader) ResumePartition(topic string, partition int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	tp := topicPartition{topic: topic, partition: partition}
+	if resumed, ok := r.paused[tp]; ok {
+		close(resumed)
+		delete(r.paused, tp)
+	}
+}
+
+func (r *groupReader) partitionConfig(topic string, partition int) kafka.ReaderConfig {
+	config := r.config
+	config.GroupID = ""
+	config.GroupTopics = nil
+	config.Topic = topic
+	config.Partition = partition
+	return config
+}
+
+func (r *groupReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	m, err := r.FetchMessage(ctx)
+	if err != nil {
+		return m, err
+	}
+	return m, r.CommitMessages(ctx, m)
+}
+
+func (r *groupReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if r.err != nil {
+		return kafka.Message{}, r.err
+	}
+	select {
+	case m := <-r.messages:
+		atomic.AddInt64(&r.fetched, 1)
+		return m, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	case <-r.closed:
+		return kafka.Message{}, io.EOF
+	}
+}
+
+// CommitMessages commits next offset of messages through current generation,
+// or collects it until commit interval elapsed when CommitInterval is set
+func (r *groupReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.lock.Lock()
+	gen := r.generation
+	r.lock.Unlock()
+	if gen == nil {
+		return errors.New("consumer group has not joined yet")
+	}
+
+	offsets := make(map[string]map[int]int64)
+	for _, m := range msgs {
+		if _, ok := offsets[m.Topic]; !ok {
+			offsets[m.Topic] = make(map[int]int64)
+		}
+		if offset, ok := offsets[m.Topic][m.Partition]; !ok || offset < m.Offset+1 {
+			offsets[m.Topic][m.Partition] = m.Offset + 1
+		}
+	}
+	if r.config.CommitInterval > 0 {
+		r.lock.Lock()
+		r.merge(offsets)
+		r.lock.Unlock()
+		return nil
+	}
+	return gen.CommitOffsets(offsets)
+}
+
+func (r *groupReader) Assignments() []Assignment {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Assignment(nil), r.assignments...)
+}
+
+func (r *groupReader) Stats() kafka.ReaderStats {
+	return kafka.ReaderStats{Topic: r.config.Topic, Messages: atomic.LoadInt64(&r.fetched)}
+}
+
+func (r *groupReader) Config() kafka.ReaderConfig {
+	return r.config
+}
+
+func (r *groupReader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		if r.group != nil {
+			err = r.group.Close()
+		}
+	})
+	return err
+}
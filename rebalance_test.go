@@ -0,0 +1,236 @@
+package oni
+
+import (
+	"context"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestRebalanceSuite struct {
+	suite.Suite
+}
+
+func TestRebalanceTestSuite(t *testing.T) {
+	suite.Run(t, new(TestRebalanceSuite))
+}
+
+// rebalanceEvents records hook invocations of one reader
+type rebalanceEvents struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (e *rebalanceEvents) hook(name string) RebalanceFunc {
+	return func(partitions []Assignment) {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		e.events = append(e.events, fmt.Sprintf("%s %v", name, partitions))
+	}
+}
+
+func (e *rebalanceEvents) get() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]string(nil), e.events...)
+}
+
+func (suite *TestRebalanceSuite) TestMemoryRebalance() {
+	suite.Run("TestMemoryRebalance", func() {
+		transport := NewMemoryTransport()
+		transport.CreateTopic("foos", 2)
+		config := kafka.ReaderConfig{Topic: "foos", GroupID: "consumer-group-foos"}
+
+		var first rebalanceEvents
+		release := make(chan struct{})
+		a := transport.RebalanceReader(config, first.hook("assigned"), func(partitions []Assignment) {
+			first.hook("revoked")(partitions)
+			<-release
+		})
+		suite.Assert().Eventually(func() bool {
+			return len(first.get()) == 1
+		}, time.Second, time.Millisecond)
+		suite.Assert().Equal(a.Assignments(), []Assignment{{Topic: "foos", Partition: 0}, {Topic: "foos", Partition: 1}})
+
+		// nothing assigned until first member gives its partitions up
+		var second rebalanceEvents
+		b := transport.RebalanceReader(config, second.hook("assigned"), nil)
+		suite.Assert().Eventually(func() bool {
+			return len(first.get()) == 2
+		}, time.Second, time.Millisecond)
+		suite.Assert().Empty(a.Assignments())
+		suite.Assert().Empty(b.Assignments())
+		suite.Assert().Empty(second.get())
+
+		close(release)
+		suite.Assert().Eventually(func() bool {
+			return len(first.get()) == 3 && len(second.get()) == 1
+		}, time.Second, time.Millisecond)
+		suite.Assert().Equal(first.get(), []string{
+			"assigned [{foos 0} {foos 1}]",
+			"revoked [{foos 0} {foos 1}]",
+			"assigned [{foos 0}]",
+		})
+		suite.Assert().Equal(second.get(), []string{"assigned [{foos 1}]"})
+
+		// partitions of closed member revoked before given to the rest
+		suite.Assert().Nil(a.Close())
+		suite.Assert().Eventually(func() bool {
+			return len(first.get()) == 4 && len(second.get()) == 2
+		}, time.Second, time.Millisecond)
+		suite.Assert().Equal(first.get()[3], "revoked [{foos 0}]")
+		suite.Assert().Equal(b.Assignments(), []Assignment{{Topic: "foos", Partition: 0}, {Topic: "foos", Partition: 1}})
+		suite.Assert().Nil(b.Close())
+	})
+}
+
+func (suite *TestRebalanceSuite) TestStreamRevoke() {
+	suite.Run("TestStreamRevoke", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		transport.CreateTopic("foos", 2)
+		config := kafka.ReaderConfig{Topic: "foos", GroupID: "consumer-group-foos"}
+		consumer := NewConsumer(NewStream(config, TransportOpt(transport)))
+		consumer.Explicit()
+		consumer.BatchCommit(time.Hour, 0)
+
+		var events rebalanceEvents
+		var committed []int64
+		consumer.OnPartitionsAssigned(events.hook("assigned"))
+		consumer.OnPartitionsRevoked(func(partitions []Assignment) {
+			events.hook("revoked")(partitions)
+			committed = []int64{
+				transport.CommittedOffset("consumer-group-foos", "foos", 0),
+				transport.CommittedOffset("consumer-group-foos", "foos", 1),
+			}
+		})
+
+		var lock sync.Mutex
+		var handled int
+		var assigned [][]Assignment
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled++
+			assigned = append(assigned, ctx.Assignments())
+			return ctx.Ack()
+		})
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+		suite.Assert().Nil(writeFoos(transport, "0", "1", "2", "3"))
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return handled == 4
+		}, time.Second, time.Millisecond)
+		suite.Assert().Equal(assignments(consumer.stream.reader), []Assignment{{Topic: "foos", Partition: 0}, {Topic: "foos", Partition: 1}})
+
+		// acknowledged offsets committed before partitions revoked
+		other := transport.Reader(config)
+		suite.Assert().Eventually(func() bool {
+			return len(events.get()) == 3
+		}, time.Second, time.Millisecond)
+		suite.Assert().Equal(committed, []int64{2, 2})
+		suite.Assert().Equal(events.get(), []string{
+			"assigned [{foos 0} {foos 1}]",
+			"revoked [{foos 0} {foos 1}]",
+			"assigned [{foos 0}]",
+		})
+		suite.Assert().Equal(assigned[0], []Assignment{{Topic: "foos", Partition: 0}, {Topic: "foos", Partition: 1}})
+		suite.Assert().Nil(other.Close())
+
+		cancel()
+		<-done
+		suite.Assert().Nil(consumer.closeConsumers())
+	})
+}
+
+func (suite *TestRebalanceSuite) TestRebalanceUnsupported() {
+	suite.Run("TestRebalanceUnsupported", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		transport := struct{ Transport }{NewMemoryTransport()}
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+
+		errs := make(chan error, 1)
+		consumer.ErrorHandler(func(err error) {
+			errs <- err
+		})
+		consumer.OnPartitionsRevoked(func(partitions []Assignment) {})
+		consumer.NoRoute(func(ctx Context) error {
+			return nil
+		})
+		go consumer.run(ctx)
+		suite.Assert().ErrorIs(<-errs, ErrRebalanceUnsupported)
+	})
+}
+
+func (suite *TestRebalanceSuite) TestGroupReaderConfig() {
+	suite.Run("TestGroupReaderConfig", func() {
+		config := kafka.ReaderConfig{
+			Brokers:         []string{"localhost:8097"},
+			GroupID:         "consumer-group-foos",
+			GroupTopics:     []string{"foos", "bars"},
+			CommitInterval:  time.Second,
+			ReadLagInterval: time.Minute,
+			MaxWait:         time.Millisecond,
+		}
+		r := &groupReader{config: config, generation: &kafka.Generation{}}
+
+		// partition reader keeps every setting except consumer group
+		partition := r.partitionConfig("bars", 2)
+		suite.Assert().Nil(partition.Validate())
+		suite.Assert().Equal(partition.ReadLagInterval, time.Minute)
+		suite.Assert().Equal(partition.MaxWait, time.Millisecond)
+		suite.Assert().Equal(partition.Brokers, config.Brokers)
+		suite.Assert().Empty(partition.GroupID)
+		suite.Assert().Nil(partition.GroupTopics)
+		suite.Assert().Equal(partition.Topic, "bars")
+		suite.Assert().Equal(partition.Partition, 2)
+
+		// commit interval collects highest offsets until flushed
+		suite.Assert().Nil(r.CommitMessages(context.Background(),
+			kafka.Message{Topic: "foos", Partition: 0, Offset: 4},
+			kafka.Message{Topic: "foos", Partition: 0, Offset: 2},
+		))
+		suite.Assert().Nil(r.CommitMessages(context.Background(), kafka.Message{Topic: "bars", Partition: 2, Offset: 7}))
+		suite.Assert().Equal(r.pending, map[string]map[int]int64{"foos": {0: 5}, "bars": {2: 8}})
+	})
+}
+
+func (suite *TestRebalanceSuite) TestGroupReaderFailed() {
+	suite.Run("TestGroupReaderFailed", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(NewMemoryTransport())))
+		var errs []error
+		consumer.ErrorHandler(func(err error) {
+			errs = append(errs, err)
+		})
+		consumer.NoRoute(func(ctx Context) error {
+			return nil
+		})
+		consumer.stream.reader = newGroupReader(kafka.ReaderConfig{
+			Brokers:        []string{"localhost:8097"},
+			Topic:          "foos",
+			GroupID:        "consumer-group-foos",
+			SessionTimeout: -time.Second,
+		}, nil, nil)
+
+		// consumer group which cannot be created stops consumer visibly
+		err := consumer.run(context.Background())
+		suite.Assert().EqualError(err, "SessionTimeout out of bounds: -1000000000")
+		suite.Assert().Equal(errs, []error{err})
+	})
+}
@@ -0,0 +1,239 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var recordMagic = []byte("ONIREC\x01")
+
+var ErrInvalidRecord = errors.New("invalid record")
+
+// Record middleware writes every consumed message into w before handler
+// chain invoked, each record contains topic, partition, offset, key,
+// headers, value, message timestamp and time it was consumed, records
+// can be fed back to handlers using NewReplayTransport, message dispatched
+// again once delayed or nacked is recorded only once, file which already
+// holds records, for example reopened in append mode, is continued
+func Record(w io.Writer) Middleware {
+	var lock sync.Mutex
+	var checked, started bool
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) error {
+			if c, ok := ctx.(*octx); ok && c.redelivered {
+				return next(ctx)
+			}
+			b := encodeRecord(time.Now(), ctx.Message())
+
+			lock.Lock()
+			if !checked {
+				started = recorded(w)
+				checked = true
+			}
+			if !started {
+				b = append(append([]byte(nil), recordMagic...), b...)
+			}
+			_, err := w.Write(b)
+			if err == nil {
+				started = true
+			}
+			lock.Unlock()
+			if err != nil {
+				return err
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+// recorded reports whether file or seekable w already holds
+// records so header is not written again in the middle of it
+func recorded(w io.Writer) bool {
+	if f, ok := w.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size() != 0
+		}
+	}
+	if seeker, ok := w.(io.Seeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return offset != 0
+		}
+	}
+	return false
+}
+
+func encodeRecord(recordedAt time.Time, m kafka.Message) []byte {
+	var payload []byte
+	payload = appendVarint(payload, recordTime(recordedAt))
+	payload = appendRecordBytes(payload, []byte(m.Topic))
+	payload = appendVarint(payload, int64(m.Partition))
+	payload = appendVarint(payload, m.Offset)
+	payload = appendVarint(payload, recordTime(m.Time))
+	payload = appendRecordBytes(payload, m.Key)
+	payload = appendRecordBytes(payload, m.Value)
+	payload = appendUvarint(payload, uint64(len(m.Headers)))
+	for _, header := range m.Headers {
+		payload = appendRecordBytes(payload, []byte(header.Key))
+		payload = appendRecordBytes(payload, header.Value)
+	}
+
+	b := appendUvarint(nil, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutVarint(buf, v)]...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+// recordTime encodes zero time as zero instead of its unix nano
+func recordTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func recordedTime(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+// appendRecordBytes writes length + 1 followed by the bytes
+// so nil and empty bytes can be told apart, zero means nil
+func appendRecordBytes(b []byte, v []byte) []byte {
+	if v == nil {
+		return appendUvarint(b, 0)
+	}
+	b = appendUvarint(b, uint64(len(v))+1)
+	return append(b, v...)
+}
+
+// recordReader decodes records written by Record middleware, header
+// validated once before the first record
+type recordReader struct {
+	r       *bufio.Reader
+	started bool
+	lock    sync.Mutex
+}
+
+func newRecordReader(r io.Reader) *recordReader {
+	return &recordReader{r: bufio.NewReader(r)}
+}
+
+// next returns next record message and the time it was consumed
+// returns io.EOF when there are no more records
+func (rr *recordReader) next() (time.Time, kafka.Message, error) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	if !rr.started {
+		magic := make([]byte, len(recordMagic))
+		if _, err := io.ReadFull(rr.r, magic); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return time.Time{}, kafka.Message{}, ErrInvalidRecord
+			}
+			return time.Time{}, kafka.Message{}, err
+		}
+		if !bytes.Equal(magic, recordMagic) {
+			return time.Time{}, kafka.Message{}, ErrInvalidRecord
+		}
+		rr.started = true
+	}
+
+	size, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return time.Time{}, kafka.Message{}, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(rr.r, payload); err != nil {
+		return time.Time{}, kafka.Message{}, fmt.Errorf("%w: %s", ErrInvalidRecord, err.Error())
+	}
+	return decodeRecord(payload)
+}
+
+func decodeRecord(payload []byte) (time.Time, kafka.Message, error) {
+	d := recordDecoder{b: payload}
+	var m kafka.Message
+	recordedAt := recordedTime(d.varint())
+	m.Topic = string(d.bytes())
+	m.Partition = int(d.varint())
+	m.Offset = d.varint()
+	m.Time = recordedTime(d.varint())
+	m.Key = d.bytes()
+	m.Value = d.bytes()
+	if headers := d.uvarint(); headers != 0 && d.err == nil {
+		m.Headers = make([]kafka.Header, 0, headers)
+		for i := uint64(0); i < headers && d.err == nil; i++ {
+			m.Headers = append(m.Headers, kafka.Header{Key: string(d.bytes()), Value: d.bytes()})
+		}
+	}
+	if d.err != nil {
+		return time.Time{}, kafka.Message{}, d.err
+	}
+	return recordedAt, m, nil
+}
+
+type recordDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *recordDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrInvalidRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrInvalidRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *recordDecoder) bytes() []byte {
+	size := d.uvarint()
+	if d.err != nil || size == 0 {
+		return nil
+	}
+	if uint64(len(d.b)) < size-1 {
+		d.err = ErrInvalidRecord
+		return nil
+	}
+	v := append([]byte{}, d.b[:size-1]...)
+	d.b = d.b[size-1:]
+	return v
+}
@@ -0,0 +1,143 @@
+package oni
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type TestRecordSuite struct {
+	suite.Suite
+}
+
+func TestRecordTestSuite(t *testing.T) {
+	suite.Run(t, new(TestRecordSuite))
+}
+
+func (suite *TestRecordSuite) TestRecordRoundTrip() {
+	suite.Run("TestRecordRoundTrip", func() {
+		t := time.Unix(1690000000, 123)
+		messages := []kafka.Message{
+			{
+				Topic:     "foos",
+				Partition: 2,
+				Offset:    1234,
+				Key:       []byte("create.foo"),
+				Value:     []byte("{\"foo_content\":\"foo\"}"),
+				Headers: []kafka.Header{
+					{Key: "Content-Type", Value: []byte("application/json")},
+					{Key: "X-Empty", Value: []byte{}},
+				},
+				Time: t,
+			},
+			{Topic: "foos", Offset: 1235},
+		}
+
+		var buf bytes.Buffer
+		record := Record(&buf)(func(ctx Context) error {
+			return nil
+		})
+		for _, m := range messages {
+			suite.Assert().Nil(record(newContext(context.Background(), nil, m, nil)))
+		}
+		suite.Assert().True(bytes.HasPrefix(buf.Bytes(), recordMagic))
+
+		rr := newRecordReader(&buf)
+		for _, expected := range messages {
+			recordedAt, m, err := rr.next()
+			suite.Assert().Nil(err)
+			suite.Assert().False(recordedAt.IsZero())
+			suite.Assert().Equal(expected.Topic, m.Topic)
+			suite.Assert().Equal(expected.Partition, m.Partition)
+			suite.Assert().Equal(expected.Offset, m.Offset)
+			suite.Assert().Equal(expected.Key, m.Key)
+			suite.Assert().Equal(expected.Value, m.Value)
+			suite.Assert().Equal(expected.Headers, m.Headers)
+			suite.Assert().True(expected.Time.Equal(m.Time))
+		}
+		_, _, err := rr.next()
+		suite.Assert().Equal(err, io.EOF)
+	})
+}
+
+func (suite *TestRecordSuite) TestRecordInvalid() {
+	suite.Run("TestRecordInvalid", func() {
+		_, _, err := newRecordReader(bytes.NewBufferString("NOTREC\x01")).next()
+		suite.Assert().Equal(err, ErrInvalidRecord)
+
+		b := append(append([]byte(nil), recordMagic...), encodeRecord(time.Now(), kafka.Message{Topic: "foos"})...)
+		_, _, err = newRecordReader(bytes.NewReader(b[:len(b)-1])).next()
+		suite.Assert().True(errors.Is(err, ErrInvalidRecord))
+	})
+}
+
+func (suite *TestRecordSuite) TestRecordAppend() {
+	suite.Run("TestRecordAppend", func() {
+		path := filepath.Join(suite.T().TempDir(), "foos.rec")
+		for _, offset := range []int64{1, 2} {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+			suite.Require().Nil(err)
+			record := Record(f)(func(ctx Context) error {
+				return nil
+			})
+			suite.Assert().Nil(record(newContext(context.Background(), nil, kafka.Message{Topic: "foos", Offset: offset}, nil)))
+			suite.Assert().Nil(f.Close())
+		}
+
+		// recording continued after reopen without second header
+		f, err := os.Open(path)
+		suite.Require().Nil(err)
+		defer f.Close()
+		rr := newRecordReader(f)
+		for _, offset := range []int64{1, 2} {
+			_, m, err := rr.next()
+			suite.Assert().Nil(err)
+			suite.Assert().Equal(m.Offset, offset)
+		}
+		_, _, err = rr.next()
+		suite.Assert().Equal(err, io.EOF)
+	})
+}
+
+func (suite *TestRecordSuite) TestRecordRedelivered() {
+	suite.Run("TestRecordRedelivered", func() {
+		var buf bytes.Buffer
+		handled := 0
+		record := Record(&buf)(func(ctx Context) error {
+			handled++
+			return nil
+		})
+		ctx := newContext(context.Background(), nil, kafka.Message{Topic: "foos"}, nil)
+		suite.Assert().Nil(record(ctx))
+		recorded := buf.Len()
+		ctx.redelivered = true
+		suite.Assert().Nil(record(ctx))
+		suite.Assert().Equal(buf.Len(), recorded)
+		suite.Assert().Equal(handled, 2)
+	})
+}
+
+func (suite *TestRecordSuite) TestRecordWriteError() {
+	suite.Run("TestRecordWriteError", func() {
+		called := false
+		record := Record(failingWriter{})(func(ctx Context) error {
+			called = true
+			return nil
+		})
+		suite.Assert().NotNil(record(newContext(context.Background(), nil, kafka.Message{}, nil)))
+		suite.Assert().False(called)
+	})
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayTransport feeds records written by Record middleware to stream
+// reader instead of reading from kafka, reader returns io.EOF after the
+// last record so consumer stops, producers write into embedded memory
+// transport so nothing is sent to brokers while replaying, reader recreated
+// after seek continues from the next record of the same source
+type ReplayTransport struct {
+	*MemoryTransport
+	records *recordReader
+	timing  bool
+}
+
+// NewReplayTransport creates replay transport reading records from source,
+// when timing is true records are delivered with the same delay between
+// them as when they were consumed originally
+func NewReplayTransport(source io.Reader, timing bool) *ReplayTransport {
+	return &ReplayTransport{
+		MemoryTransport: NewMemoryTransport(),
+		records:         newRecordReader(source),
+		timing:          timing,
+	}
+}
+
+func (t *ReplayTransport) Reader(config kafka.ReaderConfig) Reader {
+	return &replayReader{
+		records: t.records,
+		config:  config,
+		timing:  t.timing,
+		closed:  make(chan struct{}),
+	}
+}
+
+type replayReader struct {
+	records   *recordReader
+	config    kafka.ReaderConfig
+	timing    bool
+	previous  time.Time
+	messages  int64
+	lock      sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *replayReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	return r.FetchMessage(ctx)
+}
+
+func (r *replayReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	select {
+	case <-r.closed:
+		return kafka.Message{}, io.EOF
+	default:
+	}
+
+	recordedAt, m, err := r.records.next()
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	if r.timing && !r.previous.IsZero() {
+		if delay := recordedAt.Sub(r.previous); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return kafka.Message{}, ctx.Err()
+			case <-r.closed:
+				timer.Stop()
+				return kafka.Message{}, io.EOF
+			case <-timer.C:
+			}
+		}
+	}
+	r.previous = recordedAt
+	atomic.AddInt64(&r.messages, 1)
+	return m, nil
+}
+
+func (r *replayReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return nil
+}
+
+func (r *replayReader) Stats() kafka.ReaderStats {
+	return kafka.ReaderStats{Topic: r.config.Topic, Messages: atomic.LoadInt64(&r.messages)}
+}
+
+func (r *replayReader) Config() kafka.ReaderConfig {
+	return r.config
+}
+
+func (r *replayReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+	return nil
+}
@@ -0,0 +1,95 @@
+package oni
+
+import (
+	"bytes"
+	"context"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type TestReplaySuite struct {
+	suite.Suite
+}
+
+func TestReplayTestSuite(t *testing.T) {
+	suite.Run(t, new(TestReplaySuite))
+}
+
+func (suite *TestReplaySuite) TestReplay() {
+	suite.Run("TestReplay", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		var buf bytes.Buffer
+
+		recorded := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		recorded.Use(Record(&buf))
+		recorded.Handler("create.foo", func(ctx Context) error {
+			return nil
+		})
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("1")},
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("2")},
+		))
+		suite.Assert().Nil(recorded.Poll(ctx))
+		suite.Assert().Nil(recorded.Poll(ctx))
+
+		replay := NewReplayTransport(&buf, false)
+		replayed := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(replay)))
+		replayed.Producer("bars_producer", func() *kafka.Writer {
+			return BasicWriter(kafka.TCP("localhost:8097"), "bars")
+		})
+		var values []string
+		replayed.Handler("create.foo", func(ctx Context) error {
+			values = append(values, ctx.ValueString())
+			return ctx.Forward("bars_producer")
+		})
+
+		// consumer stops after last record replayed
+		replayed.run(ctx)
+		suite.Assert().Equal(values, []string{"1", "2"})
+		suite.Assert().Len(replay.Messages("bars"), 2)
+		suite.Assert().Equal(replayed.stream.reader.Stats().Messages, int64(2))
+	})
+}
+
+func (suite *TestReplaySuite) TestReplayTiming() {
+	suite.Run("TestReplayTiming", func() {
+		now := time.Now()
+		var buf bytes.Buffer
+		buf.Write(recordMagic)
+		buf.Write(encodeRecord(now, kafka.Message{Topic: "foos", Key: []byte("a")}))
+		buf.Write(encodeRecord(now.Add(50*time.Millisecond), kafka.Message{Topic: "foos", Key: []byte("b")}))
+
+		r := NewReplayTransport(&buf, true).Reader(kafka.ReaderConfig{Topic: "foos"})
+		_, err := r.FetchMessage(context.Background())
+		suite.Assert().Nil(err)
+		started := time.Now()
+		m, err := r.FetchMessage(context.Background())
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Key), "b")
+		suite.Assert().GreaterOrEqual(time.Since(started), 50*time.Millisecond)
+	})
+}
+
+func (suite *TestReplaySuite) TestReplayRecreatedReader() {
+	suite.Run("TestReplayRecreatedReader", func() {
+		var buf bytes.Buffer
+		buf.Write(recordMagic)
+		buf.Write(encodeRecord(time.Now(), kafka.Message{Topic: "foos", Key: []byte("a")}))
+		buf.Write(encodeRecord(time.Now(), kafka.Message{Topic: "foos", Key: []byte("b")}))
+
+		// reader recreated after seek continues without reading header again
+		replay := NewReplayTransport(&buf, false)
+		r := replay.Reader(kafka.ReaderConfig{Topic: "foos"})
+		m, err := r.FetchMessage(context.Background())
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Key), "a")
+		suite.Assert().Nil(r.Close())
+		m, err = replay.Reader(kafka.ReaderConfig{Topic: "foos"}).FetchMessage(context.Background())
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Key), "b")
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRequestTimeout = errors.New("request timeout")
+	ErrNoReplyTopic   = errors.New("requester stream must read single reply topic")
+)
+
+// Requester sends request message through registered producer and waits
+// for the reply consumed by its own Stream, reply matched by `correlation-id`
+// header and replied by server handler using Context.Reply
+type Requester struct {
+	consumer *Consumer
+	replyTo  string
+	timeout  time.Duration
+	pending  map[string]chan kafka.Message
+	pLock    sync.Mutex
+}
+
+// NewRequester creates requester listening on topic of given stream, every
+// requester instance should have its own reply topic or partition so replies
+// are not consumed by other instances, returns ErrNoReplyTopic when stream
+// reads several topics using TopicsOpt, GroupTopics or TopicPatternOpt
+// since replies are sent into single topic given by `reply-to` header
+func NewRequester(stream *Stream, timeout time.Duration) (*Requester, error) {
+	replyTo := stream.reader.Config().Topic
+	if len(replyTo) == 0 {
+		return nil, ErrNoReplyTopic
+	}
+	r := &Requester{
+		consumer: NewConsumer(stream),
+		replyTo:  replyTo,
+		timeout:  timeout,
+		pending:  make(map[string]chan kafka.Message),
+	}
+	r.consumer.NoRoute(r.receive)
+	return r, nil
+}
+
+// Consumer returns reply consumer which should be started by Runner
+func (r *Requester) Consumer() *Consumer {
+	return r.consumer
+}
+
+func (r *Requester) Producer(name string, producerFunc ProducerFunc) {
+	r.consumer.Producer(name, producerFunc)
+}
+
+// Request sends message to producer registered with given name and blocks
+// until reply received, returns ErrRequestTimeout when no reply received
+// before requester timeout elapsed
+func (r *Requester) Request(ctx context.Context, producerFuncName string, key string, value []byte, headers ...kafka.Header) (kafka.Message, error) {
+	w, err := r.consumer.stream.pool.writer(producerFuncName)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	correlationID, err := newCorrelationID()
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	reply := make(chan kafka.Message, 1)
+	r.pLock.Lock()
+	r.pending[correlationID] = reply
+	r.pLock.Unlock()
+	defer func() {
+		r.pLock.Lock()
+		delete(r.pending, correlationID)
+		r.pLock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	requestHeaders := make([]kafka.Header, 0, len(headers)+2)
+	requestHeaders = append(requestHeaders, headers...)
+	requestHeaders = append(requestHeaders,
+		kafka.Header{Key: HeaderCorrelationID, Value: []byte(correlationID)},
+		kafka.Header{Key: HeaderReplyTo, Value: []byte(r.replyTo)},
+	)
+
+	err = w.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(key),
+		Value:   value,
+		Headers: requestHeaders,
+	})
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	select {
+	case m := <-reply:
+		return m, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return kafka.Message{}, ErrRequestTimeout
+		}
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *Requester) receive(ctx Context) error {
+	r.pLock.Lock()
+	reply, ok := r.pending[ctx.Header(HeaderCorrelationID)]
+	r.pLock.Unlock()
+	if ok {
+		select {
+		case reply <- ctx.Message():
+		default:
+		}
+	}
+	return nil
+}
+
+func newCorrelationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,94 @@
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type TestRequesterSuite struct {
+	suite.Suite
+}
+
+func TestRequesterTestSuite(t *testing.T) {
+	suite.Run(t, new(TestRequesterSuite))
+}
+
+func (suite *TestRequesterSuite) TestRequest() {
+	suite.Run("TestRequest", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		transport := NewMemoryTransport()
+
+		server := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "requests"}, TransportOpt(transport)))
+		server.Producer("reply_producer", func() *kafka.Writer {
+			return &kafka.Writer{Addr: kafka.TCP("localhost:8097")}
+		})
+		server.ReplyWith("reply_producer")
+		server.Handler("ping", func(ctx Context) error {
+			return ctx.Reply(map[string]string{"content": "pong " + ctx.ValueString()})
+		})
+		go server.run(ctx)
+
+		requester, err := NewRequester(NewStream(kafka.ReaderConfig{Topic: "replies"}, TransportOpt(transport)), time.Second)
+		suite.Assert().Nil(err)
+		requester.Producer("request_producer", func() *kafka.Writer {
+			return BasicWriter(kafka.TCP("localhost:8097"), "requests")
+		})
+		go requester.Consumer().run(ctx)
+
+		reply, err := requester.Request(ctx, "request_producer", "ping", []byte("foo"))
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(reply.Value), "{\"content\":\"pong foo\"}")
+		suite.Assert().Equal(reply.Topic, "replies")
+
+		requests := transport.Messages("requests")
+		suite.Assert().Len(requests, 1)
+		correlationID := newContext(ctx, nil, requests[0], nil).Header(HeaderCorrelationID)
+		suite.Assert().NotEmpty(correlationID)
+		suite.Assert().Equal(newContext(ctx, nil, reply, nil).Header(HeaderCorrelationID), correlationID)
+		suite.Assert().Equal(newContext(ctx, nil, requests[0], nil).Header(HeaderReplyTo), "replies")
+	})
+}
+
+func (suite *TestRequesterSuite) TestRequestTimeout() {
+	suite.Run("TestRequestTimeout", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		transport := NewMemoryTransport()
+
+		requester, err := NewRequester(NewStream(kafka.ReaderConfig{Topic: "replies"}, TransportOpt(transport)), 10*time.Millisecond)
+		suite.Assert().Nil(err)
+		requester.Producer("request_producer", func() *kafka.Writer {
+			return BasicWriter(kafka.TCP("localhost:8097"), "requests")
+		})
+		go requester.Consumer().run(ctx)
+
+		_, err = requester.Request(ctx, "request_producer", "ping", []byte("foo"))
+		suite.Assert().Equal(err, ErrRequestTimeout)
+		suite.Assert().Len(requester.pending, 0)
+
+		_, err = requester.Request(ctx, "unknown", "ping", []byte("foo"))
+		suite.Assert().True(errors.Is(err, ErrProducerNotFound))
+	})
+}
+
+func (suite *TestRequesterSuite) TestRequesterReplyTopic() {
+	suite.Run("TestRequesterReplyTopic", func() {
+		transport := NewMemoryTransport()
+
+		// stream without single topic has no topic to receive replies
+		_, err := NewRequester(NewStream(kafka.ReaderConfig{
+			GroupID: "consumer-group-replies",
+		}, TopicsOpt("replies-1", "replies-2"), TransportOpt(transport)), time.Second)
+		suite.Assert().Equal(err, ErrNoReplyTopic)
+		_, err = NewRequester(NewStream(kafka.ReaderConfig{
+			GroupID:     "consumer-group-replies",
+			GroupTopics: []string{"replies"},
+		}, TransportOpt(transport)), time.Second)
+		suite.Assert().Equal(err, ErrNoReplyTopic)
+	})
+}
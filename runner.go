@@ -6,7 +6,10 @@ package oni
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -14,10 +17,12 @@ import (
 )
 
 type Runner struct {
-	Context   context.Context
-	Timeout   time.Duration
-	Syscall   []os.Signal
-	Consumers []*Consumer
+	Context      context.Context
+	Timeout      time.Duration
+	Syscall      []os.Signal
+	Consumers    []*Consumer
+	Relays       []*OutboxRelay
+	Provisioning *Provisioning
 }
 
 func SyscallOpt(syscall ...os.Signal) []os.Signal {
@@ -28,19 +33,72 @@ func ConsumerOpt(consumers ...*Consumer) []*Consumer {
 	return consumers
 }
 
-func (r *Runner) Start() {
+func RelayOpt(relays ...*OutboxRelay) []*OutboxRelay {
+	return relays
+}
+
+// Health returns state of every runner consumer
+func (r *Runner) Health() []ConsumerState {
+	states := make([]ConsumerState, 0, len(r.Consumers))
 	for _, consumer := range r.Consumers {
-		go consumer.run(r.Context)
+		states = append(states, consumer.State())
+	}
+	return states
+}
+
+// HealthHandler returns http handler writing state of every runner
+// consumer as json, paused consumer and partitions are included
+func (r *Runner) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Consumers []ConsumerState `json:"consumers"`
+		}{Consumers: r.Health()})
+	})
+}
+
+// Start provisions topics, runs every consumer and relay and blocks until
+// syscall received or consumer stopped by error, then closes them, returns
+// provisioning error without starting any consumer, or error of the consumer
+// which stopped once the others closed
+func (r *Runner) Start() error {
+	// fail fast before any consumer joins its group
+	if r.Provisioning != nil {
+		if err := r.Provision(); err != nil {
+			return fmt.Errorf("runner not started: %w", err)
+		}
+	}
+
+	// consumer which cannot be started shuts the runner down
+	failed := make(chan error, len(r.Consumers))
+	for i, consumer := range r.Consumers {
+		sequence := i
+		c := consumer
+		go func() {
+			if err := c.run(r.Context); err != nil {
+				failed <- fmt.Errorf("consumer %d stopped: %w", sequence, err)
+			}
+		}()
+	}
+	for _, relay := range r.Relays {
+		go relay.run(r.Context)
 	}
 
+	var stopErr error
 	wait := make(chan struct{})
 	go func() {
 		s := make(chan os.Signal, 1)
 
 		//syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP
 		signal.Notify(s, r.Syscall...)
-		<-s
-		log.Println("shutting down")
+		defer signal.Stop(s)
+		select {
+		case <-s:
+			log.Println("shutting down")
+		case err := <-failed:
+			stopErr = err
+			log.Printf("shutting down, %s", err.Error())
+		}
 
 		timeoutFunc := time.AfterFunc(r.Timeout, func() {
 			log.Printf("timeout %d ms has been elapsed, force exit", r.Timeout.Milliseconds())
@@ -49,6 +107,11 @@ func (r *Runner) Start() {
 
 		defer timeoutFunc.Stop()
 
+		// relays stopped first since they publish using consumer producers
+		for _, relay := range r.Relays {
+			relay.close()
+		}
+
 		var wg sync.WaitGroup
 
 		for i, consumer := range r.Consumers {
@@ -77,4 +140,5 @@ func (r *Runner) Start() {
 	}()
 
 	<-wait
+	return stopErr
 }
@@ -1,10 +1,14 @@
 package oni
 
 import (
+	"context"
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
 	"syscall"
 	"testing"
+	"time"
 )
 
 type TestRunnerSuite struct {
@@ -58,3 +62,77 @@ func (suite *ContextTestSuite) TestConsumerOpt() {
 		}
 	})
 }
+
+func (suite *ContextTestSuite) TestRelayOpt() {
+	suite.Run("TestRelayOpt", func() {
+		outbox := NewOutbox(nil, "oni_outbox", SQLiteDialect)
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "test"}, TransportOpt(NewMemoryTransport())))
+		relays := RelayOpt(
+			outbox.Relay(consumer, time.Second),
+			outbox.Relay(consumer, time.Minute),
+		)
+
+		suite.Assert().Equal(len(relays), 2)
+		suite.Assert().Equal(relays[0].interval, time.Second)
+		suite.Assert().Equal(relays[1].interval, time.Minute)
+	})
+}
+
+func (suite *ContextTestSuite) TestHealthHandler() {
+	suite.Run("TestHealthHandler", func() {
+		paused := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos", GroupID: "foos"}, TransportOpt(NewMemoryTransport())))
+		paused.Pause()
+		runner := Runner{
+			Consumers: ConsumerOpt(
+				paused,
+				NewConsumer(NewStream(kafka.ReaderConfig{Topic: "bars"}, TransportOpt(NewMemoryTransport()))),
+			),
+		}
+		suite.Assert().Equal(runner.Health(), []ConsumerState{
+			{Topic: "foos", GroupID: "foos", Paused: true},
+			{Topic: "bars"},
+		})
+
+		recorder := httptest.NewRecorder()
+		runner.HealthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+		suite.Assert().Equal(recorder.Code, http.StatusOK)
+		suite.Assert().Equal(recorder.Header().Get("Content-Type"), "application/json")
+		suite.Assert().JSONEq(recorder.Body.String(), `{"consumers":[
+			{"topic":"foos","group_id":"foos","paused":true},
+			{"topic":"bars","paused":false}
+		]}`)
+	})
+}
+
+func (suite *ContextTestSuite) TestRunnerConsumerFailed() {
+	suite.Run("TestRunnerConsumerFailed", func() {
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(NewMemoryTransport())))
+		consumer.Handler("create.foo", func(ctx Context) error {
+			return nil
+		})
+		consumer.stream.reader = newGroupReader(kafka.ReaderConfig{
+			Brokers:        []string{"localhost:8097"},
+			Topic:          "foos",
+			GroupID:        "consumer-group-foos",
+			SessionTimeout: -time.Second,
+		}, nil, nil)
+		runner := Runner{
+			Context:   context.Background(),
+			Timeout:   time.Second,
+			Syscall:   SyscallOpt(syscall.SIGUSR1),
+			Consumers: ConsumerOpt(consumer),
+		}
+
+		// runner shut down instead of waiting for signal
+		done := make(chan error, 1)
+		go func() {
+			done <- runner.Start()
+		}()
+		select {
+		case err := <-done:
+			suite.Assert().EqualError(err, "consumer 0 stopped: SessionTimeout out of bounds: -1000000000")
+		case <-time.After(time.Second):
+			suite.Fail("runner not shut down")
+		}
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"time"
+)
+
+const (
+	defaultNackDelay      = time.Second
+	defaultRejoinInterval = 5 * time.Second
+)
+
+var errSeeking = errors.New("partition seeking")
+
+// seek requested by Context.SeekTo for partition of handled message, or by
+// Consumer.SeekToTime and Consumer.ResetToEarliest for every partition,
+// resubscription to topics matched by stream topic pattern, or revocation
+// of partitions finished once messages fetched before it are handled
+type seek struct {
+	offsets    map[topicPartition]int64
+	all        bool
+	at         time.Time
+	topics     []string
+	revocation *revocation
+}
+
+// requestSeek stores seek applied by stream before next fetch and
+// interrupts fetch in progress so the stream picks it up immediately
+func (s *Stream) requestSeek(sk seek) {
+	s.sLock.Lock()
+	s.seeks = append(s.seeks, sk)
+	cancel := s.cancelFetch
+	s.sLock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (s *Stream) takeSeeks() []seek {
+	s.sLock.Lock()
+	defer s.sLock.Unlock()
+	seeks := s.seeks
+	s.seeks = nil
+	return seeks
+}
+
+func (s *Stream) seeking() bool {
+	s.sLock.Lock()
+	defer s.sLock.Unlock()
+	return len(s.seeks) != 0
+}
+
+// fetchSeekable fetches next message, fetch interrupted by requested
+// seek returns errSeeking so the stream applies it first
+func (s *Stream) fetchSeekable() (kafka.Message, error) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	s.sLock.Lock()
+	if len(s.seeks) != 0 {
+		s.sLock.Unlock()
+		return kafka.Message{}, errSeeking
+	}
+	s.cancelFetch = cancel
+	s.sLock.Unlock()
+
+	m, err := s.fetchContext(ctx)
+
+	s.sLock.Lock()
+	s.cancelFetch = nil
+	s.sLock.Unlock()
+	if err != nil && s.ctx.Err() == nil && ctx.Err() != nil {
+		return m, errSeeking
+	}
+	return m, err
+}
+
+// applySeeks moves reader without GroupID using SeekableReader, reader of
+// consumer group cannot be moved while it is member of the group, so its
+// offsets are committed then the reader recreated to rejoin the group
+// starting from committed offsets, every uncommitted message of reader
+// assignment is consumed again, resubscription recreates the reader as well,
+// rejoin rebalances every member of the group so seeks requested meanwhile
+// are applied together and the group is rejoined at most once per interval
+func (s *Stream) applySeeks(seeks []seek) error {
+	config := s.reader.Config()
+	subscribed := false
+	for _, sk := range seeks {
+		if sk.topics != nil {
+			config.Topic = ""
+			config.GroupTopics = sk.topics
+			subscribed = true
+		}
+	}
+	if len(config.GroupID) == 0 {
+		r, ok := s.reader.(SeekableReader)
+		if !ok {
+			return ErrSeekUnsupported
+		}
+		for _, sk := range seeks {
+			var err error
+			switch {
+			case sk.all && sk.at.IsZero():
+				err = r.SetOffset(kafka.FirstOffset)
+			case sk.all:
+				err = r.SetOffsetAt(s.ctx, sk.at)
+			default:
+				for _, offset := range sk.offsets {
+					err = r.SetOffset(offset)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	offsets := make(map[topicPartition]int64)
+	for _, sk := range seeks {
+		if sk.topics != nil || sk.revocation != nil {
+			continue
+		}
+		if !sk.all {
+			for tp, offset := range sk.offsets {
+				offsets[tp] = offset
+			}
+			continue
+		}
+
+		t, ok := s.transport.(OffsetTransport)
+		if !ok {
+			return ErrSeekUnsupported
+		}
+		topics := config.GroupTopics
+		if len(topics) == 0 {
+			topics = []string{config.Topic}
+		}
+		for _, topic := range topics {
+			partitions, err := t.OffsetsAt(s.ctx, config, topic, sk.at)
+			if err != nil {
+				return err
+			}
+			for partition, offset := range partitions {
+				offsets[topicPartition{topic: topic, partition: partition}] = offset
+			}
+		}
+	}
+
+	if len(offsets) == 0 {
+		if subscribed {
+			return s.recreateReader(config)
+		}
+		return nil
+	}
+
+	if err := s.waitRejoin(); err != nil {
+		return err
+	}
+
+	// committing message commits its next offset
+	msgs := make([]kafka.Message, 0, len(offsets))
+	for tp, offset := range offsets {
+		msgs = append(msgs, kafka.Message{Topic: tp.topic, Partition: tp.partition, Offset: offset - 1})
+	}
+	if err := s.reader.CommitMessages(s.ctx, msgs...); err != nil {
+		return err
+	}
+	s.rejoined = time.Now()
+	return s.recreateReader(config)
+}
+
+// waitRejoin waits until rejoin interval elapsed since reader rejoined its
+// group to seek, returns errStopped when consumers closed meanwhile
+func (s *Stream) waitRejoin() error {
+	wait := s.rejoinInterval - time.Since(s.rejoined)
+	if s.rejoined.IsZero() || wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.pauser.closed:
+		return errStopped
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// recreateReader replaces stream reader unless consumers closed meanwhile
+func (s *Stream) recreateReader(config kafka.ReaderConfig) error {
+	s.rLock.Lock()
+	defer s.rLock.Unlock()
+	select {
+	case <-s.pauser.closed:
+		return errStopped
+	default:
+	}
+	_ = s.reader.Close()
+	s.reader = s.newReader(config)
+	return nil
+}
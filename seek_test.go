@@ -0,0 +1,298 @@
+package oni
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestSeekSuite struct {
+	suite.Suite
+}
+
+func TestSeekTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSeekSuite))
+}
+
+func writeFoos(transport *MemoryTransport, values ...string) error {
+	w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+	for _, value := range values {
+		if err := w.WriteMessages(context.Background(), kafka.Message{Key: []byte("create.foo"), Value: []byte(value)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runFoos runs consumer until handled returns wanted number of values
+func (suite *TestSeekSuite) runFoos(consumer *Consumer, handled func() []string, want int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		consumer.run(ctx)
+		close(done)
+	}()
+	suite.Assert().Eventually(func() bool {
+		return len(handled()) == want
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
+
+func (suite *TestSeekSuite) TestMemorySeek() {
+	suite.Run("TestMemorySeek", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		start := time.Now()
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Value: []byte("0"), Time: start},
+			kafka.Message{Value: []byte("1"), Time: start.Add(time.Minute)},
+			kafka.Message{Value: []byte("2"), Time: start.Add(2 * time.Minute)},
+		))
+
+		offsets, err := transport.OffsetsAt(ctx, kafka.ReaderConfig{}, "foos", start.Add(30*time.Second))
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(offsets, map[int]int64{0: 1})
+		offsets, err = transport.OffsetsAt(ctx, kafka.ReaderConfig{}, "foos", time.Time{})
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(offsets, map[int]int64{0: 0})
+
+		r := transport.Reader(kafka.ReaderConfig{Topic: "foos"}).(SeekableReader)
+		suite.Assert().Nil(r.SetOffset(2))
+		m, err := r.FetchMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Value), "2")
+		suite.Assert().Nil(r.SetOffsetAt(ctx, start.Add(time.Second)))
+		m, err = r.FetchMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Value), "1")
+		suite.Assert().Nil(r.SetOffset(kafka.FirstOffset))
+		m, err = r.FetchMessage(ctx)
+		suite.Assert().Nil(err)
+		suite.Assert().Equal(string(m.Value), "0")
+
+		// group reader rewound by committing lower offset
+		group := transport.Reader(kafka.ReaderConfig{Topic: "foos", GroupID: "consumer-group-foos"})
+		suite.Assert().NotNil(group.(SeekableReader).SetOffset(0))
+		suite.Assert().Nil(group.CommitMessages(ctx, kafka.Message{Topic: "foos", Offset: 2}))
+		suite.Assert().Nil(group.CommitMessages(ctx, kafka.Message{Topic: "foos", Offset: 0}))
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(1))
+	})
+}
+
+func (suite *TestSeekSuite) TestStreamNack() {
+	suite.Run("TestStreamNack", func() {
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Explicit()
+		consumer.NackDelay(20 * time.Millisecond)
+
+		var lock sync.Mutex
+		var handled []string
+		var errs []error
+		var nackedAt, redeliveredAt time.Time
+		consumer.ErrorHandler(func(err error) {
+			errs = append(errs, err)
+		})
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.ValueString())
+			if ctx.ValueString() == "1" && nackedAt.IsZero() {
+				nackedAt = time.Now()
+				return ctx.Nack()
+			}
+			if ctx.ValueString() == "1" {
+				redeliveredAt = time.Now()
+			}
+			return ctx.Ack()
+		})
+		suite.Assert().Nil(writeFoos(transport, "1", "2"))
+
+		suite.runFoos(consumer, func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return append([]string(nil), handled...)
+		}, 3)
+		suite.Assert().Equal(handled, []string{"1", "1", "2"})
+		suite.Assert().GreaterOrEqual(redeliveredAt.Sub(nackedAt), 20*time.Millisecond)
+		suite.Assert().Len(errs, 0)
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(2))
+	})
+}
+
+func (suite *TestSeekSuite) TestStreamSeekTo() {
+	suite.Run("TestStreamSeekTo", func() {
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Explicit()
+
+		var lock sync.Mutex
+		var handled []string
+		sought := false
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.ValueString())
+			if ctx.ValueString() == "3" && !sought {
+				sought = true
+				suite.Assert().NotNil(ctx.SeekTo(-1))
+				return ctx.SeekTo(1)
+			}
+			return ctx.Ack()
+		})
+		suite.Assert().Nil(writeFoos(transport, "0", "1", "2", "3"))
+
+		suite.runFoos(consumer, func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return append([]string(nil), handled...)
+		}, 7)
+		suite.Assert().Equal(handled, []string{"0", "1", "2", "3", "1", "2", "3"})
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(4))
+	})
+}
+
+func (suite *TestSeekSuite) TestStreamSeekRejoinInterval() {
+	suite.Run("TestStreamSeekRejoinInterval", func() {
+		transport := NewMemoryTransport()
+		stream := NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport))
+		stream.rejoinInterval = 100 * time.Millisecond
+		consumer := NewConsumer(stream)
+		consumer.Explicit()
+
+		// seeking every message rejoins group at most once per interval
+		var lock sync.Mutex
+		var handled []string
+		var rejoins []time.Time
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.ValueString())
+			if len(handled) <= 3 {
+				rejoins = append(rejoins, time.Now())
+				return ctx.SeekTo(0)
+			}
+			return ctx.Ack()
+		})
+		suite.Assert().Nil(writeFoos(transport, "0", "1"))
+
+		suite.runFoos(consumer, func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return append([]string(nil), handled...)
+		}, 5)
+		suite.Assert().Equal(handled, []string{"0", "0", "0", "0", "1"})
+		suite.Assert().GreaterOrEqual(rejoins[2].Sub(rejoins[0]), 100*time.Millisecond)
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(2))
+	})
+}
+
+func (suite *TestSeekSuite) TestStreamResetToEarliest() {
+	suite.Run("TestStreamResetToEarliest", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		transport.CreateTopic("foos", 2)
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+
+		var lock sync.Mutex
+		var handled []string
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.ValueString())
+			return nil
+		})
+		count := func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(handled)
+		}
+		suite.Assert().Nil(writeFoos(transport, "0", "1", "2", "3"))
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+		suite.Assert().Eventually(func() bool {
+			return count() == 4
+		}, time.Second, time.Millisecond)
+
+		// running stream replays every partition
+		consumer.ResetToEarliest()
+		suite.Assert().Eventually(func() bool {
+			return count() == 8
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		suite.Assert().ElementsMatch(handled, []string{"0", "1", "2", "3", "0", "1", "2", "3"})
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(2))
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 1), int64(2))
+	})
+}
+
+func (suite *TestSeekSuite) TestPollSeekToTime() {
+	suite.Run("TestPollSeekToTime", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(transport)))
+		var handled []string
+		consumer.Handler("create.foo", func(ctx Context) error {
+			handled = append(handled, ctx.ValueString())
+			return nil
+		})
+
+		start := time.Now()
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		for i, value := range []string{"0", "1", "2"} {
+			suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{
+				Key:   []byte("create.foo"),
+				Value: []byte(value),
+				Time:  start.Add(time.Duration(i) * time.Minute),
+			}))
+		}
+
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Nil(consumer.Poll(ctx))
+		consumer.SeekToTime(start.Add(90 * time.Second))
+		suite.Assert().Nil(consumer.Poll(ctx))
+		consumer.ResetToEarliest()
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Equal(handled, []string{"0", "1", "2", "0"})
+	})
+}
+
+func (suite *TestSeekSuite) TestSeekUnsupported() {
+	suite.Run("TestSeekUnsupported", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(struct{ Transport }{transport})))
+		consumer.Handler("create.foo", func(ctx Context) error {
+			return nil
+		})
+
+		consumer.ResetToEarliest()
+		suite.Assert().ErrorIs(consumer.Poll(ctx), ErrSeekUnsupported)
+	})
+}
@@ -0,0 +1,50 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"fmt"
+)
+
+// Placeholder returns bind parameter of i-th query argument starting from 1
+type Placeholder func(i int) string
+
+// QuestionPlaceholder used by MySQL and SQLite drivers
+func QuestionPlaceholder(i int) string {
+	return "?"
+}
+
+// DollarPlaceholder used by PostgreSQL drivers
+func DollarPlaceholder(i int) string {
+	return fmt.Sprintf("$%d", i)
+}
+
+// SQLDialect describes differences between databases used by
+// SQL backed stores when building queries and creating tables
+type SQLDialect struct {
+	Placeholder Placeholder
+	// Serial column definition of auto increment primary key
+	Serial string
+	// Blob column type of binary data
+	Blob string
+}
+
+var (
+	SQLiteDialect = SQLDialect{
+		Placeholder: QuestionPlaceholder,
+		Serial:      "INTEGER PRIMARY KEY AUTOINCREMENT",
+		Blob:        "BLOB",
+	}
+	PostgresDialect = SQLDialect{
+		Placeholder: DollarPlaceholder,
+		Serial:      "BIGSERIAL PRIMARY KEY",
+		Blob:        "BYTEA",
+	}
+	MySQLDialect = SQLDialect{
+		Placeholder: QuestionPlaceholder,
+		Serial:      "BIGINT AUTO_INCREMENT PRIMARY KEY",
+		Blob:        "LONGBLOB",
+	}
+)
@@ -0,0 +1,29 @@
+package oni
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type TestSQLSuite struct {
+	suite.Suite
+}
+
+func TestSQLTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSQLSuite))
+}
+
+func (suite *TestSQLSuite) TestPlaceholder() {
+	suite.Run("TestPlaceholder", func() {
+		suite.Assert().Equal(QuestionPlaceholder(2), "?")
+		suite.Assert().Equal(DollarPlaceholder(2), "$2")
+	})
+}
+
+func (suite *TestSQLSuite) TestSQLDialect() {
+	suite.Run("TestSQLDialect", func() {
+		suite.Assert().Equal(SQLiteDialect.Placeholder(1), "?")
+		suite.Assert().Equal(MySQLDialect.Placeholder(1), "?")
+		suite.Assert().Equal(PostgresDialect.Placeholder(1), "$1")
+	})
+}
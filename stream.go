@@ -6,8 +6,11 @@ package oni
 
 import (
 	"context"
+	"errors"
 	"github.com/segmentio/kafka-go"
+	"regexp"
 	"sync"
+	"time"
 )
 
 const (
@@ -19,10 +22,14 @@ type consumeMode int
 
 type HandlerFunc func(ctx Context) error
 
+type Middleware func(next HandlerFunc) HandlerFunc
+
 type ErrorCallbackFunc func(err error)
 
 type ProducerFunc func() *kafka.Writer
 
+type StreamOption func(s *Stream)
+
 type handler struct {
 	HandlerFunc       HandlerFunc
 	ErrorCallbackFunc ErrorCallbackFunc
@@ -30,81 +37,520 @@ type handler struct {
 
 type IStream interface {
 	addHandler(key string, handlerFunc HandlerFunc, errorCallbackFunc ErrorCallbackFunc)
+	addNoRoute(handlerFunc HandlerFunc, errorCallbackFunc ErrorCallbackFunc)
+	addMiddleware(middleware Middleware)
 	addProducer(name string, producerFunc ProducerFunc)
-	invoke(wg *sync.WaitGroup)
 	closeConsumers() error
 	closeProducers() error
 	stream()
+	fetch() (kafka.Message, error)
+	dispatch(m kafka.Message) error
+	useTransport(transport Transport)
 }
 
 type Stream struct {
-	reader    *kafka.Reader
-	handlers  map[string][]handler
-	producers map[string]ProducerFunc
-	fLock     sync.Mutex
-	eLock     sync.Mutex
-	cm        consumeMode
-	ctx       context.Context
+	transport       Transport
+	reader          Reader
+	handlers        map[string][]handler
+	topicHandlers   map[route][]handler
+	noRoute         []handler
+	middlewares     []Middleware
+	producers       map[string]ProducerFunc
+	pool            *producerPool
+	fLock           sync.Mutex
+	eLock           sync.Mutex
+	cm              consumeMode
+	ctx             context.Context
+	codec           Codec
+	validator       Validator
+	invalidProducer string
+	replyProducer   string
+	outbox          *Outbox
+	pauser          *pauser
+	limits          *limits
+	nackDelay       time.Duration
+	rejoinInterval  time.Duration
+	rejoined        time.Time
+	queueSize       int
+	seeks           []seek
+	cancelFetch     context.CancelFunc
+	sLock           sync.Mutex
+	rLock           sync.Mutex
+	errorCallback   ErrorCallbackFunc
+	offsets         *offsetManager
+	acks            map[string]AckStrategy
+	noRouteAck      AckStrategy
+	noRouteAcked    bool
+	topicAcks       map[route]AckStrategy
+	topics          []string
+	pattern         *regexp.Regexp
+	refresh         time.Duration
+	refreshed       time.Time
+	onAssigned      RebalanceFunc
+	onRevoked       RebalanceFunc
+	listening       bool
+	streaming       chan struct{}
 }
 
-func NewStream(config kafka.ReaderConfig) *Stream {
-	return &Stream{
-		reader:    kafka.NewReader(config),
-		handlers:  make(map[string][]handler),
-		producers: make(map[string]ProducerFunc),
-		cm:        implicit,
+func NewStream(config kafka.ReaderConfig, opts ...StreamOption) *Stream {
+	s := &Stream{
+		transport:      KafkaTransport(),
+		handlers:       make(map[string][]handler),
+		topicHandlers:  make(map[route][]handler),
+		producers:      make(map[string]ProducerFunc),
+		acks:           make(map[string]AckStrategy),
+		topicAcks:      make(map[route]AckStrategy),
+		cm:             implicit,
+		codec:          JSONCodec(),
+		validator:      TagValidator(),
+		pauser:         newPauser(),
+		limits:         newLimits(),
+		nackDelay:      defaultNackDelay,
+		rejoinInterval: defaultRejoinInterval,
+		queueSize:      defaultPartitionQueue,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if len(s.topics) != 0 || s.pattern != nil {
+		s.topics = mergeTopics(config.Topic, config.GroupTopics, s.topics)
+		config.Topic = ""
+		config.GroupTopics = s.topics
+	}
+	s.reader = s.newReader(config)
+	s.pool = newProducerPool(s.producers, s.transport)
+	return s
+}
+
+// TransportOpt replace default kafka transport used by
+// stream reader and producers, for example NewMemoryTransport
+func TransportOpt(transport Transport) StreamOption {
+	return func(s *Stream) {
+		s.transport = transport
 	}
 }
 
 func (s *Stream) closeConsumers() error {
+	if err := s.flushOffsets(); err != nil {
+		s.callbackError(err)
+	}
+
+	s.rLock.Lock()
+	defer s.rLock.Unlock()
+	s.pauser.close()
 	return s.reader.Close()
 }
 
 func (s *Stream) closeProducers() error {
-	var err error
-	for key, producer := range s.producers {
-		err = producer().Close()
+	err := s.pool.close()
+	for key := range s.producers {
 		delete(s.producers, key)
-		return err
 	}
-	return nil
+	return err
 }
 
-func (s *Stream) invoke(wg *sync.WaitGroup) {
-	s.stream()
-	defer wg.Done()
-}
+// stream fetches messages until reader closed and hands them to worker of
+// their partition, partitions processed concurrently while messages of the
+// same partition processed in order, next message is not fetched until
+// limits of the current one allow it to be handled, partition which queue
+// is full stops being fetched while others keep being consumed, or stream
+// stops fetching when reader cannot pause single partition, so delayed or
+// paused partition does not buffer every message behind it, requested seek applied
+// once workers finished messages fetched before it, stream subscribed to
+// topic pattern resubscribes the same way once matched topics changed,
+// returns reader error which stopped the stream before it was closed
+func (s *Stream) stream() error {
+	streaming := make(chan struct{})
+	s.sLock.Lock()
+	s.streaming = streaming
+	s.sLock.Unlock()
+	defer func() {
+		s.sLock.Lock()
+		s.streaming = nil
+		s.sLock.Unlock()
+		close(streaming)
+	}()
+	if s.rebalancing() && !s.listening && len(s.reader.Config().GroupID) != 0 {
+		s.callbackError(ErrRebalanceUnsupported)
+	}
 
-func (s *Stream) stream() {
+	stop := make(chan struct{})
+	committed := make(chan struct{})
+	watched := make(chan struct{})
+	if s.pattern != nil {
+		go func() {
+			defer close(watched)
+			s.watchTopics(stop)
+		}()
+	} else {
+		close(watched)
+	}
+	if s.tracking() {
+		go func() {
+			defer close(committed)
+			s.offsets.run(stop, func() {
+				if err := s.flushOffsets(); err != nil {
+					s.callbackError(err)
+				}
+			})
+		}()
+	} else {
+		close(committed)
+	}
+
+	var failed error
+	var wg sync.WaitGroup
+	workers := make(map[topicPartition]*partitionWorker)
 	for {
-		var m kafka.Message
-		var err error
+		if err := s.pauser.wait(s.ctx, nil, nil); err != nil {
+			break
+		}
+		if seeks := s.takeSeeks(); len(seeks) != 0 {
+			s.waitWorkers(workers, &wg)
+			workers = make(map[topicPartition]*partitionWorker)
+			if err := s.flushOffsets(); err != nil {
+				s.callbackError(err)
+			}
+
+			// messages abandoned by stopped workers are not tracked anymore
+			err := s.applySeeks(seeks)
+			if s.offsets != nil {
+				s.offsets.reset()
+			}
+			for _, sk := range seeks {
+				if sk.revocation != nil {
+					sk.revocation.finish(s.onRevoked)
+				}
+			}
+			if errors.Is(err, errStopped) {
+				break
+			}
+			if err != nil {
+				s.callbackError(err)
+			}
+			continue
+		}
+
+		m, err := s.fetchSeekable()
+		if errors.Is(err, errSeeking) {
+			continue
+		}
+		if err != nil {
+			failed = s.failed(err)
+			break
+		}
+		if s.tracking() {
+			s.offsets.track(m)
+		}
+		if err := s.limits.acquire(s.ctx, m, s.pauser.closed); err != nil {
+			break
+		}
+
+		tp := topicPartition{topic: m.Topic, partition: m.Partition}
+		w, ok := workers[tp]
+		if !ok {
+			w = s.newWorker(tp)
+			workers[tp] = w
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.work(w)
+			}()
+		}
 
-		switch s.cm {
-		case implicit:
-			m, err = s.reader.ReadMessage(s.ctx)
-		case explicit:
-			m, err = s.reader.FetchMessage(s.ctx)
+		// message not queued because of requested seek is fetched again
+		// like messages abandoned by stopped workers
+		err = s.enqueue(w, m)
+		if errors.Is(err, errSeeking) {
+			s.limits.release(m)
+			continue
 		}
 		if err != nil {
+			s.limits.release(m)
 			break
 		}
+	}
+
+	s.waitWorkers(workers, &wg)
+	close(stop)
+	<-committed
+	<-watched
+	if err := s.flushOffsets(); err != nil {
+		s.callbackError(err)
+	}
+	return failed
+}
+
+// failed reports reader error which stopped the stream to error handler,
+// returns nil when fetch stopped because stream closed or its context done
+func (s *Stream) failed(err error) error {
+	select {
+	case <-s.pauser.closed:
+		return nil
+	default:
+	}
+	if s.ctx.Err() != nil {
+		return nil
+	}
+	s.callbackError(err)
+	return err
+}
+
+// newWorker creates worker of partition which pauses fetching of the
+// partition once its queue is full when reader can pause partitions
+func (s *Stream) newWorker(tp topicPartition) *partitionWorker {
+	w := newPartitionWorker(s.queueSize)
+	if r, ok := s.reader.(PartitionPausableReader); ok {
+		w.pause = func() {
+			r.PausePartition(tp.topic, tp.partition)
+		}
+		w.resume = func() {
+			r.ResumePartition(tp.topic, tp.partition)
+		}
+	}
+	return w
+}
+
+// enqueue hands message to worker of its partition, worker of reader which
+// cannot pause partitions waits while its queue is full, waiting interrupted
+// by requested seek like fetch and returns errSeeking
+func (s *Stream) enqueue(w *partitionWorker, m kafka.Message) error {
+	if w.pause != nil {
+		w.offer(m)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	s.sLock.Lock()
+	if len(s.seeks) != 0 {
+		s.sLock.Unlock()
+		return errSeeking
+	}
+	s.cancelFetch = cancel
+	s.sLock.Unlock()
+
+	err := w.push(ctx, m, s.pauser.closed)
+
+	s.sLock.Lock()
+	s.cancelFetch = nil
+	s.sLock.Unlock()
+	if err != nil && s.ctx.Err() == nil && ctx.Err() != nil {
+		return errSeeking
+	}
+	return err
+}
+
+func (s *Stream) waitWorkers(workers map[topicPartition]*partitionWorker, wg *sync.WaitGroup) {
+	for _, w := range workers {
+		w.close()
+	}
+	wg.Wait()
+}
+
+func (s *Stream) work(w *partitionWorker) {
+	stopped := false
+	for {
+		m, ok := w.pop()
+		if !ok {
+			return
+		}
+		// worker stopped while message delayed or partition paused, or its partition
+		// seeking, the rest are abandoned
+		if !stopped {
+			var d *delayed
+			err := s.process(m, w.stop)
+			if errors.As(err, &d) || errors.Is(err, errStopped) || errors.Is(err, errSeeking) {
+				stopped = true
+			}
+		}
+		s.limits.release(m)
+	}
+}
 
-		oniCtx := newContext(s.ctx, s.reader, m, s.producers)
-		for _, handler := range s.handlers[string(m.Key)] {
+// process dispatches message once stream and its partition are not paused
+// and dispatches it again once due when it is delayed, returns the delay
+// error when stopped before message due
+func (s *Stream) process(m kafka.Message, stop <-chan struct{}) error {
+	tp := topicPartition{topic: m.Topic, partition: m.Partition}
+	for redelivered := false; ; redelivered = true {
+		if err := s.pauser.wait(s.ctx, &tp, stop); err != nil {
+			return err
+		}
+		err := s.redispatch(m, redelivered)
+		var d *delayed
+		if !errors.As(err, &d) {
+			return err
+		}
+
+		timer := time.NewTimer(time.Until(d.until))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return err
+		case <-s.ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (s *Stream) fetch() (kafka.Message, error) {
+	return s.fetchContext(s.ctx)
+}
+
+// fetchContext fetches message without committing it, implicit stream commits
+// it once dispatched so message held by Delay is not committed before it is due
+func (s *Stream) fetchContext(ctx context.Context) (kafka.Message, error) {
+	return s.reader.FetchMessage(ctx)
+}
+
+// dispatch invokes handler chain registered for message topic and key wrapped
+// by stream middlewares and returns error which stopped the chain, or
+// delay of nacked message and errSeeking when handler requested seek
+func (s *Stream) dispatch(m kafka.Message) error {
+	return s.redispatch(m, false)
+}
+
+// redispatch invokes handler chain of message, redelivered is set when
+// message dispatched again once delayed or nacked message due
+func (s *Stream) redispatch(m kafka.Message, redelivered bool) error {
+	handlers := s.lookup(m.Topic, string(m.Key))
+
+	// error returned by middleware reported to first handler error callback
+	var errorCallbackFunc ErrorCallbackFunc
+	if len(handlers) != 0 {
+		errorCallbackFunc = handlers[0].ErrorCallbackFunc
+	}
+
+	// message of route acknowledged before its handlers committed right before
+	// the first handler invoked, so middleware holding it does not commit it
+	ctx := s.newContext(m)
+	ctx.redelivered = redelivered
+	strategy := s.ackStrategy(m.Topic, string(m.Key))
+	before := strategy == AutoAckBefore
+	acked := false
+	chain := func(c Context) error {
+		if before && !acked {
+			acked = true
+			if err := s.autoAck(ctx); err != nil {
+				return err
+			}
+		}
+		for _, handler := range handlers {
 			s.fLock.Lock()
-			err := handler.HandlerFunc(oniCtx)
+			err := handler.HandlerFunc(c)
 			s.fLock.Unlock()
 			if err != nil {
-				if handler.ErrorCallbackFunc != nil {
-					s.eLock.Lock()
-					handler.ErrorCallbackFunc(err)
-					s.eLock.Unlock()
-				}
-				break
+				errorCallbackFunc = handler.ErrorCallbackFunc
+				return err
 			}
 		}
+		return nil
+	}
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		chain = s.middlewares[i](chain)
+	}
+
+	var err error
+	var d *delayed
+	switch {
+	case before:
+		// middleware which stopped the chain before handlers does not hold message
+		err = chain(ctx)
+		if !acked && !errors.As(err, &d) {
+			if ackErr := s.autoAck(ctx); err == nil {
+				err = ackErr
+			}
+		}
+	default:
+		err = chain(ctx)
+		if err == nil && strategy == AutoAckAfterSuccess && !ctx.nacked && ctx.seekOffset == nil {
+			err = s.autoAck(ctx)
+		}
 	}
+	switch {
+	case err != nil:
+	case ctx.seekOffset != nil:
+		s.requestSeek(seek{offsets: map[topicPartition]int64{
+			{topic: m.Topic, partition: m.Partition}: *ctx.seekOffset,
+		}})
+		return errSeeking
+	case ctx.nacked:
+		return &delayed{until: time.Now().Add(s.nackDelay)}
+	}
+
+	// message without handler or which handler returned error is not handled
+	// again, so it is marked acknowledged to let offsets after it be committed
+	if s.tracking() && !ctx.acked && (len(handlers) == 0 || err != nil) && !errors.As(err, &d) {
+		s.offsets.done(m)
+	}
+	if err != nil && errorCallbackFunc != nil && !errors.As(err, &d) {
+		s.eLock.Lock()
+		errorCallbackFunc(err)
+		s.eLock.Unlock()
+	}
+	return err
+}
+
+// callbackError reports error of the stream itself to consumer error handler
+func (s *Stream) callbackError(err error) {
+	if s.errorCallback == nil {
+		return
+	}
+	s.eLock.Lock()
+	defer s.eLock.Unlock()
+	s.errorCallback(err)
+}
+
+func (s *Stream) useTransport(transport Transport) {
+	config := s.reader.Config()
+	_ = s.reader.Close()
+	s.transport = transport
+	s.reader = s.newReader(config)
+	s.pool = newProducerPool(s.producers, transport)
+}
+
+// tracking reports whether acknowledged offsets committed by offset manager
+func (s *Stream) tracking() bool {
+	return s.offsets != nil
+}
+
+// flushOffsets commits offsets acknowledged so far, offsets acknowledged
+// after consumers closed are dropped and consumed again after restart
+func (s *Stream) flushOffsets() error {
+	if !s.tracking() {
+		return nil
+	}
+	return s.offsets.flush(func(msgs []kafka.Message) error {
+		s.rLock.Lock()
+		defer s.rLock.Unlock()
+		select {
+		case <-s.pauser.closed:
+			return nil
+		default:
+		}
+		return s.reader.CommitMessages(context.Background(), msgs...)
+	})
+}
+
+func (s *Stream) newContext(m kafka.Message) *octx {
+	oniCtx := newContext(s.ctx, s.reader, m, s.producers)
+	oniCtx.pool = s.pool
+	oniCtx.codec = s.codec
+	oniCtx.validator = s.validator
+	oniCtx.invalidProducer = s.invalidProducer
+	oniCtx.replyProducer = s.replyProducer
+	oniCtx.outbox = s.outbox
+	if s.tracking() {
+		oniCtx.offsets = s.offsets
+	}
+	oniCtx.pausePartition = func(d time.Duration) {
+		s.pauser.pausePartition(topicPartition{topic: m.Topic, partition: m.Partition}, d)
+	}
+	return oniCtx
 }
 
 func (s *Stream) addHandler(key string, handlerFunc HandlerFunc, errorCallbackFunc ErrorCallbackFunc) {
@@ -114,6 +560,60 @@ func (s *Stream) addHandler(key string, handlerFunc HandlerFunc, errorCallbackFu
 	})
 }
 
+// addTopicHandler registers handler for message key of given topic only,
+// preferred over handler of the same key registered for every topic
+func (s *Stream) addTopicHandler(topic string, key string, handlerFunc HandlerFunc, errorCallbackFunc ErrorCallbackFunc) {
+	r := route{topic: topic, key: key}
+	s.topicHandlers[r] = append(s.topicHandlers[r], handler{
+		HandlerFunc:       handlerFunc,
+		ErrorCallbackFunc: errorCallbackFunc,
+	})
+}
+
+// lookup returns handlers of message topic and key, handlers of the key
+// registered for every topic, or no route handlers
+func (s *Stream) lookup(topic string, key string) []handler {
+	if handlers, ok := s.topicHandlers[route{topic: topic, key: key}]; ok {
+		return handlers
+	}
+	if handlers, ok := s.handlers[key]; ok {
+		return handlers
+	}
+	return s.noRoute
+}
+
+func (s *Stream) addNoRoute(handlerFunc HandlerFunc, errorCallbackFunc ErrorCallbackFunc) {
+	s.noRoute = append(s.noRoute, handler{
+		HandlerFunc:       handlerFunc,
+		ErrorCallbackFunc: errorCallbackFunc,
+	})
+}
+
+func (s *Stream) addMiddleware(middleware Middleware) {
+	s.middlewares = append(s.middlewares, middleware)
+}
+
+func (s *Stream) routes() int {
+	routes := len(s.handlers) + len(s.topicHandlers)
+	if len(s.noRoute) != 0 {
+		return routes + 1
+	}
+	return routes
+}
+
 func (s *Stream) addProducer(name string, producerFunc ProducerFunc) {
 	s.producers[name] = producerFunc
 }
+
+func (s *Stream) state() ConsumerState {
+	s.rLock.Lock()
+	config := s.reader.Config()
+	s.rLock.Unlock()
+	state := ConsumerState{Topic: config.Topic, GroupID: config.GroupID}
+	if len(state.Topic) == 0 && len(config.GroupTopics) != 0 {
+		state.Topic = config.GroupTopics[0]
+		state.Topics = config.GroupTopics
+	}
+	s.pauser.state(&state)
+	return state
+}
@@ -1,9 +1,12 @@
 package oni
 
 import (
+	"context"
+	"errors"
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/suite"
 	"testing"
+	"time"
 )
 
 type TestStreamSuite struct {
@@ -29,3 +32,98 @@ func (suite *ContextTestSuite) TestCloseProducersStream() {
 		suite.Assert().Len(s.producers, 0)
 	})
 }
+
+func (suite *TestStreamSuite) TestStreamMemoryTransport() {
+	suite.Run("TestStreamMemoryTransport", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		transport.CreateTopic("foos", 2)
+
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Producer("bars_producer", func() *kafka.Writer {
+			return BasicWriter(kafka.TCP("localhost:8097"), "bars")
+		})
+
+		var errs []error
+		consumer.ErrorHandler(func(err error) {
+			errs = append(errs, err)
+		})
+		consumer.Handler("create.foo", func(ctx Context) error {
+			ctx.SetHeader("X-Source", "foos")
+			return ctx.SendJSON("bars_producer", "create.bar", map[string]string{"foo": ctx.ValueString()})
+		})
+		consumer.Handler("delete.foo", func(ctx Context) error {
+			return errors.New("delete not supported")
+		})
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		w := transport.Writer("test_producer", BasicWriter(kafka.TCP("localhost:8097"), "foos"))
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("1")},
+			kafka.Message{Key: []byte("delete.foo"), Value: []byte("2")},
+			kafka.Message{Key: []byte("unknown.foo"), Value: []byte("3")},
+		))
+
+		suite.Assert().Eventually(func() bool {
+			return transport.CommittedOffset("consumer-group-foos", "foos", 0)+
+				transport.CommittedOffset("consumer-group-foos", "foos", 1) == 3
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		bars := transport.Messages("bars")
+		suite.Assert().Len(bars, 1)
+		suite.Assert().Equal(string(bars[0].Key), "create.bar")
+		suite.Assert().Equal(string(bars[0].Value), "{\"foo\":\"1\"}")
+		suite.Assert().Equal(bars[0].Headers, []kafka.Header{{Key: "X-Source", Value: []byte("foos")}})
+		suite.Assert().Equal(errs, []error{errors.New("delete not supported")})
+	})
+}
+
+func (suite *TestStreamSuite) TestStreamMiddleware() {
+	suite.Run("TestStreamMiddleware", func() {
+		s := NewStream(kafka.ReaderConfig{Topic: "foos"}, TransportOpt(NewMemoryTransport()))
+		s.ctx = context.Background()
+
+		var calls []string
+		var errs []error
+		trace := func(name string) Middleware {
+			return func(next HandlerFunc) HandlerFunc {
+				return func(ctx Context) error {
+					calls = append(calls, name+".before")
+					err := next(ctx)
+					calls = append(calls, name+".after")
+					return err
+				}
+			}
+		}
+		s.addMiddleware(trace("first"))
+		s.addMiddleware(trace("second"))
+		s.addHandler("create.foo", func(ctx Context) error {
+			calls = append(calls, "handler")
+			return errors.New("handler failed")
+		}, func(err error) {
+			errs = append(errs, err)
+		})
+
+		suite.Assert().EqualError(s.dispatch(kafka.Message{Key: []byte("create.foo")}), "handler failed")
+		suite.Assert().Equal(calls, []string{"first.before", "second.before", "handler", "second.after", "first.after"})
+		suite.Assert().Equal(errs, []error{errors.New("handler failed")})
+
+		s.addMiddleware(func(next HandlerFunc) HandlerFunc {
+			return func(ctx Context) error {
+				return errors.New("middleware failed")
+			}
+		})
+		suite.Assert().EqualError(s.dispatch(kafka.Message{Key: []byte("create.foo")}), "middleware failed")
+		suite.Assert().Equal(errs, []error{errors.New("handler failed"), errors.New("middleware failed")})
+	})
+}
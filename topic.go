@@ -0,0 +1,246 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultTopicRefresh = time.Minute
+
+var (
+	ErrTopicsUnsupported = errors.New("transport does not support listing topics")
+	errNoTopic           = errors.New("reader has no topic subscribed yet")
+)
+
+// TopicTransport implemented by transport which can list existing topics,
+// used by stream subscribed to topic pattern
+type TopicTransport interface {
+	Transport
+	Topics(ctx context.Context, config kafka.ReaderConfig) ([]string, error)
+}
+
+// route of handlers registered for message key of one topic,
+// empty topic routes message key of every stream topic
+type route struct {
+	topic string
+	key   string
+}
+
+// TopicsOpt subscribes stream to multiple topics using reader
+// GroupTopics, Topic and GroupTopics of reader configuration are
+// subscribed together with given topics, reader must define GroupID
+func TopicsOpt(topics ...string) StreamOption {
+	return func(s *Stream) {
+		s.topics = topics
+	}
+}
+
+// mergeTopics returns reader topic, group topics and topics of TopicsOpt
+// in given order without empty or repeated topics
+func mergeTopics(topic string, groupTopics []string, topics []string) []string {
+	merged := make([]string, 0, 1+len(groupTopics)+len(topics))
+	seen := make(map[string]bool)
+	for _, t := range append(append([]string{topic}, groupTopics...), topics...) {
+		if len(t) == 0 || seen[t] {
+			continue
+		}
+		seen[t] = true
+		merged = append(merged, t)
+	}
+	return merged
+}
+
+// TopicPatternOpt subscribes stream to every existing topic which whole name
+// matches pattern together with topics of TopicsOpt and reader configuration,
+// topics listed again every refresh interval, default 1 minute, and reader
+// rejoins its group subscribed to new topics once they are created, transport
+// must implement TopicTransport and reader must define GroupID
+func TopicPatternOpt(pattern *regexp.Regexp, refresh time.Duration) StreamOption {
+	return func(s *Stream) {
+		s.pattern = regexp.MustCompile("^(?:" + pattern.String() + ")$")
+		s.refresh = refresh
+		if s.refresh <= 0 {
+			s.refresh = defaultTopicRefresh
+		}
+	}
+}
+
+// Topics lists every topic except kafka internal topics using brokers of reader configuration
+func (kafkaTransport) Topics(ctx context.Context, config kafka.ReaderConfig) ([]string, error) {
+	return clientTopics(ctx, kafkaClient(config))
+}
+
+// clientTopics lists every topic except kafka internal topics of client cluster
+func clientTopics(ctx context.Context, client *kafka.Client) ([]string, error) {
+	metadata, err := client.Metadata(ctx, &kafka.MetadataRequest{})
+	if err != nil {
+		return nil, err
+	}
+	topics := make([]string, 0, len(metadata.Topics))
+	for _, t := range metadata.Topics {
+		if !t.Internal && t.Error == nil {
+			topics = append(topics, t.Name)
+		}
+	}
+	return topics, nil
+}
+
+// Topics lists every topic created or written into memory transport
+func (t *MemoryTransport) Topics(ctx context.Context, config kafka.ReaderConfig) ([]string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	topics := make([]string, 0, len(t.topics))
+	for topic := range t.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// newReader creates reader of stream transport, stream subscribed to topic
+// pattern which matched nothing yet waits using pendingReader instead, reader
+// of consumer group listens to its partition assignment once hooks registered
+func (s *Stream) newReader(config kafka.ReaderConfig) Reader {
+	if len(config.Topic) == 0 && len(config.GroupTopics) == 0 && s.pattern != nil {
+		return &pendingReader{config: config, closed: make(chan struct{})}
+	}
+	if r, ok := s.rebalanceReader(config); ok {
+		return r
+	}
+	return s.transport.Reader(config)
+}
+
+// matchTopics returns topics of TopicsOpt and existing topics matching
+// topic pattern sorted, or nil when matched topics are not changed
+func (s *Stream) matchTopics(ctx context.Context) ([]string, error) {
+	t, ok := s.transport.(TopicTransport)
+	if !ok {
+		return nil, ErrTopicsUnsupported
+	}
+
+	s.rLock.Lock()
+	config := s.reader.Config()
+	s.rLock.Unlock()
+	existing, err := t.Topics(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make(map[string]bool)
+	for _, topic := range s.topics {
+		matched[topic] = true
+	}
+	for _, topic := range existing {
+		if s.pattern.MatchString(topic) {
+			matched[topic] = true
+		}
+	}
+	topics := make([]string, 0, len(matched))
+	for topic := range matched {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	current := append([]string(nil), config.GroupTopics...)
+	sort.Strings(current)
+	if len(current) == len(topics) {
+		changed := false
+		for i := range topics {
+			if current[i] != topics[i] {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return nil, nil
+		}
+	}
+	return topics, nil
+}
+
+// refreshTopics requests resubscription once matched topics changed
+func (s *Stream) refreshTopics(ctx context.Context) error {
+	topics, err := s.matchTopics(ctx)
+	if err != nil || topics == nil {
+		return err
+	}
+	s.requestSeek(seek{topics: topics})
+	return nil
+}
+
+// watchTopics refreshes matched topics every refresh interval until stop closed
+func (s *Stream) watchTopics(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for {
+		if err := s.refreshTopics(s.ctx); err != nil {
+			s.callbackError(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// pollTopics refreshes matched topics before poll once refresh interval elapsed
+func (s *Stream) pollTopics(ctx context.Context) error {
+	if s.pattern == nil || time.Since(s.refreshed) < s.refresh {
+		return nil
+	}
+	s.refreshed = time.Now()
+	return s.refreshTopics(ctx)
+}
+
+// pendingReader waits until stream subscribed to topic pattern has any
+// topic to read from, the stream replaces it once topic matched
+type pendingReader struct {
+	config    kafka.ReaderConfig
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *pendingReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	return r.FetchMessage(ctx)
+}
+
+func (r *pendingReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	case <-r.closed:
+		return kafka.Message{}, io.EOF
+	}
+}
+
+func (r *pendingReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return errNoTopic
+}
+
+func (r *pendingReader) Stats() kafka.ReaderStats {
+	return kafka.ReaderStats{}
+}
+
+func (r *pendingReader) Config() kafka.ReaderConfig {
+	return r.config
+}
+
+func (r *pendingReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+	return nil
+}
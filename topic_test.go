@@ -0,0 +1,207 @@
+package oni
+
+import (
+	"context"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestTopicSuite struct {
+	suite.Suite
+}
+
+func TestTopicTestSuite(t *testing.T) {
+	suite.Run(t, new(TestTopicSuite))
+}
+
+func (suite *TestTopicSuite) TestTopicsOpt() {
+	suite.Run("TestTopicsOpt", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Topic:   "payments",
+			GroupID: "consumer-group-billing",
+		}, TopicsOpt("orders", "invoices"), TransportOpt(transport)))
+
+		var handled []string
+		consumer.Handler("create", func(ctx Context) error {
+			handled = append(handled, ctx.Message().Topic)
+			return nil
+		})
+
+		// reader topic subscribed together with topics of the option
+		for _, topic := range []string{"orders", "invoices", "payments"} {
+			w := transport.Writer("test_producer", &kafka.Writer{Topic: topic})
+			suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create")}))
+		}
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Nil(consumer.Poll(ctx))
+		sort.Strings(handled)
+		suite.Assert().Equal(handled, []string{"invoices", "orders", "payments"})
+
+		state := consumer.stream.state()
+		suite.Assert().Equal(state.Topic, "payments")
+		suite.Assert().Equal(state.Topics, []string{"payments", "orders", "invoices"})
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-billing", "invoices", 0), int64(1))
+	})
+}
+
+func (suite *TestTopicSuite) TestTopicPatternOpt() {
+	suite.Run("TestTopicPatternOpt", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			GroupID: "consumer-group-orders",
+		}, TopicPatternOpt(regexp.MustCompile(`orders\..*`), 10*time.Millisecond), TransportOpt(transport)))
+
+		var lock sync.Mutex
+		var handled []string
+		consumer.NoRoute(func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled = append(handled, ctx.Message().Topic)
+			return nil
+		})
+
+		done := make(chan struct{})
+		go func() {
+			consumer.run(ctx)
+			close(done)
+		}()
+
+		// topics created after stream started picked up on refresh
+		for _, topic := range []string{"orders.created", "invoices", "backorders.created"} {
+			w := transport.Writer("test_producer", &kafka.Writer{Topic: topic})
+			suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create")}))
+		}
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(handled) == 1
+		}, time.Second, time.Millisecond)
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "orders.cancelled"})
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("cancel")}))
+		suite.Assert().Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(handled) == 2
+		}, time.Second, time.Millisecond)
+
+		cancel()
+		<-done
+		suite.Assert().Equal(handled, []string{"orders.created", "orders.cancelled"})
+		suite.Assert().Equal(consumer.stream.state().Topics, []string{"orders.cancelled", "orders.created"})
+	})
+}
+
+func (suite *TestTopicSuite) TestPollTopicPattern() {
+	suite.Run("TestPollTopicPattern", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		transport.CreateTopic("orders.created", 1)
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			GroupID: "consumer-group-orders",
+		}, TopicPatternOpt(regexp.MustCompile(`orders\..*`), 0), TransportOpt(transport)))
+		suite.Assert().Equal(consumer.stream.refresh, time.Minute)
+
+		var handled int
+		consumer.Handler("create", func(ctx Context) error {
+			handled++
+			return nil
+		})
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "orders.created"})
+		suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: []byte("create")}))
+
+		suite.Assert().Nil(consumer.Poll(ctx))
+		suite.Assert().Equal(handled, 1)
+		suite.Assert().Equal(consumer.stream.state().Topics, []string{"orders.created"})
+	})
+}
+
+func (suite *TestTopicSuite) TestTopicRouting() {
+	suite.Run("TestTopicRouting", func() {
+		s := NewStream(kafka.ReaderConfig{GroupID: "consumer-group-billing"},
+			TopicsOpt("orders", "invoices"), TransportOpt(NewMemoryTransport()))
+
+		var handled []string
+		handlerFunc := func(name string) HandlerFunc {
+			return func(ctx Context) error {
+				handled = append(handled, name)
+				return nil
+			}
+		}
+		s.addHandler("create", handlerFunc("create"), nil)
+		s.addTopicHandler("invoices", "create", handlerFunc("invoices.create"), nil)
+		s.setTopicAckStrategy("invoices", "create", Manual)
+		s.addNoRoute(handlerFunc("no-route"), nil)
+		suite.Assert().Equal(s.routes(), 3)
+
+		s.ctx = context.Background()
+		for _, m := range []kafka.Message{
+			{Topic: "orders", Key: []byte("create")},
+			{Topic: "invoices", Key: []byte("create")},
+			{Topic: "invoices", Key: []byte("delete")},
+		} {
+			suite.Assert().Nil(s.dispatch(m))
+		}
+		suite.Assert().Equal(handled, []string{"create", "invoices.create", "no-route"})
+		suite.Assert().Equal(s.ackStrategy("orders", "create"), AutoAckBefore)
+		suite.Assert().Equal(s.ackStrategy("invoices", "create"), Manual)
+	})
+}
+
+func (suite *TestTopicSuite) TestConsumerTopic() {
+	suite.Run("TestConsumerTopic", func() {
+		ctx := context.Background()
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			GroupID: "consumer-group-billing",
+		}, TopicsOpt("orders", "invoices"), TransportOpt(transport)))
+
+		var handled []string
+		handlerFunc := func(name string) HandlerFunc {
+			return func(ctx Context) error {
+				handled = append(handled, fmt.Sprintf("%s:%s", name, ctx.Topic()))
+				return nil
+			}
+		}
+		consumer.Handler("create", handlerFunc("create"))
+		orders := consumer.Topic("orders")
+		orders.Handler("create", handlerFunc("orders.create"))
+		event := orders.Group("event")
+		event.AckStrategy(Manual)
+		event.Handler("cancel", handlerFunc("orders.event.cancel"))
+		consumer.Topic("invoices").Group("event").Handler("cancel", handlerFunc("invoices.event.cancel"))
+		suite.Assert().Equal(consumer.stream.routes(), 4)
+		suite.Assert().Equal(consumer.stream.ackStrategy("orders", "event.cancel"), Manual)
+		suite.Assert().Equal(consumer.stream.ackStrategy("invoices", "event.cancel"), AutoAckBefore)
+
+		for _, m := range []kafka.Message{
+			{Topic: "orders", Key: []byte("create")},
+			{Topic: "orders", Key: []byte("event.cancel")},
+			{Topic: "invoices", Key: []byte("create")},
+			{Topic: "invoices", Key: []byte("event.cancel")},
+		} {
+			w := transport.Writer("test_producer", &kafka.Writer{Topic: m.Topic})
+			suite.Assert().Nil(w.WriteMessages(ctx, kafka.Message{Key: m.Key}))
+		}
+		for i := 0; i < 4; i++ {
+			suite.Assert().Nil(consumer.Poll(ctx))
+		}
+		sort.Strings(handled)
+		suite.Assert().Equal(handled, []string{
+			"create:invoices",
+			"invoices.event.cancel:invoices",
+			"orders.create:orders",
+			"orders.event.cancel:orders",
+		})
+	})
+}
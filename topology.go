@@ -0,0 +1,193 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"strconv"
+	"time"
+)
+
+const HeaderRetryAttempt = "retry-attempt"
+
+// Topology routes message which handler returned error into retry topic
+// of each tier in order, message returned to main topic once its tier delay
+// elapsed and lands in dead letter topic after the last tier failed
+type Topology struct {
+	mainTopic string
+	tiers     []time.Duration
+	dlqTopic  string
+	writer    func(topic string) *kafka.Writer
+}
+
+// RetryTopology creates topology of main topic with retry topic for every
+// tier named after main topic and tier delay, for example foos-retry-5s
+func RetryTopology(mainTopic string, tiers []time.Duration, dlqTopic string) *Topology {
+	return &Topology{mainTopic: mainTopic, tiers: tiers, dlqTopic: dlqTopic}
+}
+
+// Topics returns retry topic of every tier followed by dead letter topic
+func (t *Topology) Topics() []string {
+	topics := make([]string, 0, len(t.tiers)+1)
+	for i := range t.tiers {
+		topics = append(topics, t.tierTopic(i))
+	}
+	return append(topics, t.dlqTopic)
+}
+
+// Writer sets func creating writer of main, retry and dead letter topics,
+// by default BasicWriter using brokers and dialer of main consumer reader
+func (t *Topology) Writer(writer func(topic string) *kafka.Writer) *Topology {
+	t.writer = writer
+	return t
+}
+
+func (t *Topology) tierTopic(i int) string {
+	return fmt.Sprintf("%s-retry-%s", t.mainTopic, formatTier(t.tiers[i]))
+}
+
+// tierGroup consumer group of tier reader named after main group and tier
+// delay, so every group subscribes to one topic and tiers do not rebalance
+// main consumer
+func (t *Topology) tierGroup(groupID string, i int) string {
+	if len(groupID) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s-retry-%s", groupID, formatTier(t.tiers[i]))
+}
+
+func formatTier(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	default:
+		return fmt.Sprintf("%dms", d/time.Millisecond)
+	}
+}
+
+// Bind registers producers of every topology topic and retry middleware
+// to consumer of main topic, then returns consumers of retry tiers using the
+// same reader configuration and transport which should be started together
+// with main consumer, every tier joins its own group named after main group
+// and tier delay, for example consumer-group-foos-retry-5s, consumer error
+// handler should be set before Bind
+func (t *Topology) Bind(consumer *Consumer) []*Consumer {
+	config := consumer.stream.reader.Config()
+	writer := t.writer
+	if writer == nil {
+		writer = func(topic string) *kafka.Writer {
+			w := BasicWriter(kafka.TCP(config.Brokers...), topic)
+			if config.Dialer != nil {
+				w.Transport = dialerTransport(config.Dialer)
+			}
+			return w
+		}
+	}
+	producer := func(topic string) ProducerFunc {
+		return func() *kafka.Writer {
+			return writer(topic)
+		}
+	}
+
+	consumer.Producer(t.mainTopic, producer(t.mainTopic))
+	for _, topic := range t.Topics() {
+		consumer.Producer(topic, producer(topic))
+	}
+	consumer.Use(t.retry(consumer))
+
+	tiers := make([]*Consumer, 0, len(t.tiers))
+	for i := range t.tiers {
+		tierConfig := config
+		tierConfig.Topic = t.tierTopic(i)
+		tierConfig.GroupID = t.tierGroup(config.GroupID, i)
+		tierConfig.GroupTopics = nil
+
+		tier := NewConsumer(NewStream(tierConfig, TransportOpt(consumer.stream.transport)))
+		tier.Producer(t.mainTopic, producer(t.mainTopic))
+		tier.Explicit()
+		tier.Use(Delay())
+		tier.ErrorHandler(consumer.callbackError)
+		tier.NoRoute(t.giveBack)
+		tiers = append(tiers, tier)
+	}
+	return tiers
+}
+
+// retry sends failed message into next tier or dead letter topic, message
+// is acknowledged once sent so it is not consumed again from main topic
+func (t *Topology) retry(consumer *Consumer) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) error {
+			err := next(ctx)
+			var d *delayed
+			if err == nil || errors.As(err, &d) {
+				return err
+			}
+
+			attempt, _ := strconv.Atoi(ctx.Header(HeaderRetryAttempt))
+			if sendErr := t.send(ctx, attempt); sendErr != nil {
+				return sendErr
+			}
+
+			if consumer.stream.ackStrategy(ctx.Message().Topic, ctx.KeyString()) != AutoAckBefore {
+				if ackErr := ctx.Ack(); ackErr != nil {
+					return ackErr
+				}
+			}
+			return err
+		}
+	}
+}
+
+func (t *Topology) send(ctx Context, attempt int) error {
+	value, err := json.Marshal(retry{OriginKey: ctx.KeyString(), Value: ctx.ValueString()})
+	if err != nil {
+		return err
+	}
+
+	headers := retryHeaders(ctx.Message().Headers)
+	headers = append(headers, kafka.Header{Key: HeaderRetryAttempt, Value: []byte(strconv.Itoa(attempt + 1))})
+	if attempt < len(t.tiers) {
+		key := fmt.Sprintf("%s.%s", "retry", ctx.KeyString())
+		return ctx.SendAfter(t.tierTopic(attempt), t.tiers[attempt], key, value, headers...)
+	}
+	key := fmt.Sprintf("%s.%s", "failed", ctx.KeyString())
+	return ctx.Send(t.dlqTopic, key, value, headers...)
+}
+
+// giveBack returns due message of retry tier into main topic with its origin key
+func (t *Topology) giveBack(ctx Context) error {
+	var retryData retry
+	if err := json.Unmarshal(ctx.ValueBytes(), &retryData); err != nil {
+		return err
+	}
+
+	headers := retryHeaders(ctx.Message().Headers)
+	if attempt := ctx.HeaderBytes(HeaderRetryAttempt); attempt != nil {
+		headers = append(headers, kafka.Header{Key: HeaderRetryAttempt, Value: attempt})
+	}
+	if err := ctx.Send(t.mainTopic, retryData.OriginKey, []byte(retryData.Value), headers...); err != nil {
+		return err
+	}
+	return ctx.Ack()
+}
+
+// retryHeaders copies headers of failed message except the ones managed by topology
+func retryHeaders(headers []kafka.Header) []kafka.Header {
+	copied := make([]kafka.Header, 0, len(headers)+1)
+	for _, header := range headers {
+		if header.Key != HeaderRetryAttempt && header.Key != HeaderDeliverAt {
+			copied = append(copied, header)
+		}
+	}
+	return copied
+}
@@ -0,0 +1,142 @@
+package oni
+
+import (
+	"context"
+	"errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TestTopologySuite struct {
+	suite.Suite
+}
+
+func TestTopologyTestSuite(t *testing.T) {
+	suite.Run(t, new(TestTopologySuite))
+}
+
+func (suite *TestTopologySuite) TestTopologyTopics() {
+	suite.Run("TestTopologyTopics", func() {
+		topology := RetryTopology("foos", []time.Duration{
+			5 * time.Second, time.Minute, 10 * time.Minute, 2 * time.Hour, 1500 * time.Millisecond,
+		}, "foos-dlq")
+		suite.Assert().Equal(topology.Topics(), []string{
+			"foos-retry-5s", "foos-retry-1m", "foos-retry-10m", "foos-retry-2h", "foos-retry-1500ms", "foos-dlq",
+		})
+	})
+}
+
+func (suite *TestTopologySuite) TestTopology() {
+	suite.Run("TestTopology", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := NewMemoryTransport()
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+		}, TransportOpt(transport)))
+		consumer.Explicit()
+
+		var lock sync.Mutex
+		var errs []error
+		consumer.ErrorHandler(func(err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			errs = append(errs, err)
+		})
+		attempts := map[string][]string{}
+		consumer.Handler("create.foo", func(ctx Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			attempts[ctx.ValueString()] = append(attempts[ctx.ValueString()], ctx.Header(HeaderRetryAttempt))
+			if ctx.ValueString() == "recovered" && len(attempts["recovered"]) == 2 {
+				return ctx.Ack()
+			}
+			return errors.New("payment unavailable")
+		})
+
+		topology := RetryTopology("foos", []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, "foos-dlq")
+		tiers := topology.Bind(consumer)
+		suite.Assert().Len(tiers, 2)
+		suite.Assert().Equal(tiers[1].stream.reader.Config().Topic, "foos-retry-20ms")
+		suite.Assert().Equal(tiers[1].stream.reader.Config().GroupID, "consumer-group-foos-retry-20ms")
+
+		var wg sync.WaitGroup
+		for _, c := range append([]*Consumer{consumer}, tiers...) {
+			wg.Add(1)
+			go func(c *Consumer) {
+				defer wg.Done()
+				c.run(ctx)
+			}(c)
+		}
+
+		w := transport.Writer("test_producer", &kafka.Writer{Topic: "foos"})
+		suite.Assert().Nil(w.WriteMessages(ctx,
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("failing"), Headers: []kafka.Header{
+				{Key: "trace-id", Value: []byte("1234")},
+			}},
+			kafka.Message{Key: []byte("create.foo"), Value: []byte("recovered")},
+		))
+
+		suite.Assert().Eventually(func() bool {
+			return len(transport.Messages("foos-dlq")) == 1
+		}, time.Second, time.Millisecond)
+		cancel()
+		wg.Wait()
+
+		suite.Assert().Equal(attempts, map[string][]string{
+			"failing":   {"", "1", "2"},
+			"recovered": {"", "1"},
+		})
+		suite.Assert().Len(errs, 4)
+
+		dlq := transport.Messages("foos-dlq")[0]
+		suite.Assert().Equal(string(dlq.Key), "failed.create.foo")
+		suite.Assert().Equal(string(dlq.Value), "{\"origin_key\":\"create.foo\",\"value\":\"failing\"}")
+		suite.Assert().Equal(dlq.Headers, []kafka.Header{
+			{Key: "trace-id", Value: []byte("1234")},
+			{Key: HeaderRetryAttempt, Value: []byte("3")},
+		})
+		suite.Assert().Len(transport.Messages("foos-retry-10ms"), 2)
+		suite.Assert().Len(transport.Messages("foos-retry-20ms"), 1)
+		suite.Assert().Len(transport.Messages("foos"), 5)
+
+		// every message acknowledged once handed over to next topic
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos", "foos", 0), int64(5))
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos-retry-10ms", "foos-retry-10ms", 0), int64(2))
+		suite.Assert().Equal(transport.CommittedOffset("consumer-group-foos-retry-20ms", "foos-retry-20ms", 0), int64(1))
+	})
+}
+
+func (suite *TestTopologySuite) TestTopologyWriter() {
+	suite.Run("TestTopologyWriter", func() {
+		dialer := &kafka.Dialer{ClientID: "foos-service"}
+		consumer := NewConsumer(NewStream(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "foos",
+			GroupID: "consumer-group-foos",
+			Dialer:  dialer,
+		}, TransportOpt(NewMemoryTransport())))
+
+		// default writer connects using reader dialer
+		tiers := RetryTopology("foos", []time.Duration{time.Second}, "foos-dlq").Bind(consumer)
+		w := consumer.stream.producers["foos-dlq"]()
+		suite.Assert().Equal(w.Topic, "foos-dlq")
+		suite.Assert().Equal(w.Transport, dialerTransport(dialer))
+		suite.Assert().Equal(tiers[0].stream.producers["foos"]().Topic, "foos")
+		closeConsumers(tiers)
+
+		tiers = RetryTopology("foos", []time.Duration{time.Second}, "foos-dlq").Writer(func(topic string) *kafka.Writer {
+			return BatchTimeoutWriter(kafka.TCP("localhost:8098"), topic, time.Second)
+		}).Bind(consumer)
+		w = consumer.stream.producers["foos-retry-1s"]()
+		suite.Assert().Equal(w.Addr, kafka.TCP("localhost:8098"))
+		suite.Assert().Equal(w.BatchTimeout, time.Second)
+		suite.Assert().Equal(tiers[0].stream.producers["foos"]().Addr, kafka.TCP("localhost:8098"))
+		closeConsumers(tiers)
+		suite.Assert().Nil(consumer.closeConsumers())
+	})
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"time"
+)
+
+var ErrSeekUnsupported = errors.New("reader or transport does not support seeking")
+
+// Transport creates readers used by Stream and writers used by
+// registered producers, writer created once for each producer name
+// default transport is KafkaTransport
+type Transport interface {
+	Reader(config kafka.ReaderConfig) Reader
+	Writer(name string, w *kafka.Writer) Writer
+}
+
+// Reader implemented by *kafka.Reader
+type Reader interface {
+	ReadMessage(ctx context.Context) (kafka.Message, error)
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Stats() kafka.ReaderStats
+	Config() kafka.ReaderConfig
+	Close() error
+}
+
+// SeekableReader implemented by *kafka.Reader, used to seek reader
+// which GroupID is not set, offset could be kafka.FirstOffset or kafka.LastOffset
+type SeekableReader interface {
+	Reader
+	SetOffset(offset int64) error
+	SetOffsetAt(ctx context.Context, t time.Time) error
+}
+
+// OffsetTransport implemented by transport which can look up offsets of topic
+// partitions, used to seek reader of consumer group by committing the offsets
+type OffsetTransport interface {
+	Transport
+	// OffsetsAt returns offset of first message produced at or after given time
+	// for every partition of topic, or their first offset when time is zero
+	OffsetsAt(ctx context.Context, config kafka.ReaderConfig, topic string, at time.Time) (map[int]int64, error)
+}
+
+// Writer implemented by *kafka.Writer
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type kafkaTransport struct{}
+
+// KafkaTransport returns transport which connects to kafka brokers
+// using kafka-go reader and writer, reader of consumer group fetches
+// its assigned partitions separately
+func KafkaTransport() Transport {
+	return kafkaTransport{}
+}
+
+// Reader creates kafka-go reader, reader of consumer group reads every
+// assigned partition using its own reader so single partition can be paused
+func (kafkaTransport) Reader(config kafka.ReaderConfig) Reader {
+	if len(config.GroupID) != 0 {
+		return newGroupReader(config, nil, nil)
+	}
+	return kafka.NewReader(config)
+}
+
+func (kafkaTransport) Writer(name string, w *kafka.Writer) Writer {
+	return w
+}
+
+// kafkaClient connects to brokers of reader configuration using its dialer
+func kafkaClient(config kafka.ReaderConfig) *kafka.Client {
+	client := &kafka.Client{Addr: kafka.TCP(config.Brokers...)}
+	if config.Dialer != nil {
+		client.Transport = dialerTransport(config.Dialer)
+	}
+	return client
+}
+
+// dialerTransport connects writer or client the same way reader dialer does,
+// including its TLS and SASL configuration
+func dialerTransport(d *kafka.Dialer) *kafka.Transport {
+	return &kafka.Transport{Dial: d.DialFunc, ClientID: d.ClientID, TLS: d.TLS, SASL: d.SASLMechanism}
+}
+
+// OffsetsAt lists partitions of topic then their offsets using brokers and dialer of reader configuration
+func (kafkaTransport) OffsetsAt(ctx context.Context, config kafka.ReaderConfig, topic string, at time.Time) (map[int]int64, error) {
+	client := kafkaClient(config)
+	metadata, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, err
+	}
+	var requests []kafka.OffsetRequest
+	for _, t := range metadata.Topics {
+		if t.Error != nil {
+			return nil, fmt.Errorf("topic %s: %w", topic, t.Error)
+		}
+		for _, partition := range t.Partitions {
+			if at.IsZero() {
+				requests = append(requests, kafka.FirstOffsetOf(partition.ID))
+			} else {
+				requests = append(requests, kafka.TimeOffsetOf(partition.ID, at))
+			}
+		}
+	}
+
+	listed, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{topic: requests}})
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[int]int64)
+	for _, partition := range listed.Topics[topic] {
+		if partition.Error != nil {
+			return nil, fmt.Errorf("topic %s partition %d: %w", topic, partition.Partition, partition.Error)
+		}
+		// broker answers timestamp -1 for first offset request and when no message
+		// produced after given time, kafka-go reports both as LastOffset
+		offsets[partition.Partition] = partition.LastOffset
+		for offset := range partition.Offsets {
+			offsets[partition.Partition] = offset
+		}
+	}
+	return offsets, nil
+}
@@ -0,0 +1,49 @@
+package oni
+
+import (
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type TestTransportSuite struct {
+	suite.Suite
+}
+
+func TestTransportTestSuite(t *testing.T) {
+	suite.Run(t, new(TestTransportSuite))
+}
+
+func (suite *TestTransportSuite) TestKafkaTransport() {
+	suite.Run("TestKafkaTransport", func() {
+		r := KafkaTransport().Reader(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+			GroupID: "consumer-group-test",
+		})
+		suite.Assert().IsType(&groupReader{}, r)
+		suite.Assert().Implements((*PartitionPausableReader)(nil), r)
+		suite.Assert().Equal(r.Config().Topic, "test")
+		suite.Assert().Nil(r.Close())
+
+		r = KafkaTransport().Reader(kafka.ReaderConfig{
+			Brokers: []string{"localhost:8097"},
+			Topic:   "test",
+		})
+		suite.Assert().IsType(&kafka.Reader{}, r)
+		suite.Assert().Nil(r.Close())
+
+		w := BasicWriter(kafka.TCP("localhost:8097"), "test")
+		suite.Assert().Same(KafkaTransport().Writer("test_producer", w), w)
+	})
+}
+
+func (suite *TestTransportSuite) TestTransportOpt() {
+	suite.Run("TestTransportOpt", func() {
+		transport := NewMemoryTransport()
+		s := NewStream(kafka.ReaderConfig{Topic: "test"}, TransportOpt(transport))
+		suite.Assert().Same(s.transport, transport)
+		suite.Assert().IsType(&memoryReader{}, s.reader)
+		suite.Assert().Same(s.pool.transport, transport)
+	})
+}
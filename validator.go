@@ -0,0 +1,249 @@
+// Copyright 2022 coffeehaze. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package oni
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownRule = errors.New("unknown validate rule")
+
+// checkedTypes holds result of checking `validate` tags of every
+// struct type validated so far, tags are checked once per type
+var checkedTypes sync.Map
+
+// Validator validates a bound message value, custom implementation
+// can be registered through IConsumer.Validator to replace the
+// default struct tag validator
+type Validator interface {
+	Validate(v interface{}) error
+}
+
+// FieldError describes single struct field that failed
+// one of its `validate` tag rules
+type FieldError struct {
+	Field string
+	Tag   string
+	Param string
+	Value interface{}
+}
+
+func (e FieldError) Error() string {
+	if len(e.Param) != 0 {
+		return fmt.Sprintf("field %s failed on %s=%s", e.Field, e.Tag, e.Param)
+	}
+	return fmt.Sprintf("field %s failed on %s", e.Field, e.Tag)
+}
+
+// ValidationErrors returned by the default validator, contains
+// every field error found in the validated struct
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fieldError := range e {
+		messages = append(messages, fieldError.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+type tagValidator struct{}
+
+// TagValidator returns default validator which reads `validate` struct tags,
+// supported rules are required, min, max, len and oneof, rules separated by comma
+// for example `validate:"required,min=1"`, struct which tag has unknown rule or
+// non numeric limit fails every validation with error wrapping ErrUnknownRule
+func TagValidator() Validator {
+	return tagValidator{}
+}
+
+func (tv tagValidator) Validate(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	if err := checkTags(rv.Type()); err != nil {
+		return err
+	}
+
+	var errs ValidationErrors
+	tv.validateStruct(rv, "", &errs)
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func (tv tagValidator) validateStruct(rv reflect.Value, namespace string, errs *ValidationErrors) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		name := sf.Name
+		if len(namespace) != 0 {
+			name = fmt.Sprintf("%s.%s", namespace, sf.Name)
+		}
+
+		fv := rv.Field(i)
+		if tag, ok := sf.Tag.Lookup("validate"); ok && tag != "-" {
+			for _, rule := range strings.Split(tag, ",") {
+				rule = strings.TrimSpace(rule)
+				if len(rule) == 0 {
+					continue
+				}
+				ruleTag, param, _ := strings.Cut(rule, "=")
+				if !checkRule(fv, ruleTag, param) {
+					*errs = append(*errs, FieldError{
+						Field: name,
+						Tag:   ruleTag,
+						Param: param,
+						Value: fv.Interface(),
+					})
+				}
+			}
+		}
+
+		for fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				break
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct {
+			tv.validateStruct(fv, name, errs)
+		}
+	}
+}
+
+// checkTags reports first rule of struct type or its nested struct
+// types which tag validator does not know, result cached per type
+func checkTags(rt reflect.Type) error {
+	if err, ok := checkedTypes.Load(rt); ok {
+		if err == nil {
+			return nil
+		}
+		return err.(error)
+	}
+	err := checkStructTags(rt, "", make(map[reflect.Type]bool))
+	checkedTypes.Store(rt, err)
+	return err
+}
+
+func checkStructTags(rt reflect.Type, namespace string, visited map[reflect.Type]bool) error {
+	if visited[rt] {
+		return nil
+	}
+	visited[rt] = true
+
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		name := sf.Name
+		if len(namespace) != 0 {
+			name = fmt.Sprintf("%s.%s", namespace, sf.Name)
+		}
+
+		if tag, ok := sf.Tag.Lookup("validate"); ok && tag != "-" {
+			for _, rule := range strings.Split(tag, ",") {
+				rule = strings.TrimSpace(rule)
+				if len(rule) == 0 {
+					continue
+				}
+				ruleTag, param, _ := strings.Cut(rule, "=")
+				if !knownRule(ruleTag, param) {
+					return fmt.Errorf("field %s: %w %q", name, ErrUnknownRule, rule)
+				}
+			}
+		}
+
+		ft := sf.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			if err := checkStructTags(ft, name, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func knownRule(tag string, param string) bool {
+	switch tag {
+	case "required", "oneof":
+		return true
+	case "min", "max", "len":
+		_, err := strconv.ParseFloat(param, 64)
+		return err == nil
+	}
+	return false
+}
+
+func checkRule(fv reflect.Value, tag string, param string) bool {
+	switch tag {
+	case "required":
+		return !fv.IsZero()
+	case "min":
+		return compareRule(fv, param, func(a, b float64) bool { return a >= b })
+	case "max":
+		return compareRule(fv, param, func(a, b float64) bool { return a <= b })
+	case "len":
+		return compareRule(fv, param, func(a, b float64) bool { return a == b })
+	case "oneof":
+		for _, option := range strings.Fields(param) {
+			if fmt.Sprint(fv.Interface()) == option {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func compareRule(fv reflect.Value, param string, cmp func(a, b float64) bool) bool {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return false
+	}
+
+	for fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			return true
+		}
+		fv = fv.Elem()
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		return cmp(float64(len([]rune(fv.String()))), limit)
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return cmp(float64(fv.Len()), limit)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp(float64(fv.Int()), limit)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp(float64(fv.Uint()), limit)
+	case reflect.Float32, reflect.Float64:
+		return cmp(fv.Float(), limit)
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package oni
+
+import (
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type TestValidatorSuite struct {
+	suite.Suite
+}
+
+func TestValidatorTestSuite(t *testing.T) {
+	suite.Run(t, new(TestValidatorSuite))
+}
+
+type dummyAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type dummyValidated struct {
+	Name    string        `json:"name" validate:"required,min=3,max=8"`
+	Amount  int           `json:"amount" validate:"min=1"`
+	Tags    []string      `json:"tags" validate:"len=2"`
+	Status  string        `json:"status" validate:"oneof=active inactive"`
+	Address *dummyAddress `json:"address" validate:"required"`
+}
+
+func (suite *TestValidatorSuite) TestTagValidatorValid() {
+	suite.Run("TestTagValidatorValid", func() {
+		err := TagValidator().Validate(&dummyValidated{
+			Name:    "foo",
+			Amount:  1,
+			Tags:    []string{"a", "b"},
+			Status:  "active",
+			Address: &dummyAddress{City: "Jakarta"},
+		})
+		suite.Assert().Nil(err)
+	})
+}
+
+func (suite *TestValidatorSuite) TestTagValidatorInvalid() {
+	suite.Run("TestTagValidatorInvalid", func() {
+		err := TagValidator().Validate(&dummyValidated{
+			Name:    "fo",
+			Amount:  0,
+			Tags:    []string{"a"},
+			Status:  "deleted",
+			Address: &dummyAddress{},
+		})
+
+		var validationErrors ValidationErrors
+		suite.Assert().True(errors.As(err, &validationErrors))
+		suite.Assert().Len(validationErrors, 5)
+		suite.Assert().Equal(FieldError{Field: "Name", Tag: "min", Param: "3", Value: "fo"}, validationErrors[0])
+		suite.Assert().Equal("Amount", validationErrors[1].Field)
+		suite.Assert().Equal("Tags", validationErrors[2].Field)
+		suite.Assert().Equal("oneof", validationErrors[3].Tag)
+		suite.Assert().Equal("Address.City", validationErrors[4].Field)
+		suite.Assert().Equal("field Name failed on min=3", validationErrors[0].Error())
+	})
+}
+
+func (suite *TestValidatorSuite) TestTagValidatorRequired() {
+	suite.Run("TestTagValidatorRequired", func() {
+		err := TagValidator().Validate(dummyValidated{Amount: 1, Tags: []string{"a", "b"}, Status: "active"})
+
+		var validationErrors ValidationErrors
+		suite.Assert().True(errors.As(err, &validationErrors))
+		suite.Assert().Len(validationErrors, 3)
+		suite.Assert().Equal("required", validationErrors[0].Tag)
+		suite.Assert().Equal("min", validationErrors[1].Tag)
+		suite.Assert().Equal("Address", validationErrors[2].Field)
+	})
+}
+
+func (suite *TestValidatorSuite) TestTagValidatorNonStruct() {
+	suite.Run("TestTagValidatorNonStruct", func() {
+		var nilPointer *dummyValidated
+		suite.Assert().Nil(TagValidator().Validate(nilPointer))
+		suite.Assert().Nil(TagValidator().Validate("string"))
+	})
+}
+
+type dummyMisspelled struct {
+	Name    string `json:"name" validate:"required"`
+	Address struct {
+		City string `json:"city" validate:"requried"`
+	} `json:"address"`
+}
+
+type dummyInvalidLimit struct {
+	Amount int `json:"amount" validate:"min=one"`
+}
+
+func (suite *TestValidatorSuite) TestTagValidatorUnknownRule() {
+	suite.Run("TestTagValidatorUnknownRule", func() {
+		// reported even though value is valid otherwise, every time type validated
+		for i := 0; i < 2; i++ {
+			err := TagValidator().Validate(&dummyMisspelled{Name: "foo"})
+			suite.Assert().ErrorIs(err, ErrUnknownRule)
+			suite.Assert().EqualError(err, "field Address.City: unknown validate rule \"requried\"")
+		}
+		err := TagValidator().Validate(dummyInvalidLimit{Amount: 1})
+		suite.Assert().EqualError(err, "field Amount: unknown validate rule \"min=one\"")
+	})
+}